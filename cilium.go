@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"gopkg.in/yaml.v3"
+)
+
+// ciliumValuesFile is where the first server of a Cilium cluster keeps its Helm values
+const ciliumValuesFile = "$HOME/.cilium/values.yaml"
+
+// ciliumValuesParams fill scripts/cilium-values.sh.tmpl
+type ciliumValuesParams struct {
+	Service    string
+	HostIP     string
+	Values     string // Merged Helm values as YAML
+	ValuesFile string
+	Version    string // Cilium chart version
+}
+
+// defaultLoadBalancerPools are the LoadBalancer IP ranges of each cluster type, for Cilium or
+// MetalLB clusters whose config sets no pools
+var defaultLoadBalancerPools = map[string][2]string{
+	"k3s":     {"192.168.91.10", "192.168.91.15"},
+	"rke2":    {"192.168.91.20", "192.168.91.25"},
+	"kubeadm": {"192.168.91.30", "192.168.91.35"},
+}
+
+// ciliumGatewayParams fill scripts/cilium-gateway.sh.tmpl. The certificates with source files
+// are read from stdin as TLS_CERT_<index> and TLS_KEY_<index>, their index in
+// Gateway.Certificates.
+type ciliumGatewayParams struct {
+	Kubectl     string // kubectl invocation including the cluster's kubeconfig
+	ServiceName string
+	Pools       []CiliumPoolBlock
+	L2          CiliumL2Policy
+	Gateway     CiliumGateway
+	IPAM        bool // Cilium serves LoadBalancer services, so the pool and L2 policy are applied
+}
+
+// defaultCiliumValues are the Helm values every Cilium cluster starts from: kube-proxy
+// replacement talking to the first server, Hubble relay, Gateway API and, unless another
+// loadBalancerProvider serves LoadBalancer services, L2 announcements
+func defaultCiliumValues(apiServerIP string, l2Announcements bool) map[string]interface{} {
+	return map[string]interface{}{
+		"kubeProxyReplacement": true,
+		"k8sServiceHost":       apiServerIP,
+		"k8sServicePort":       6443,
+		"hubble":               map[string]interface{}{"relay": map[string]interface{}{"enabled": true}},
+		"l2announcements":      map[string]interface{}{"enabled": l2Announcements},
+		"externalIPs":          map[string]interface{}{"enabled": true},
+		"envoy":                map[string]interface{}{"enabled": true},
+		"gatewayAPI": map[string]interface{}{
+			"enabled":           true,
+			"enableAlpn":        true,
+			"enableAppProtocol": true,
+		},
+		"securityContext": map[string]interface{}{
+			"capabilities": map[string]interface{}{"keepCapNetBindService": true},
+		},
+	}
+}
+
+// ciliumOptions returns the `cilium` config of a cluster
+func ciliumOptions(config *ServiceConfig) (CiliumOptions, error) {
+	var options CiliumOptions
+	if raw, set := config.Config["cilium"]; set {
+		if err := decodeConfigValue(raw, &options); err != nil {
+			return options, fmt.Errorf("invalid cilium config: %w", err)
+		}
+	}
+	return options, nil
+}
+
+// ciliumValues returns the Helm values of a Cilium cluster as YAML: cilium.values, inline or
+// read from its file, merged over defaultCiliumValues the way config layers merge, so a null
+// removes a default
+func ciliumValues(config *ServiceConfig, apiServerIP string) (string, error) {
+	options, err := ciliumOptions(config)
+	if err != nil {
+		return "", err
+	}
+	var values interface{} = defaultCiliumValues(apiServerIP, loadBalancerProvider(config) == "cilium")
+	switch overlay := options.Values.(type) {
+	case nil:
+	case string:
+		data, err := os.ReadFile(overlay)
+		if err != nil {
+			return "", err
+		}
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return "", fmt.Errorf("%s: %w", overlay, err)
+		}
+		fileValues, ok := jsonValue(document).(map[string]interface{})
+		if document != nil && !ok {
+			return "", fmt.Errorf("%s: must be a YAML mapping", overlay)
+		}
+		values = mergeLayer(values, fileValues)
+	case map[string]interface{}:
+		values = mergeLayer(values, overlay)
+	default:
+		return "", fmt.Errorf("must be a map or the path of a YAML file, got %v", overlay)
+	}
+	var encoded bytes.Buffer
+	encoder := yaml.NewEncoder(&encoded)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(values); err != nil {
+		return "", err
+	}
+	return encoded.String(), nil
+}
+
+// installCiliumValues writes the Helm values of a Cilium cluster to its first server, whose
+// install runs helm from them, and returns what that install waits for. The command runs again
+// when the hash of the values changes and upgrades the running release, so values edits reach
+// existing clusters without reinstalling the server. Clusters with another CNI get serverReady
+// back.
+func installCiliumValues(ctx *pulumi.Context, serviceCtx ServiceContext, server Host, serverReady pulumi.Resource, cni cniParams) (pulumi.Resource, error) {
+	if cni.Name != "cilium" {
+		return serverReady, nil
+	}
+	values, err := ciliumValues(serviceCtx.ServiceConfig, cni.APIServerIP)
+	if err != nil {
+		return nil, err
+	}
+	script, err := renderScript("cilium-values.sh.tmpl", ciliumValuesParams{
+		Service:    serviceCtx.ServiceName,
+		HostIP:     server.IP,
+		Values:     values,
+		ValuesFile: cni.ValuesFile,
+		Version:    cni.Versions.Cilium,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := remote.NewCommand(ctx, fmt.Sprintf("%s-cilium-values", serviceCtx.ServiceName), &remote.CommandArgs{
+		Connection: sshConnection(server),
+		Create:     pulumi.String(script),
+		Update:     pulumi.String(script),
+		Triggers:   pulumi.Array{pulumi.String(contentHash(values))},
+	}, pulumi.DependsOn(serviceCtx.after(serverReady)), pulumi.Timeouts(&pulumi.CustomTimeouts{Create: "10m", Update: "10m"}))
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// Names and labels the gateway manifests take as they are
+var (
+	kubernetesNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	hostnamePattern       = regexp.MustCompile(`^(\*\.)?[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	labelKeyPattern       = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelValuePattern     = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+)
+
+// validateCiliumConfig checks the cilium map of every enabled cluster: only clusters running
+// Cilium take one, its values have to merge into a values document, and its L2 policy and
+// gateway have to make valid manifests
+func validateCiliumConfig(services Services, errs *ConfigErrors) {
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		raw, set := config.Config["cilium"]
+		if !set {
+			continue
+		}
+		path := fmt.Sprintf("services.%s.config.cilium", name)
+		if !isClusterType(config.Type) || clusterCNI(config) != "cilium" {
+			errs.add(path, "only used by k3s, rke2 and kubeadm clusters with cni cilium")
+			continue
+		}
+		before := len(*errs)
+		checkSchema(raw, jsonSchemaFor(reflect.TypeOf(CiliumOptions{})), path, errs)
+		if len(*errs) > before {
+			continue
+		}
+		if _, err := ciliumValues(config, ""); err != nil {
+			errs.add(path+".values", "%v", err)
+		}
+		options, _ := ciliumOptions(config)
+		if loadBalancerProvider(config) != "cilium" {
+			for _, field := range []string{"pools", "l2"} {
+				if _, set := raw.(map[string]interface{})[field]; set {
+					errs.add(path+"."+field, "not used with loadBalancerProvider %s", loadBalancerProvider(config))
+				}
+			}
+		}
+		if options.L2 != nil {
+			validateCiliumL2Policy(*options.L2, path+".l2", errs)
+		}
+		if options.Gateway != nil {
+			validateCiliumGateway(*options.Gateway, path+".gateway", errs)
+		}
+	}
+}
+
+// validateCiliumL2Policy checks the interfaces and selectors of an L2 announcement policy
+func validateCiliumL2Policy(policy CiliumL2Policy, path string, errs *ConfigErrors) {
+	for i, pattern := range policy.Interfaces {
+		if _, err := regexp.Compile(pattern); err != nil || strings.Contains(pattern, "'") {
+			errs.add(fmt.Sprintf("%s.interfaces[%d]", path, i), "must be a regular expression without quotes, got %q", pattern)
+		}
+	}
+	for _, selector := range []struct {
+		field  string
+		labels map[string]string
+	}{{"nodeSelector", policy.NodeSelector}, {"serviceSelector", policy.ServiceSelector}} {
+		keys := make([]string, 0, len(selector.labels))
+		for key := range selector.labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !labelKeyPattern.MatchString(key) || !labelValuePattern.MatchString(selector.labels[key]) {
+				errs.add(path+"."+selector.field, "%s=%s is not a valid label", key, selector.labels[key])
+			}
+		}
+	}
+}
+
+// validateCiliumGateway checks the listeners and certificates of a gateway: names are unique,
+// HTTPS listeners refer to a certificate and every certificate has what its source needs
+func validateCiliumGateway(gateway CiliumGateway, path string, errs *ConfigErrors) {
+	if gateway.Name != "" && !kubernetesNamePattern.MatchString(gateway.Name) {
+		errs.add(path+".name", "%q is not a valid Kubernetes name", gateway.Name)
+	}
+	if gateway.Namespace != "" && !kubernetesNamePattern.MatchString(gateway.Namespace) {
+		errs.add(path+".namespace", "%q is not a valid Kubernetes name", gateway.Namespace)
+	}
+
+	certificates := map[string]GatewayCertificate{}
+	for i, certificate := range gateway.Certificates {
+		certPath := fmt.Sprintf("%s.certificates[%d]", path, i)
+		if !kubernetesNamePattern.MatchString(certificate.Name) {
+			errs.add(certPath+".name", "%q is not a valid Kubernetes name", certificate.Name)
+		} else if _, duplicate := certificates[certificate.Name]; duplicate {
+			errs.add(certPath+".name", "certificate %s is declared twice", certificate.Name)
+		}
+		certificates[certificate.Name] = certificate
+		if certificate.Namespace != "" && !kubernetesNamePattern.MatchString(certificate.Namespace) {
+			errs.add(certPath+".namespace", "%q is not a valid Kubernetes name", certificate.Namespace)
+		}
+
+		fileSource := certificate.Source == "files"
+		certManagerSource := certificate.Source == "cert-manager"
+		if !fileSource && (certificate.CertFile != "" || certificate.KeyFile != "") {
+			errs.add(certPath, "certFile and keyFile are only used with source files")
+		}
+		if fileSource && (certificate.CertFile == "") != (certificate.KeyFile == "") {
+			errs.add(certPath, "needs both certFile and keyFile, or neither to use the tlsCert and tlsKey credentials")
+		}
+		for _, file := range []string{certificate.CertFile, certificate.KeyFile} {
+			if fileSource && file != "" {
+				if _, err := os.Stat(file); err != nil {
+					errs.add(certPath, "%v", err)
+				}
+			}
+		}
+		if !certManagerSource && (certificate.Issuer != "" || certificate.IssuerKind != "") {
+			errs.add(certPath, "issuer and issuerKind are only used with source cert-manager")
+		}
+		if certManagerSource && !kubernetesNamePattern.MatchString(certificate.Issuer) {
+			errs.add(certPath+".issuer", "must name the cert-manager issuer, got %q", certificate.Issuer)
+		}
+	}
+
+	if len(gateway.Listeners) == 0 {
+		errs.add(path+".listeners", "needs at least one listener")
+	}
+	listeners := map[string]bool{}
+	issued := map[string]bool{}
+	for i, listener := range gateway.Listeners {
+		listenerPath := fmt.Sprintf("%s.listeners[%d]", path, i)
+		if !kubernetesNamePattern.MatchString(listener.Name) {
+			errs.add(listenerPath+".name", "%q is not a valid Kubernetes name", listener.Name)
+		} else if listeners[listener.Name] {
+			errs.add(listenerPath+".name", "listener %s is declared twice", listener.Name)
+		}
+		listeners[listener.Name] = true
+		if listener.Hostname != "" && !hostnamePattern.MatchString(listener.Hostname) {
+			errs.add(listenerPath+".hostname", "%q is not a valid hostname", listener.Hostname)
+		}
+		if listener.Port < 1 || listener.Port > 65535 {
+			errs.add(listenerPath+".port", "must be between 1 and 65535, got %d", listener.Port)
+		}
+		switch {
+		case listener.Certificate == "" && listener.Protocol == "HTTPS":
+			errs.add(listenerPath+".certificate", "required for HTTPS listeners")
+		case listener.Certificate != "" && listener.Protocol == "HTTP":
+			errs.add(listenerPath+".certificate", "not used by HTTP listeners")
+		case listener.Certificate != "":
+			certificate, declared := certificates[listener.Certificate]
+			if !declared {
+				errs.add(listenerPath+".certificate", "%s is not one of the gateway certificates", listener.Certificate)
+			} else if certificate.Source == "cert-manager" && listener.Hostname != "" {
+				issued[certificate.Name] = true
+			}
+		}
+	}
+	for i, certificate := range gateway.Certificates {
+		if certificate.Source == "cert-manager" && !issued[certificate.Name] {
+			errs.add(fmt.Sprintf("%s.certificates[%d]", path, i), "cert-manager certificates need a listener with a hostname to issue them for")
+		}
+	}
+}
+
+// ciliumPoolBlocks returns the LoadBalancer IP blocks of a Cilium cluster: cilium.pools, or
+// else the range of cilium-pool-start and cilium-pool-stop, which default to the range of the
+// cluster type
+func ciliumPoolBlocks(config *ServiceConfig) ([]CiliumPoolBlock, error) {
+	options, err := ciliumOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Pools) > 0 {
+		return options.Pools, nil
+	}
+	pool := defaultLoadBalancerPools[config.Type]
+	return []CiliumPoolBlock{{
+		Start: getConfigString(config.Config, "cilium-pool-start", pool[0]),
+		Stop:  getConfigString(config.Config, "cilium-pool-stop", pool[1]),
+	}}, nil
+}
+
+// ciliumPoolRange returns the first and last IPv4 address of a pool block
+func ciliumPoolRange(block CiliumPoolBlock) (net.IP, net.IP, error) {
+	if block.CIDR != "" {
+		if block.Start != "" || block.Stop != "" {
+			return nil, nil, fmt.Errorf("takes either cidr or start and stop")
+		}
+		_, network, err := net.ParseCIDR(block.CIDR)
+		if err != nil || network.IP.To4() == nil {
+			return nil, nil, fmt.Errorf("cidr must be an IPv4 network, got %q", block.CIDR)
+		}
+		first, last := network.IP.To4(), make(net.IP, net.IPv4len)
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+		return first, last, nil
+	}
+	start, stop := net.ParseIP(block.Start).To4(), net.ParseIP(block.Stop).To4()
+	if start == nil || stop == nil {
+		return nil, nil, fmt.Errorf("needs a cidr, or start and stop IPv4 addresses, got %q-%q", block.Start, block.Stop)
+	}
+	if bytes.Compare(start, stop) > 0 {
+		return nil, nil, fmt.Errorf("start %s is after stop %s", block.Start, block.Stop)
+	}
+	return start, stop, nil
+}
+
+// Names of the gateway every Cilium cluster got before cilium.gateway existed. They stay the
+// defaults so existing clusters update these objects in place, and the argocd manifests that
+// reference the secret keep working.
+const (
+	defaultGatewayName   = "rancher-master-gateway"
+	defaultGatewaySecret = "rajesh-tls-cert"
+)
+
+// ciliumGateway returns the gateway of a Cilium cluster with its defaults filled in. Without a
+// cilium.gateway, that is one HTTPS listener on 443 terminating TLS with the tlsCert and tlsKey
+// credentials.
+func ciliumGateway(config *ServiceConfig, serviceName string) (CiliumGateway, error) {
+	options, err := ciliumOptions(config)
+	if err != nil {
+		return CiliumGateway{}, err
+	}
+	var gateway CiliumGateway
+	if options.Gateway != nil {
+		gateway = *options.Gateway
+	} else {
+		gateway.Name = defaultGatewayName
+		gateway.Listeners = []GatewayListener{{Name: defaultGatewayName, Port: 443, Protocol: "HTTPS", Certificate: defaultGatewaySecret}}
+		gateway.Certificates = []GatewayCertificate{{Name: defaultGatewaySecret, Source: "files"}}
+	}
+	if gateway.Name == "" {
+		gateway.Name = serviceName + "-gateway"
+	}
+	if gateway.Namespace == "" {
+		gateway.Namespace = "cilium-gateway"
+	}
+	gateway.Certificates = append([]GatewayCertificate(nil), gateway.Certificates...)
+	for i := range gateway.Certificates {
+		certificate := &gateway.Certificates[i]
+		if certificate.Namespace == "" {
+			certificate.Namespace = "certificates"
+		}
+		if certificate.Source == "cert-manager" && certificate.IssuerKind == "" {
+			certificate.IssuerKind = "ClusterIssuer"
+		}
+	}
+	return gateway, nil
+}
+
+// Certificate returns the certificate listeners refer to as name
+func (g CiliumGateway) Certificate(name string) GatewayCertificate {
+	for _, certificate := range g.Certificates {
+		if certificate.Name == name {
+			return certificate
+		}
+	}
+	return GatewayCertificate{}
+}
+
+// Hostnames returns the hostnames of the listeners using a certificate, the names a
+// cert-manager Certificate is issued for
+func (g CiliumGateway) Hostnames(certificate string) []string {
+	var hostnames []string
+	seen := map[string]bool{}
+	for _, listener := range g.Listeners {
+		if listener.Certificate == certificate && listener.Hostname != "" && !seen[listener.Hostname] {
+			seen[listener.Hostname] = true
+			hostnames = append(hostnames, listener.Hostname)
+		}
+	}
+	return hostnames
+}
+
+// Namespaces returns the namespace of the gateway, then those of its certificates
+func (g CiliumGateway) Namespaces() []string {
+	return append([]string{g.Namespace}, g.CertificateNamespaces()...)
+}
+
+// ReferenceGrantName names the ReferenceGrants of the gateway; the default gateway keeps the
+// name its grant always had
+func (g CiliumGateway) ReferenceGrantName() string {
+	if g.Name == defaultGatewayName {
+		return "allow-gateway-to-use-cert"
+	}
+	return "allow-" + g.Name
+}
+
+// CertificateNamespaces returns the namespaces of the certificates other than the gateway's,
+// which each need a ReferenceGrant for the gateway to read their secrets
+func (g CiliumGateway) CertificateNamespaces() []string {
+	var namespaces []string
+	seen := map[string]bool{g.Namespace: true}
+	for _, certificate := range g.Certificates {
+		if !seen[certificate.Namespace] {
+			seen[certificate.Namespace] = true
+			namespaces = append(namespaces, certificate.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// gatewayCertificateSecrets returns the stdin of scripts/cilium-gateway.sh.tmpl: the PEM
+// certificate and key of every certificate with source files, from its files or else the
+// tlsCert and tlsKey credentials
+func gatewayCertificateSecrets(gateway CiliumGateway) (map[string]string, error) {
+	secrets := map[string]string{}
+	for i, certificate := range gateway.Certificates {
+		if certificate.Source != "files" {
+			continue
+		}
+		certData, keyData := credential("tlsCert"), credential("tlsKey")
+		if certificate.CertFile != "" {
+			cert, err := os.ReadFile(certificate.CertFile)
+			if err != nil {
+				return nil, fmt.Errorf("certificate %s: %w", certificate.Name, err)
+			}
+			key, err := os.ReadFile(certificate.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("certificate %s: %w", certificate.Name, err)
+			}
+			certData, keyData = string(cert), string(key)
+		}
+		if certData == "" || keyData == "" {
+			return nil, fmt.Errorf(`TLS certificate %s for the Cilium gateway not found.
+		Set its certFile and keyFile, declare credentials.tlsCert and credentials.tlsKey, or export:
+  			export TLS_CERT_PATH="./selfSignedCerts/tls.crt"
+  			export TLS_KEY_PATH="./selfSignedCerts/tls.key"`, certificate.Name)
+		}
+		secrets[fmt.Sprintf("TLS_CERT_%d", i)] = certData
+		secrets[fmt.Sprintf("TLS_KEY_%d", i)] = keyData
+	}
+	return secrets, nil
+}
+
+// deployCiliumGateway applies the gateway of a Cilium cluster from its cilium config once
+// LoadBalancer services can get an address, with the LoadBalancer IP pool and the L2
+// announcement policy when Cilium serves them. The command runs again when that config or a
+// certificate changes.
+func deployCiliumGateway(ctx *pulumi.Context, serviceCtx ServiceContext, server Host, loadBalancerReady pulumi.Resource) (*remote.Command, error) {
+	config := serviceCtx.ServiceConfig
+	kubectlCmd, err := clusterKubectl(config.Type)
+	if err != nil {
+		return nil, err
+	}
+	options, err := ciliumOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := ciliumPoolBlocks(config)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := ciliumGateway(config, serviceCtx.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := gatewayCertificateSecrets(gateway)
+	if err != nil {
+		return nil, err
+	}
+	params := ciliumGatewayParams{
+		Kubectl:     kubectlCmd,
+		ServiceName: serviceCtx.ServiceName,
+		Pools:       pools,
+		Gateway:     gateway,
+		IPAM:        loadBalancerProvider(config) == "cilium",
+	}
+	if options.L2 != nil {
+		params.L2 = *options.L2
+	}
+
+	deployScript, err := renderScript("cilium-gateway.sh.tmpl", params)
+	if err != nil {
+		return nil, err
+	}
+
+	return remote.NewCommand(ctx, fmt.Sprintf("cilium-gateway-setup-%s", serviceCtx.ServiceName), &remote.CommandArgs{
+		Connection: sshConnection(server),
+		Create:     pulumi.String(deployScript),
+		Update:     pulumi.String(deployScript),
+		Stdin:      secretStdin(secrets),
+	}, pulumi.DependsOn([]pulumi.Resource{loadBalancerReady}))
+}
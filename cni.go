@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cniPlugins are the CNIs a cluster can run, with the cluster types whose distribution ships
+// them. A shipped CNI is switched on by the server flags; the others are installed on the
+// first server by their scripts/cni-<name>.sh.tmpl module. Cilium always comes from its own
+// chart, since the clusters rely on its kube-proxy replacement and Gateway API support.
+var cniPlugins = map[string][]string{
+	"cilium":  nil,
+	"calico":  {"rke2"},
+	"canal":   {"rke2"},
+	"flannel": {"k3s", "rke2"},
+}
+
+// defaultPodCIDRs are the pod networks of the cluster types that do not configure one
+var defaultPodCIDRs = map[string]string{
+	"k3s":     "10.42.0.0/16",
+	"rke2":    "10.42.0.0/16",
+	"kubeadm": "10.244.0.0/16",
+}
+
+// cniParams fill the CNI module a cluster's first server runs, and the server flags of the CNI
+type cniParams struct {
+	Name        string
+	ClusterType string
+	Bundled     bool   // The distribution ships the CNI, so the module only has to leave it on
+	Kubectl     string // kubectl invocation including the cluster's kubeconfig
+	APIServerIP string // Server Cilium reaches the API on, as it replaces kube-proxy
+	PodCIDR     string
+	ValuesFile  string // Cilium Helm values on the first server, see installCiliumValues
+	Versions    ClusterVersions
+}
+
+// clusterCNI returns the CNI a cluster runs, from cni in its config
+func clusterCNI(config *ServiceConfig) string {
+	return getConfigString(config.Config, "cni", "cilium")
+}
+
+// clusterPodCIDR returns the pod network of a cluster: pod-cidr for kubeadm, the distribution
+// default for K3s and RKE2
+func clusterPodCIDR(config *ServiceConfig) string {
+	if config.Type == "kubeadm" {
+		return getConfigString(config.Config, "pod-cidr", defaultPodCIDRs["kubeadm"])
+	}
+	return defaultPodCIDRs[config.Type]
+}
+
+// clusterCNIParams returns the CNI module parameters of a cluster whose first server is apiServerIP
+func clusterCNIParams(config *ServiceConfig, apiServerIP string) (cniParams, error) {
+	kubectl, err := clusterKubectl(config.Type)
+	if err != nil {
+		return cniParams{}, err
+	}
+	name := clusterCNI(config)
+	bundled := false
+	for _, clusterType := range cniPlugins[name] {
+		bundled = bundled || clusterType == config.Type
+	}
+	return cniParams{
+		Name:        name,
+		ClusterType: config.Type,
+		Bundled:     bundled,
+		Kubectl:     kubectl,
+		APIServerIP: apiServerIP,
+		PodCIDR:     clusterPodCIDR(config),
+		ValuesFile:  ciliumValuesFile,
+		Versions:    clusterVersions(config),
+	}, nil
+}
+
+// KubeProxyReplacement reports whether the CNI takes over from kube-proxy, which the servers
+// then leave out
+func (c cniParams) KubeProxyReplacement() bool {
+	return c.Name == "cilium"
+}
+
+// FlannelBackend returns the --flannel-backend of K3s servers: the embedded flannel, or none
+// for a CNI installed next to K3s
+func (c cniParams) FlannelBackend() string {
+	if c.Name == "flannel" {
+		return "vxlan"
+	}
+	return "none"
+}
+
+// RKE2CNI returns the cni of the RKE2 config. Cilium is installed from its own chart, so RKE2
+// starts without a CNI for it.
+func (c cniParams) RKE2CNI() string {
+	if c.Name == "cilium" {
+		return "none"
+	}
+	return c.Name
+}
+
+// validateClusterCNIs checks the cni of every enabled service: only clusters take one, and it
+// has to be one of cniPlugins
+func validateClusterCNIs(services Services, errs *ConfigErrors) {
+	plugins := make([]string, 0, len(cniPlugins))
+	for plugin := range cniPlugins {
+		plugins = append(plugins, plugin)
+	}
+	sort.Strings(plugins)
+
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		raw, set := config.Config["cni"]
+		if !set {
+			continue
+		}
+		path := fmt.Sprintf("services.%s.config.cni", name)
+		if !isClusterType(config.Type) {
+			errs.add(path, "only used by k3s, rke2 and kubeadm clusters")
+			continue
+		}
+		value, _ := raw.(string)
+		if _, known := cniPlugins[value]; !known {
+			errs.add(path, "must be one of %s, got %v", strings.Join(plugins, ", "), raw)
+		}
+	}
+}
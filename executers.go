@@ -2,15 +2,158 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
+// serviceTypes holds every service type a config instance can use, filled by registerServiceType
+var serviceTypes = map[string]ServiceType{}
+
+// registerServiceType makes a service type available under services.<instance>.type.
+// Handlers register themselves from an init function next to their implementation.
+func registerServiceType(name string, serviceType ServiceType) {
+	if _, exists := serviceTypes[name]; exists {
+		panic(fmt.Sprintf("service type %s registered twice", name))
+	}
+	serviceTypes[name] = serviceType
+}
+
+// serviceTypeNames returns the registered service types in alphabetical order
+func serviceTypeNames() []string {
+	names := make([]string, 0, len(serviceTypes))
+	for name := range serviceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedServiceNames returns the names of the configured service instances in alphabetical
+// order, so validation reports them in a stable order
+func sortedServiceNames(services Services) []string {
+	names := make([]string, 0, len(services))
+	for name, config := range services {
+		if config != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedEnabledServices returns the names of the enabled service instances in alphabetical order
+func sortedEnabledServices(services Services) []string {
+	var names []string
+	for _, name := range sortedServiceNames(services) {
+		if services[name].Enabled {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isClusterType reports whether a service type installs a Kubernetes cluster this stack sets
+// up itself, with a CNI, versions, a load balancer and LoadBalancer pools
+func isClusterType(serviceType string) bool {
+	switch serviceType {
+	case "k3s", "rke2", "kubeadm":
+		return true
+	}
+	return false
+}
+
+// serviceOrder returns the enabled service instances so that every instance comes after the
+// instances it depends on. Independent instances keep alphabetical order.
+func serviceOrder(services Services) ([]string, error) {
+	pending := make(map[string]int)
+	for name, config := range services {
+		if config != nil && config.Enabled {
+			pending[name] = 0
+		}
+	}
+	// Dependencies on missing or disabled instances are config errors reported elsewhere
+	dependents := make(map[string][]string)
+	for name := range pending {
+		for _, dependency := range services[name].DependsOn {
+			if _, enabled := pending[dependency]; enabled && dependency != name {
+				pending[name]++
+				dependents[dependency] = append(dependents[dependency], name)
+			}
+		}
+	}
+
+	var ready []string
+	for name, count := range pending {
+		if count == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	var order []string
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		name := ready[0]
+		ready = ready[1:]
+		order = append(order, name)
+		for _, dependent := range dependents[name] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) < len(pending) {
+		var cycle []string
+		for name, count := range pending {
+			if count > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependency cycle between services %s", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
+
+// markDone records resources that instances depending on this service wait for
+func (s ServiceContext) markDone(resources ...pulumi.Resource) {
+	done, _ := s.GlobalDeps[s.ServiceName+"-done"].([]pulumi.Resource)
+	for _, resource := range resources {
+		if resource != nil {
+			done = append(done, resource)
+		}
+	}
+	s.GlobalDeps[s.ServiceName+"-done"] = done
+}
+
+// after returns what a command that starts work on a VM waits for: the given resources, such as
+// the readiness gate of the VM, and what the services this instance depends on finished with
+func (s ServiceContext) after(resources ...pulumi.Resource) []pulumi.Resource {
+	return append(append([]pulumi.Resource(nil), resources...), s.After...)
+}
+
+// dependencyResources returns what the services a service depends on recorded with markDone
+func dependencyResources(ctx *pulumi.Context, serviceName string, config *ServiceConfig, deps map[string]interface{}) []pulumi.Resource {
+	var after []pulumi.Resource
+	for _, dependency := range config.DependsOn {
+		done, ok := deps[dependency+"-done"].([]pulumi.Resource)
+		if !ok || len(done) == 0 {
+			ctx.Log.Warn(fmt.Sprintf("Service '%s' depends on '%s', which recorded nothing to wait for", serviceName, dependency), nil)
+			continue
+		}
+		after = append(after, done...)
+	}
+	return after
+}
+
 func executeService(ctx *pulumi.Context, serviceName string, config *ServiceConfig, vmGroups map[string][]*vm.VirtualMachine, globalDeps map[string]interface{}, vmPassword string) error {
-	handler, exists := serviceHandlers[serviceName]
-	if !exists {
-		return fmt.Errorf("unknown service: %s", serviceName)
+	handler := serviceTypes[config.Type].Handler
+	if handler == nil {
+		return fmt.Errorf("service type %s has no handler", config.Type)
 	}
 
 	serviceCtx := ServiceContext{
@@ -19,6 +162,7 @@ func executeService(ctx *pulumi.Context, serviceName string, config *ServiceConf
 		Config:        config.Config,
 		VMPassword:    vmPassword,
 		ServiceConfig: config,
+		After:         dependencyResources(ctx, serviceName, config, globalDeps),
 	}
 
 	allTargets := []string{}
@@ -28,34 +172,33 @@ func executeService(ctx *pulumi.Context, serviceName string, config *ServiceConf
 	for _, target := range allTargets {
 		if vms, exists := vmGroups[target]; exists {
 			serviceCtx.VMs = append(serviceCtx.VMs, vms...)
+			if ready, exists := globalDeps[target+"-ready"].([]pulumi.Resource); exists {
+				serviceCtx.Ready = append(serviceCtx.Ready, ready...)
+			}
 			if ips, exists := globalDeps[target+"-ips"].([]string); exists {
 				serviceCtx.IPs = append(serviceCtx.IPs, ips...)
 			}
+			if hosts, exists := globalDeps[target+"-hosts"].([]Host); exists {
+				serviceCtx.Hosts = append(serviceCtx.Hosts, hosts...)
+			}
 		}
 	}
 	if len(serviceCtx.VMs) == 0 {
 		return fmt.Errorf("service %s has no target VMs configured", serviceName)
 	}
-	ctx.Log.Info(fmt.Sprintf("Executing service '%s' on %d VMs", serviceName, len(serviceCtx.VMs)), nil)
+	ctx.Log.Info(fmt.Sprintf("Executing service '%s' (%s) on %d VMs", serviceName, config.Type, len(serviceCtx.VMs)), nil)
 	return handler(ctx, serviceCtx)
 }
-func executeServices(ctx *pulumi.Context, services *Services, vmGroups map[string][]*vm.VirtualMachine, globalDeps map[string]interface{}, vmPassword string) error {
-	if services.K3s != nil && services.K3s.Enabled {
-		err := executeService(ctx, "k3s", services.K3s, vmGroups, globalDeps, vmPassword)
-		if err != nil {
-			return fmt.Errorf("failed to execute K3s service: %w", err)
-		}
-	}
-	if services.RKE2 != nil && services.RKE2.Enabled {
-		err := executeService(ctx, "rke2", services.RKE2, vmGroups, globalDeps, vmPassword)
-		if err != nil {
-			return fmt.Errorf("failed to execute RKE2 service: %w", err)
-		}
+
+func executeServices(ctx *pulumi.Context, services Services, vmGroups map[string][]*vm.VirtualMachine, globalDeps map[string]interface{}, vmPassword string) error {
+	order, err := serviceOrder(services)
+	if err != nil {
+		return err
 	}
-	if services.Kubeadm != nil && services.Kubeadm.Enabled {
-		err := executeService(ctx, "kubeadm", services.Kubeadm, vmGroups, globalDeps, vmPassword)
+	for _, name := range order {
+		err := executeService(ctx, name, services[name], vmGroups, globalDeps, vmPassword)
 		if err != nil {
-			return fmt.Errorf("failed to execute Kubeadm service: %w", err)
+			return fmt.Errorf("failed to execute %s service: %w", name, err)
 		}
 	}
 	return nil
@@ -11,223 +11,111 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
-var serviceHandlers = map[string]ServiceHandler{
-	"k3s":       handleK3sService,
-	"rke2":      handleRKE2Service,
-	"kubeadm":   handleKubeadmService,
-	"harvester": handleHarvesterService,
-	//"talos":     handleTalosService,
+func init() {
+	registerServiceType("k3s", ServiceType{Handler: handleK3sService, Cluster: true})
+	registerServiceType("rke2", ServiceType{Handler: handleRKE2Service, Cluster: true})
+	registerServiceType("kubeadm", ServiceType{Handler: handleKubeadmService, Cluster: true})
+	registerServiceType("harvester", ServiceType{Handler: handleHarvesterService, Cluster: true})
+	registerServiceType("talos", ServiceType{Cluster: true})
+	registerServiceType("haproxy", ServiceType{Handler: handleHAProxyService})
 }
 
-func deployCiliumGateway(ctx *pulumi.Context, serverIP string, clusterType string, kubeconfigDependency pulumi.Resource, ciliumStartIP, ciliumStopIP string) error {
-	// Determine kubectl command based on cluster type
-	var kubectlCmd string
+// clusterKubectl returns the kubectl invocation that works on a server of the cluster type
+func clusterKubectl(clusterType string) (string, error) {
 	switch clusterType {
-	case "k3s":
-		kubectlCmd = "kubectl"
+	case "k3s", "kubeadm":
+		return "kubectl", nil
 	case "rke2":
-		kubectlCmd = "sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml"
-	case "kubeadm":
-		kubectlCmd = "kubectl"
+		return "sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml", nil
 	default:
-		return fmt.Errorf("unsupported cluster type: %s", clusterType)
-	}
-
-	// Get cert paths from environment
-	certPath := os.Getenv("TLS_CERT_PATH")
-	keyPath := os.Getenv("TLS_KEY_PATH")
-
-	if certPath == "" || keyPath == "" {
-		return fmt.Errorf(`TLS certificate paths not found in environment.
-		Please export:
-  			export TLS_CERT_PATH="./selfSignedCerts/tls.crt"
-  			export TLS_KEY_PATH="./selfSignedCerts/tls.key"`)
-	}
-
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		return fmt.Errorf("cert file not found: %s", certPath)
-	}
-	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-		return fmt.Errorf("key file not found: %s", keyPath)
-	}
-
-	certData, _ := os.ReadFile(certPath)
-	keyData, _ := os.ReadFile(keyPath)
-	//ctx.Log.Info(fmt.Sprintf("deployCiliumGateway: %s", kubectlCmd), nil)
-	deployScript := fmt.Sprintf(`#!/bin/bash
-		set -x
-		set -e
-		export KUBECONFIG=$HOME/.kube/config
-		# Create namespaces
-		%s create namespace cilium-gateway --dry-run=client -o yaml | %s apply -f -
-		%s create namespace certificates --dry-run=client -o yaml | %s apply -f -
-		
-		# Create TLS secret
-		cat > /tmp/tls.crt << 'EOF'
-%s
-EOF
-		cat > /tmp/tls.key << 'EOF'
-%s
-EOF
-		%s -n certificates create secret tls rajesh-tls-cert \
-			--cert=/tmp/tls.crt \
-			--key=/tmp/tls.key \
-			--dry-run=client -o yaml | %s apply -f -
-		rm /tmp/tls.crt /tmp/tls.key
-		
-		# Deploy ReferenceGrant
-		cat <<EOF | %s apply -f -
-apiVersion: gateway.networking.k8s.io/v1beta1
-kind: ReferenceGrant
-metadata:
-  name: allow-gateway-to-use-cert
-  namespace: certificates
-spec:
-  from:
-  - group: gateway.networking.k8s.io
-    kind: Gateway
-    namespace: cilium-gateway
-  to:
-  - group: ""
-    kind: Secret
-EOF
-		
-		# Deploy Gateway
-		cat <<EOF | %s apply -f -
-apiVersion: gateway.networking.k8s.io/v1beta1
-kind: Gateway
-metadata:
-  name: rancher-master-gateway
-  namespace: cilium-gateway
-spec:
-  gatewayClassName: cilium
-  listeners:
-  - protocol: HTTPS
-    port: 443	
-    name: rancher-master-gateway
-    tls:
-      mode: Terminate
-      certificateRefs:
-      - name: rajesh-tls-cert
-        namespace: certificates
-        kind: Secret
-    allowedRoutes:
-      namespaces:
-        from: All
-EOF
-		
-		# Deploy IP Pool
-		cat <<EOF | %s apply -f -
-apiVersion: "cilium.io/v2alpha1"
-kind: CiliumLoadBalancerIPPool
-metadata:
-  name: "rancher-master-cluster-pool"
-  namespace: kube-system
-spec:
-  blocks:
-    - start: %s
-      stop: %s
-EOF
-		
-		# Deploy L2 Announcement
-		cat <<EOF | %s apply -f -
-apiVersion: cilium.io/v2alpha1
-kind: CiliumL2AnnouncementPolicy
-metadata:
-  name: default-l2-announcement-policy
-  namespace: kube-system
-spec:
-  externalIPs: true
-  loadBalancerIPs: true
-EOF
-		
-		echo "Cilium Gateway setup complete on %s"
-	`, kubectlCmd, kubectlCmd, kubectlCmd, kubectlCmd, string(certData), string(keyData),
-		kubectlCmd, kubectlCmd, kubectlCmd, kubectlCmd, kubectlCmd, ciliumStartIP, ciliumStopIP, kubectlCmd, clusterType)
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("cilium-gateway-setup-%s", clusterType), &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: pulumi.String(deployScript),
-	}, pulumi.DependsOn([]pulumi.Resource{kubeconfigDependency}))
-
-	return err
+		return "", fmt.Errorf("unsupported cluster type: %s", clusterType)
+	}
 }
 
 func handleK3sService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	ctx.Log.Info(fmt.Sprintf("Installing K3s service on %d VMs", len(serviceCtx.VMs)), nil)
+	versions := exportClusterVersions(ctx, serviceCtx)
 
-	err := installK3SLoadBalancer(ctx, serviceCtx)
+	lbCmd, err := installClusterLoadBalancer(ctx, serviceCtx)
 	if err != nil {
 		return fmt.Errorf("failed to install K3s load balancer: %w", err)
 	}
 
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		return fmt.Errorf("k3s service requires a load balancer configured")
-	}
-
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbKey := lbName + "-ips"
-	lbIPs, ok := serviceCtx.GlobalDeps[lbKey].([]string)
-	if !ok || len(lbIPs) == 0 {
-		return fmt.Errorf("k3s server needs loadbalancer IP but they are not available")
+	lbIP, err := clusterEndpoint(serviceCtx)
+	if err != nil {
+		return err
 	}
-
-	lbIP := lbIPs[0]
 	ctx.Log.Info(fmt.Sprintf("installing k3s server with LBIP: %s", lbIP), nil)
+	cni, err := clusterCNIParams(serviceCtx.ServiceConfig, serviceCtx.Hosts[0].IP)
+	if err != nil {
+		return err
+	}
 
 	//var k3sCommands []*remote.Command
 	var k3sServerToken pulumi.StringOutput
-	var firstServerIP string
+	var firstServer Host
 	var lastServerCommand pulumi.Resource
 
-	for i, serverVM := range serviceCtx.VMs {
-		serverIP := serviceCtx.IPs[i]
+	for i, serverReady := range serviceCtx.Ready {
+		server := serviceCtx.Hosts[i]
+		serverIP := server.IP
 		isFirstServer := (i == 0)
 
 		ctx.Log.Info(fmt.Sprintf("Installing K3s on server %d: %s", i+1, serverIP), nil)
 
+		serverLB, err := clusterNodeLoadBalancer(ctx, serviceCtx, server, serverReady, lbCmd, lastServerCommand)
+		if err != nil {
+			return err
+		}
+
 		if isFirstServer {
-			firstServerIP = serverIP
+			firstServer = server
 			ctx.Log.Info(fmt.Sprintf("installing k3s on server %d: %s", i+1, serverIP), nil)
 
-			k3sCmd, err := installK3SServer(ctx, lbIP, serviceCtx.VMPassword, serverIP, serverVM, true, pulumi.String("").ToStringOutput(), nil)
+			valuesReady, err := installCiliumValues(ctx, serviceCtx, server, serverReady, cni)
+			if err != nil {
+				return fmt.Errorf("cannot write Cilium values on %s: %w", serverIP, err)
+			}
+			k3sCmd, err := installK3SServer(ctx, lbIP, versions, cni, server, serviceCtx.after(valuesReady), true, pulumi.String("").ToStringOutput(), serverLB)
 			if err != nil {
 				return fmt.Errorf("cannot install K3s server on first node %s: %w", serverIP, err)
 			}
 			lastServerCommand = k3sCmd
 			//	k3sCommands = append(k3sCommands, k3sCmd)
-			tokenCmd, err := getK3sToken(ctx, serverIP, serviceCtx.VMPassword, k3sCmd)
+			tokenCmd, err := getK3sToken(ctx, server, k3sCmd)
 			if err != nil {
 				return fmt.Errorf("cannot get k3s token: %w", err)
 			}
 			k3sServerToken = tokenCmd.Stdout
 		} else {
-			k3sCmd, err := installK3SServer(ctx, lbIP, serviceCtx.VMPassword, serverIP, serverVM, false, k3sServerToken, nil)
+			k3sCmd, err := installK3SServer(ctx, lbIP, versions, cni, server, serviceCtx.after(serverReady), false, k3sServerToken, serverLB)
 			if err != nil {
-				return fmt.Errorf("cannot install k3s on server %s: %v", serverIP, serverVM)
+				return fmt.Errorf("cannot install k3s on server %s: %w", serverIP, err)
 			}
 			lastServerCommand = k3sCmd
 			//		k3sCommands = append(k3sCommands, k3sCmds)
 		}
 	}
-	if firstServerIP != "" {
-		kubeconfigCmd, err := getK3sKubeconfig(ctx, firstServerIP, serviceCtx.VMPassword, lbIP, lastServerCommand)
+	if firstServer.IP != "" {
+		kubeconfigCmd, err := getK3sKubeconfig(ctx, serviceCtx.ServiceName, firstServer, lbIP, lastServerCommand)
 		if err != nil {
 			return fmt.Errorf("failed to extract kubeconfig: %w", err)
 		}
-		ctx.Log.Info("Deploying Cilium Gateway on k3s...", nil)
-		err = deployCiliumGateway(ctx, firstServerIP, "k3s", kubeconfigCmd, "192.168.91.10", "192.168.91.15")
+		lbReady, err := installMetalLB(ctx, serviceCtx, firstServer, kubeconfigCmd)
 		if err != nil {
-			ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on k3s: %v", err), nil)
-			return fmt.Errorf("failed to deploy Cilium Gateway on k3s: %w", err)
+			return fmt.Errorf("failed to install MetalLB on k3s: %w", err)
+		}
+		serviceCtx.markDone(lastServerCommand, lbReady)
+		if cni.Name == "cilium" {
+			ctx.Log.Info("Deploying Cilium Gateway on k3s...", nil)
+			gatewayCmd, err := deployCiliumGateway(ctx, serviceCtx, firstServer, lbReady)
+			if err != nil {
+				ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on k3s: %v", err), nil)
+				return fmt.Errorf("failed to deploy Cilium Gateway on k3s: %w", err)
+			}
+			serviceCtx.markDone(gatewayCmd)
+			ctx.Log.Info("Cilium Gateway deployed successfully on k3s", nil)
 		}
-		ctx.Log.Info("Cilium Gateway deployed successfully on k3s", nil)
 	}
 
 	ctx.Log.Info(fmt.Sprintf("K3s service installed on %d servers", len(serviceCtx.VMs)), nil)
@@ -239,21 +127,21 @@ func handleK3sService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	}
 
 	// Get worker VMs and IPs
-	var workerVMs []*vm.VirtualMachine
-	var workerIPs []string
+	var workerVMs []pulumi.Resource
+	var workerHosts []Host
 	for _, nodeName := range workerNodes {
-		vms, ok := serviceCtx.GlobalDeps[nodeName+"-vms"]
+		ready, ok := serviceCtx.GlobalDeps[nodeName+"-ready"].([]pulumi.Resource)
 		if !ok {
 			ctx.Log.Warn(fmt.Sprintf("Worker VMs for '%s' not found", nodeName), nil)
 			continue
 		}
-		ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string)
+		hosts, ok := serviceCtx.GlobalDeps[nodeName+"-hosts"].([]Host)
 		if !ok {
 			ctx.Log.Warn(fmt.Sprintf("Worker IPs for '%s' not found", nodeName), nil)
 			continue
 		}
-		workerVMs = append(workerVMs, vms.([]*vm.VirtualMachine)...)
-		workerIPs = append(workerIPs, ips...)
+		workerVMs = append(workerVMs, ready...)
+		workerHosts = append(workerHosts, hosts...)
 	}
 
 	if len(workerVMs) == 0 {
@@ -265,380 +153,98 @@ func handleK3sService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 
 	// Install workers - they join the cluster as agents
 	for i, workerVM := range workerVMs {
-		workerIP := workerIPs[i]
+		workerIP := workerHosts[i].IP
 		ctx.Log.Info(fmt.Sprintf("Installing k3s agent on worker %d: %s", i+1, workerIP), nil)
 
-		_, err := installK3SWorker(ctx, lbIP, serviceCtx.VMPassword, workerIP, workerVM, lastServerCommand, k3sServerToken)
+		workerCmd, err := installK3SWorker(ctx, lbIP, versions, workerHosts[i], serviceCtx.after(workerVM), lastServerCommand, k3sServerToken)
 		if err != nil {
 			return fmt.Errorf("failed to install k3s agent on worker %s: %w", workerIP, err)
 		}
+		serviceCtx.markDone(workerCmd)
 	}
 
 	ctx.Log.Info(fmt.Sprintf("k3s agents installed on %d workers", len(workerVMs)), nil)
 	return nil
 }
 
-func installK3SLoadBalancer(ctx *pulumi.Context, serviceCtx ServiceContext) error {
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		ctx.Log.Info("No load balancer configured for K3s, skipping HAProxy installation", nil)
-		return nil
-	}
-
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbVMs, ok := serviceCtx.GlobalDeps[lbName+"-vms"]
-	if !ok {
-		return fmt.Errorf("load balancer VMs '%s' not found", lbName)
-	}
-	lbIps, ok := serviceCtx.GlobalDeps[lbName+"-ips"].([]string)
-	if !ok || len(lbIps) == 0 {
-		return fmt.Errorf("load balancer IPs '%s' not found", lbName)
-	}
-
-	lbVM := lbVMs.([]*vm.VirtualMachine)[0]
-	lbIP := lbIps[0]
-
-	backendIPs := serviceCtx.IPs
-
-	ports := serviceCtx.ServiceConfig.Config["ports"]
-	if ports == nil {
-		return fmt.Errorf("no ports configured for K3s load balancer")
-	}
-	ctx.Log.Info(fmt.Sprintf("Installing HAProxy on %s for %d K3s backends", lbIP, len(backendIPs)), nil)
-	haproxyConfig := generateK3sHAProxyConfig(backendIPs)
-
-	installScript := fmt.Sprintf(`
-	echo "Installing HAProxy on load balancer %s"
-
-# Update system (non-interactive)
-sudo DEBIAN_FRONTEND=noninteractive apt-get update -y 
-sudo DEBIAN_FRONTEND=noninteractive apt-get install -y haproxy
-
-# Backup original config
-sudo cp /etc/haproxy/haproxy.cfg /etc/haproxy/haproxy.cfg.bak || true
-
-# Write new configuration
-sudo tee /etc/haproxy/haproxy.cfg << 'EOF'
-%s
-EOF
-
-# Validate configuration
-if ! sudo haproxy -f /etc/haproxy/haproxy.cfg -c; then
-    echo "HAProxy configuration validation failed!"
-    exit 1
-fi
-
-# Enable and restart HAProxy
-sudo systemctl enable haproxy
-sudo systemctl restart haproxy
-
-# Show status
-sudo systemctl status haproxy --no-pager
-
-echo "HAProxy installation completed for K3S"
-`, lbIP, haproxyConfig)
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("haproxy-install-%s", lbIP),
-		&remote.CommandArgs{
-			Connection: &remote.ConnectionArgs{
-				Host:           pulumi.String(lbIP),
-				User:           pulumi.String("rajeshk"),
-				PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-				PerDialTimeout: pulumi.IntPtr(30),
-				DialErrorLimit: pulumi.IntPtr(20),
-			},
-			Create:   pulumi.String(installScript),
-			Triggers: pulumi.Array{pulumi.String("always-run")}, // Be careful with this in prod, maybe hash the config
-		},
-		pulumi.DependsOn([]pulumi.Resource{lbVM}),
-		pulumi.Timeouts(&pulumi.CustomTimeouts{
-			Create: "10m",
-		}),
-	)
-	return err
-}
-
-func generateK3sHAProxyConfig(backendIPs []string) string {
-	var config strings.Builder
-	config.WriteString(`global
-    log /dev/log local0
-    log /dev/log local1 notice
-    chroot /var/lib/haproxy
-    stats socket /run/haproxy/admin.sock mode 660 level admin
-    stats timeout 30s
-    user haproxy
-    group haproxy
-    daemon
-
-defaults
-    log     global
-    mode    tcp
-    option  tcplog
-    option  dontlognull
-    timeout connect 5000
-    timeout client  50000
-    timeout server  50000
-
-listen stats
-    bind *:8404
-    stats enable
-    stats uri /stats
-    stats refresh 30s
-
-`)
-
-	// K3s API backend
-	config.WriteString(`frontend k3s-api-frontend
-    bind *:6443
-    mode tcp
-    option tcplog
-    default_backend k3s-api-backend
-
-backend k3s-api-backend
-    mode tcp
-    balance roundrobin
-    option tcp-check
-`)
-
-	for i, ip := range backendIPs {
-		config.WriteString(fmt.Sprintf("    server k3s-%d %s:6443 check fall 3 rise 2\n", i+1, ip))
-	}
-
-	return config.String()
-}
-
-func installK3SServer(ctx *pulumi.Context, lbIP, vmPassword, serverIP string, vmDependency pulumi.Resource, isFirstServer bool, k3sToken pulumi.StringOutput, haproxyDependency pulumi.Resource) (*remote.Command, error) {
-	var k3sCommand pulumi.StringInput
+func installK3SServer(ctx *pulumi.Context, lbIP string, versions ClusterVersions, cni cniParams, server Host, vmDependencies []pulumi.Resource, isFirstServer bool, k3sToken pulumi.StringOutput, lbDependency pulumi.Resource) (*remote.Command, error) {
+	serverIP := server.IP
 
 	suseEmail := os.Getenv("SUSE_REGISTRATION_EMAIL")
-	suseCode := os.Getenv("SUSE_REGISTRATION_CODE")
-
-	suseRegCmd := ""
-	if suseEmail != "" && suseCode != "" {
-		suseRegCmd = fmt.Sprintf("sudo transactional-update register --url=https://scc.suse.com -e %s -r %s", suseEmail, suseCode)
-	}
+	suseCode := credential("suseRegistrationCode")
 
 	if suseEmail == "" || suseCode == "" {
-		return nil, fmt.Errorf(`SUSE registration credentials not found in environment.
-		Please export the following variables:
+		return nil, fmt.Errorf(`SUSE registration credentials not found.
+		Please export SUSE_REGISTRATION_EMAIL and declare credentials.suseRegistrationCode, or export:
   		export SUSE_REGISTRATION_EMAIL="your-email@suse.com"
   		export SUSE_REGISTRATION_CODE="your-registration-code"`)
 	}
 
-	if isFirstServer {
-		k3sCommand = pulumi.Sprintf(`#!/bin/bash
-		set -e
-		set -x
-		sudo bash -c "cat > /etc/resolv.conf << 'EOF'
-nameserver 192.168.90.1
-EOF"
-		%s 
-		
-		# Install K3s with CNI disabled
-		curl -L https://get.k3s.io | sudo sh -s - server \
-			--cluster-init \
-			--tls-san=%s \
-			--tls-san=$(hostname -I | awk '{print $1}') \
-			--flannel-backend=none \
-			--disable-kube-proxy \
-			--disable=traefik \
-			--disable=servicelb
-		
-		sudo systemctl enable --now k3s
-		
-		# Wait for kubeconfig file and API endpoint
-		echo "Waiting for K3s kubeconfig..."
-		until sudo test -f /etc/rancher/k3s/k3s.yaml; do
-			sleep 2
-		done
-		
-		# Wait for API server to respond (ignore node status)
-		echo "Waiting for K3s API server..."
-		until sudo /usr/local/bin/k3s kubectl get --raw /healthz >/dev/null 2>&1; do
-			sleep 5
-		done
-
-		# Set up kubeconfig for non-root user
-		mkdir -p $HOME/.kube
-		sudo cp /etc/rancher/k3s/k3s.yaml $HOME/.kube/config
-		sudo chown $(id -u):$(id -g) $HOME/.kube/config
-		chmod 600 $HOME/.kube/config
-		export KUBECONFIG=$HOME/.kube/config
-		
-		# Install Helm
-		curl https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | sudo bash || true
-		
-		# Install Cilium CNI
-		/usr/local/bin/helm repo add cilium https://helm.cilium.io/
-		/usr/local/bin/helm repo update
-		
-		API_SERVER_IP=%s
-		API_SERVER_PORT=6443
-
-		# Install support for kubernetes gateway api
-		kubectl apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/standard-install.yaml
-		kubectl apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/experimental-install.yaml --server-side --force-conflicts
-
-		KUBECONFIG=$HOME/.kube/config /usr/local/bin/helm install cilium cilium/cilium \
-			--namespace kube-system \
-			--set kubeProxyReplacement=true \
-			--set k8sServiceHost=${API_SERVER_IP} \
-			--set k8sServicePort=${API_SERVER_PORT} \
-			--set hubble.relay.enabled=true \
-			--set l2announcements.enabled=true \
-			--set externalIPs.enabled=true \
-			--set gatewayAPI.enabled=true \
-			--set envoy.enabled=true \
-			--set debug.enabled=true \
-			--set securityContext.capabilities.keepCapNetBindService=true \
-			--set gatewayAPI.enableAlpn=true \
-    		--set gatewayAPI.enableAppProtocol=true 
-		
-		# Install cilium CLI
-		CILIUM_CLI_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/cilium-cli/main/stable.txt)
-		CLI_ARCH=amd64
-		if [ "$(uname -m)" = "aarch64" ]; then CLI_ARCH=arm64; fi
-		curl -L --fail --remote-name-all https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-		sha256sum --check cilium-linux-${CLI_ARCH}.tar.gz.sha256sum
-		sudo tar xzvfC cilium-linux-${CLI_ARCH}.tar.gz /usr/local/bin
-		rm cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-		
-		# Install hubble CLI
-		HUBBLE_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/hubble/master/stable.txt)
-		HUBBLE_ARCH=amd64
-		if [ "$(uname -m)" = "aarch64" ]; then HUBBLE_ARCH=arm64; fi
-		curl -L --fail --remote-name-all https://github.com/cilium/hubble/releases/download/$HUBBLE_VERSION/hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-		sha256sum --check hubble-linux-${HUBBLE_ARCH}.tar.gz.sha256sum
-		sudo tar xzvfC hubble-linux-${HUBBLE_ARCH}.tar.gz /usr/local/bin
-		rm hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-		
-		# Now wait for nodes to be ready
-		echo "Waiting for nodes to be ready..."
-		sudo /usr/local/bin/k3s kubectl wait --for=condition=Ready nodes --all --timeout=300s
-
-		# Setting up Longhorn pre-requisites
-		#curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
-		#chmod +x longhornctl
-		#sudo mv longhornctl /usr/local/bin/longhornctl
-		#sudo transactional-update pkg install -y nfs-client cryptsetup device-mapper
-		
-		
-		sudo ls /var/lib/rancher/k3s/server/node-token
-	`, suseRegCmd, lbIP, serverIP)
-	} else {
-		k3sCommand = pulumi.Sprintf(`#!/bin/bash
-			set -e
-			set -x
-			sudo bash -c "cat > /etc/resolv.conf << 'EOF'
-nameserver 192.168.90.1
-EOF"
-			%s
-			# Wait for first server to be ready
-			until curl -k -s https://%s:6443/ping; do
-				echo "Waiting for first K3s server to be ready..."
-				sleep 10
-			done
-			
-			# Install K3s with CNI disabled
-			curl -sfL https://get.k3s.io | sudo sh -s - server \
-			--server https://%s:6443 \
-			--token %s \
-			--tls-san=%s --tls-san=$(hostname -I | awk '{print $1}') \
-			--flannel-backend=none \
-			--disable-kube-proxy \
-			--disable=traefik \
-			--disable=servicelb
-
-			sudo systemctl enable --now k3s
-
-			# Set up kubeconfig for non-root user
-			mkdir -p $HOME/.kube
-			sudo cp /etc/rancher/k3s/k3s.yaml $HOME/.kube/config
-			sudo chown $(id -u):$(id -g) $HOME/.kube/config
-			chmod 600 $HOME/.kube/config
-
-			# Setting up Longhorn pre-requisites
-			curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
-			chmod +x longhornctl
-			sudo mv longhornctl /usr/local/bin/longhornctl
-			sudo transactional-update pkg install -y nfs-client cryptsetup device-mapper
-
-			echo "K3s server joined cluster successfully"
-		`, suseRegCmd, lbIP, lbIP, k3sToken, lbIP)
+	params := k3sServerParams{
+		ResolvConf: resolvConf(server.DNS),
+		SUSEEmail:  suseEmail,
+		LBIP:       lbIP,
+		ServerIP:   serverIP,
+		Versions:   versions,
+		CNI:        cni,
+	}
+	registration := map[string]string{"SUSE_REGISTRATION_CODE": suseCode}
+	script, err := renderScript("k3s-server-init.sh.tmpl", params)
+	stdin := secretStdin(registration)
+	if !isFirstServer {
+		script, err = renderScript("k3s-server-join.sh.tmpl", params)
+		stdin = secretStdinFrom("K3S_TOKEN", k3sToken, registration)
+	}
+	if err != nil {
+		return nil, err
 	}
 	resourceName := fmt.Sprintf("k3s-server-%s", strings.ReplaceAll(serverIP, ".", "-"))
-	dependencies := []pulumi.Resource{vmDependency}
-	if haproxyDependency != nil {
-		dependencies = append(dependencies, haproxyDependency)
+	dependencies := append([]pulumi.Resource(nil), vmDependencies...)
+	if lbDependency != nil {
+		dependencies = append(dependencies, lbDependency)
 		ctx.Log.Info(fmt.Sprintf("K3s server %s will wait for HAProxy installation", serverIP), nil)
 	}
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: k3sCommand,
+		Connection: sshConnection(server),
+		Create:     pulumi.String(script),
+		Stdin:      stdin,
 	}, pulumi.DependsOn(dependencies))
 	return cmd, err
 }
 
 // installK3SWorker installs K3s agent on worker nodes
-func installK3SWorker(ctx *pulumi.Context, lbIP, vmPassword, workerIP string, vmDependency pulumi.Resource, serverDependency pulumi.Resource, k3sToken pulumi.StringOutput) (*remote.Command, error) {
-
-	k3sCommand := pulumi.Sprintf(`
-		# Set DNS resolver
-		sudo tee /etc/resolv.conf << 'EOF'
-nameserver 192.168.90.1
-EOF
-
-		# Wait for server to be ready
-		until curl -k -s https://%s:6443/ping; do
-			echo "Waiting for K3s server to be ready..."
-			sleep 10
-		done
-
-		# Install K3s agent
-		curl -sfL https://get.k3s.io | K3S_URL=https://%s:6443 K3S_TOKEN=%s sudo sh -
-
-		echo "K3s agent joined cluster successfully"
-	`, lbIP, lbIP, k3sToken)
+func installK3SWorker(ctx *pulumi.Context, lbIP string, versions ClusterVersions, worker Host, vmDependencies []pulumi.Resource, serverDependency pulumi.Resource, k3sToken pulumi.StringOutput) (*remote.Command, error) {
+	workerIP := worker.IP
+
+	k3sCommand, err := renderScript("k3s-agent.sh.tmpl", agentParams{
+		ResolvConf: resolvConf(worker.DNS),
+		LBIP:       lbIP,
+		Versions:   versions,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	resourceName := fmt.Sprintf("k3s-worker-%s", strings.ReplaceAll(workerIP, ".", "-"))
-	dependencies := []pulumi.Resource{vmDependency}
+	dependencies := append([]pulumi.Resource(nil), vmDependencies...)
 	if serverDependency != nil {
 		dependencies = append(dependencies, serverDependency)
 		ctx.Log.Info(fmt.Sprintf("K3s worker %s will wait for K3s Server installation", workerIP), nil)
 	}
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(workerIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: k3sCommand,
+		Connection: sshConnection(worker),
+		Create:     pulumi.String(k3sCommand),
+		Stdin:      secretStdinFrom("K3S_TOKEN", k3sToken, nil),
 	}, pulumi.DependsOn(dependencies))
 
 	return cmd, err
 }
 
-func getK3sToken(ctx *pulumi.Context, firstServerIP, vmPassword string, vmDependency pulumi.Resource) (*remote.Command, error) {
-	resourceName := fmt.Sprintf("k3s-token-%s", strings.ReplaceAll(firstServerIP, ".", "-"))
+func getK3sToken(ctx *pulumi.Context, firstServer Host, vmDependency pulumi.Resource) (*remote.Command, error) {
+	resourceName := fmt.Sprintf("k3s-token-%s", strings.ReplaceAll(firstServer.IP, ".", "-"))
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(firstServerIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
+		Connection: sshConnection(firstServer),
 		Create: pulumi.String(`
 			# Wait for K3s to be fully ready and token file to exist
 			#while [ ! -f /var/lib/rancher/k3s/server/node-token ]; do
@@ -651,12 +257,12 @@ func getK3sToken(ctx *pulumi.Context, firstServerIP, vmPassword string, vmDepend
 
 			sudo cat /var/lib/rancher/k3s/server/node-token
 			`),
-	}, pulumi.DependsOn([]pulumi.Resource{vmDependency}))
+	}, pulumi.DependsOn([]pulumi.Resource{vmDependency}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 	return cmd, err
 }
 
-func getK3sKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, lastServerCommand pulumi.Resource) (*remote.Command, error) {
-	resourceName := fmt.Sprintf("k3s-kubeconfig-%s", strings.ReplaceAll(serverIP, ".", "-"))
+func getK3sKubeconfig(ctx *pulumi.Context, serviceName string, server Host, lbIP string, lastServerCommand pulumi.Resource) (*remote.Command, error) {
+	resourceName := fmt.Sprintf("k3s-kubeconfig-%s", strings.ReplaceAll(server.IP, ".", "-"))
 
 	kubeconfigCommand := fmt.Sprintf(`
 		while [ ! -f /etc/rancher/k3s/k3s.yaml ]; do
@@ -668,23 +274,16 @@ func getK3sKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, la
 		sudo cat /etc/rancher/k3s/k3s.yaml | sed 's/127.0.0.1:6443/%s:6443/g'`, lbIP) // k3s kubeconfig has frontend port to 6444 as per the
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: pulumi.String(kubeconfigCommand),
-	}, pulumi.DependsOn([]pulumi.Resource{lastServerCommand}))
+		Connection: sshConnection(server),
+		Create:     pulumi.String(kubeconfigCommand),
+	}, pulumi.DependsOn([]pulumi.Resource{lastServerCommand}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 
 	if err != nil {
 		return nil, err
 	}
 
-	kubeconfigPath := "./k3s-kubeconfig.yaml"
-	_, err = local.NewFile(ctx, "save-k3s-kubeconfig", &local.FileArgs{
+	kubeconfigPath := fmt.Sprintf("./%s-kubeconfig.yaml", serviceName)
+	_, err = local.NewFile(ctx, fmt.Sprintf("save-%s-kubeconfig", serviceName), &local.FileArgs{
 		Filename: pulumi.String(kubeconfigPath),
 		Content:  cmd.Stdout,
 	}, pulumi.DependsOn([]pulumi.Resource{cmd}),
@@ -693,34 +292,32 @@ func getK3sKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, la
 	if err != nil {
 		return nil, fmt.Errorf("failed to save kubeconfig locally: %w", err)
 	}
-	ctx.Export("kubeconfig", cmd.Stdout)
-	ctx.Log.Info("kubeconfig exported successfully", nil)
+	ctx.Export(serviceName+"-kubeconfig", pulumi.ToSecret(cmd.Stdout))
+	ctx.Export(serviceName+"-kubeconfigPath", pulumi.String(kubeconfigPath))
+	// The default instance keeps the output K3s had before instances were named
+	if serviceName == "k3s" {
+		ctx.Export("kubeconfig", pulumi.ToSecret(cmd.Stdout))
+	}
+	ctx.Log.Info(fmt.Sprintf("%s kubeconfig exported successfully", serviceName), nil)
 	return cmd, nil
 }
 
 // RKE2 Service Handler
 func handleRKE2Service(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	ctx.Log.Info(fmt.Sprintf("Installing RKE2 service on %d VMs", len(serviceCtx.VMs)), nil)
+	versions := exportClusterVersions(ctx, serviceCtx)
 
-	err := installRKE2LoadBalancer(ctx, serviceCtx)
+	lbCmd, err := installClusterLoadBalancer(ctx, serviceCtx)
 	if err != nil {
-		return fmt.Errorf("failed to install K3s load balancer: %w", err)
-	}
-
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		return fmt.Errorf("rke2 server needs loadbalancer IP but they are not available")
+		return fmt.Errorf("failed to install RKE2 load balancer: %w", err)
 	}
 
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbKey := lbName + "-ips"
-
-	lbIPs, ok := serviceCtx.GlobalDeps[lbKey].([]string)
-	if !ok || len(lbIPs) == 0 {
-		return fmt.Errorf("rke2 server needs loadbalancer IP but they are not available")
+	lbIP, err := clusterEndpoint(serviceCtx)
+	if err != nil {
+		return err
 	}
-	lbIP := lbIPs[0]
 
-	ctx.Log.Info(fmt.Sprintf("Installing RKE2 server with LB IP: %s (from %s)", lbIP, lbName), nil)
+	ctx.Log.Info(fmt.Sprintf("Installing RKE2 server with LB IP: %s", lbIP), nil)
 
 	//Install Server (Control Plane)
 	controlPlaneNodes := serviceCtx.ServiceConfig.ControlPlane
@@ -729,71 +326,93 @@ func handleRKE2Service(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	}
 
 	// Get server VMs and IPs
-	var serverVMs []*vm.VirtualMachine
-	var serverIPs []string
+	var serverVMs []pulumi.Resource
+	var serverHosts []Host
 	for _, nodeName := range controlPlaneNodes {
-		vms, ok := serviceCtx.GlobalDeps[nodeName+"-vms"]
+		ready, ok := serviceCtx.GlobalDeps[nodeName+"-ready"].([]pulumi.Resource)
 		if !ok {
 			continue
 		}
-		ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string)
+		hosts, ok := serviceCtx.GlobalDeps[nodeName+"-hosts"].([]Host)
 		if !ok {
 			continue
 		}
-		serverVMs = append(serverVMs, vms.([]*vm.VirtualMachine)...)
-		serverIPs = append(serverIPs, ips...)
+		serverVMs = append(serverVMs, ready...)
+		serverHosts = append(serverHosts, hosts...)
 	}
 
 	ctx.Log.Info(fmt.Sprintf("installing rke2 server with LBIP: %s", lbIP), nil)
+	cni, err := clusterCNIParams(serviceCtx.ServiceConfig, serverHosts[0].IP)
+	if err != nil {
+		return err
+	}
 	var rke2ServerToken pulumi.StringOutput
-	var firstServerIP string
+	var firstServer Host
 	var lastServerCommand pulumi.Resource
 
 	// Install servers sequentially
-	for i, serverVM := range serverVMs {
-		serverIP := serverIPs[i]
+	for i, serverReady := range serverVMs {
+		server := serverHosts[i]
+		serverIP := server.IP
 		isFirstServer := (i == 0)
 
 		ctx.Log.Info(fmt.Sprintf("Installing RKE2 on server %d: %s", i+1, serverIP), nil)
 
+		serverLB, err := clusterNodeLoadBalancer(ctx, serviceCtx, server, serverReady, lbCmd, lastServerCommand)
+		if err != nil {
+			return err
+		}
+
 		if isFirstServer {
-			firstServerIP = serverIP
+			firstServer = server
 			ctx.Log.Info(fmt.Sprintf("installing rke2 on server %d: %s", i+1, serverIP), nil)
 
-			rke2Cmd, err := installRKE2Server(ctx, lbIP, serviceCtx.VMPassword, serverIP, serverVM, true, pulumi.String("").ToStringOutput(), nil)
+			valuesReady, err := installCiliumValues(ctx, serviceCtx, server, serverReady, cni)
+			if err != nil {
+				return fmt.Errorf("cannot write Cilium values on %s: %w", serverIP, err)
+			}
+			rke2Cmd, err := installRKE2Server(ctx, lbIP, versions, cni, server, serviceCtx.after(valuesReady), true, pulumi.String("").ToStringOutput(), serverLB)
 			if err != nil {
 				return fmt.Errorf("cannot install RKE2 server on first node %s: %w", serverIP, err)
 			}
 			lastServerCommand = rke2Cmd
 
-			tokenCmd, err := getRKE2Token(ctx, serverIP, serviceCtx.VMPassword, rke2Cmd)
+			tokenCmd, err := getRKE2Token(ctx, server, rke2Cmd)
 			if err != nil {
 				return fmt.Errorf("cannot get rke2 token: %w", err)
 			}
 			rke2ServerToken = tokenCmd.Stdout
 		} else {
-			rke2Cmd, err := installRKE2Server(ctx, lbIP, serviceCtx.VMPassword, serverIP, serverVM, false, rke2ServerToken, nil)
+			rke2Cmd, err := installRKE2Server(ctx, lbIP, versions, cni, server, serviceCtx.after(serverReady), false, rke2ServerToken, serverLB)
 			if err != nil {
-				return fmt.Errorf("cannot install rke2 on server %s: %v", serverIP, serverVM)
+				return fmt.Errorf("cannot install rke2 on server %s: %w", serverIP, err)
 			}
 			lastServerCommand = rke2Cmd
 		}
 	}
 
 	// Export kubeconfig from first server
-	if firstServerIP != "" {
-		kubeconfigCmd, err := getRKE2Kubeconfig(ctx, firstServerIP, serviceCtx.VMPassword, lbIP, lastServerCommand)
+	if firstServer.IP != "" {
+		kubeconfigCmd, err := getRKE2Kubeconfig(ctx, serviceCtx.ServiceName, firstServer, lbIP, lastServerCommand)
 		if err != nil {
 			return fmt.Errorf("failed to extract rke2 kubeconfig: %w", err)
 		}
 
-		ctx.Log.Info("Deploying Cilium Gateway...", nil)
-		err = deployCiliumGateway(ctx, firstServerIP, "rke2", kubeconfigCmd, "192.168.91.20", "192.168.91.25")
+		lbReady, err := installMetalLB(ctx, serviceCtx, firstServer, kubeconfigCmd)
 		if err != nil {
-			ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on rke2: %v", err), nil)
-			return fmt.Errorf("failed to deploy Cilium Gateway on rke2: %w", err)
+			return fmt.Errorf("failed to install MetalLB on rke2: %w", err)
+		}
+		serviceCtx.markDone(lastServerCommand, lbReady)
+		if cni.Name == "cilium" {
+			ctx.Log.Info("Deploying Cilium Gateway...", nil)
+			gatewayCmd, err := deployCiliumGateway(ctx, serviceCtx, firstServer, lbReady)
+			if err != nil {
+				ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on rke2: %v", err), nil)
+				return fmt.Errorf("failed to deploy Cilium Gateway on rke2: %w", err)
+			}
+			serviceCtx.markDone(gatewayCmd)
+			ctx.Log.Info("Cilium Gateway deployed successfully on rke2", nil)
 		}
-		ctx.Log.Info("Cilium Gateway deployed successfully on rke2", nil)
 	}
 
 	ctx.Log.Info(fmt.Sprintf("RKE2 service installed on %d servers", len(serverVMs)), nil)
@@ -806,21 +425,21 @@ func handleRKE2Service(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	}
 
 	// Get worker VMs and IPs
-	var workerVMs []*vm.VirtualMachine
-	var workerIPs []string
+	var workerVMs []pulumi.Resource
+	var workerHosts []Host
 	for _, nodeName := range workerNodes {
-		vms, ok := serviceCtx.GlobalDeps[nodeName+"-vms"]
+		ready, ok := serviceCtx.GlobalDeps[nodeName+"-ready"].([]pulumi.Resource)
 		if !ok {
 			ctx.Log.Warn(fmt.Sprintf("Worker VMs for '%s' not found", nodeName), nil)
 			continue
 		}
-		ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string)
+		hosts, ok := serviceCtx.GlobalDeps[nodeName+"-hosts"].([]Host)
 		if !ok {
 			ctx.Log.Warn(fmt.Sprintf("Worker IPs for '%s' not found", nodeName), nil)
 			continue
 		}
-		workerVMs = append(workerVMs, vms.([]*vm.VirtualMachine)...)
-		workerIPs = append(workerIPs, ips...)
+		workerVMs = append(workerVMs, ready...)
+		workerHosts = append(workerHosts, hosts...)
 	}
 
 	if len(workerVMs) == 0 {
@@ -832,431 +451,90 @@ func handleRKE2Service(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 
 	// Install workers - they join the cluster as agents
 	for i, workerVM := range workerVMs {
-		workerIP := workerIPs[i]
+		workerIP := workerHosts[i].IP
 		ctx.Log.Info(fmt.Sprintf("Installing RKE2 agent on worker %d: %s", i+1, workerIP), nil)
 
-		_, err := installRKE2Worker(ctx, lbIP, serviceCtx.VMPassword, workerIP, workerVM, lastServerCommand, rke2ServerToken)
+		workerCmd, err := installRKE2Worker(ctx, lbIP, versions, workerHosts[i], serviceCtx.after(workerVM), lastServerCommand, rke2ServerToken)
 		if err != nil {
 			return fmt.Errorf("failed to install RKE2 agent on worker %s: %w", workerIP, err)
 		}
+		serviceCtx.markDone(workerCmd)
 	}
 
 	ctx.Log.Info(fmt.Sprintf("RKE2 agents installed on %d workers", len(workerVMs)), nil)
 	return nil
 }
-func installRKE2LoadBalancer(ctx *pulumi.Context, serviceCtx ServiceContext) error {
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		ctx.Log.Info("No load balancer configured for RKE2, skipping HAProxy installation", nil)
-		return nil
-	}
-
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbVMs, ok := serviceCtx.GlobalDeps[lbName+"-vms"]
-	if !ok {
-		return fmt.Errorf("load balancer VMs '%s' not found", lbName)
-	}
-
-	lbIPs, ok := serviceCtx.GlobalDeps[lbName+"-ips"].([]string)
-	if !ok || len(lbIPs) == 0 {
-		return fmt.Errorf("load balancer IPs '%s' not found", lbName)
-	}
-
-	lbVM := lbVMs.([]*vm.VirtualMachine)[0]
-	lbIP := lbIPs[0]
-
-	// Get backend IPs from control plane
-	backendIPs := []string{}
-	for _, nodeName := range serviceCtx.ServiceConfig.ControlPlane {
-		if ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string); ok {
-			backendIPs = append(backendIPs, ips...)
-		}
-	}
-
-	ctx.Log.Info(fmt.Sprintf("Installing HAProxy on %s for %d RKE2 backends", lbIP, len(backendIPs)), nil)
-
-	// Generate HAProxy config for RKE2
-	haproxyConfig := generateRKE2HAProxyConfig(backendIPs)
-
-	// Install HAProxy
-	installScript := fmt.Sprintf(`
-echo "Installing HAProxy for RKE2 on %s"
-
-# Update system
-sudo DEBIAN_FRONTEND=noninteractive apt-get update -y 
-sudo DEBIAN_FRONTEND=noninteractive apt-get install -y haproxy
-
-# Backup original config
-sudo cp /etc/haproxy/haproxy.cfg /etc/haproxy/haproxy.cfg.bak || true
-
-# Write new configuration
-sudo tee /etc/haproxy/haproxy.cfg << 'EOF'
-%s
-EOF
-
-# Validate configuration
-if ! sudo haproxy -f /etc/haproxy/haproxy.cfg -c; then
-    echo "HAProxy configuration validation failed!"
-    exit 1
-fi
-
-# Enable and restart HAProxy
-sudo systemctl enable haproxy
-sudo systemctl restart haproxy
-
-echo "HAProxy installation completed for RKE2"
-`, lbIP, haproxyConfig)
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("rke2-haproxy-%s", lbIP),
-		&remote.CommandArgs{
-			Connection: &remote.ConnectionArgs{
-				Host:           pulumi.String(lbIP),
-				User:           pulumi.String("rajeshk"),
-				PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-				PerDialTimeout: pulumi.IntPtr(30),
-				DialErrorLimit: pulumi.IntPtr(20),
-			},
-			Create: pulumi.String(installScript),
-		},
-		pulumi.DependsOn([]pulumi.Resource{lbVM}),
-		pulumi.Timeouts(&pulumi.CustomTimeouts{
-			Create: "10m",
-		}),
-	)
-
-	return err
-}
-func generateRKE2HAProxyConfig(backendIPs []string) string {
-	var config strings.Builder
-	config.WriteString(`global
-    log /dev/log local0
-    log /dev/log local1 notice
-    chroot /var/lib/haproxy
-    stats socket /run/haproxy/admin.sock mode 660 level admin
-    stats timeout 30s
-    user haproxy
-    group haproxy
-    daemon
-
-defaults
-    log     global
-    mode    tcp
-    option  tcplog
-    option  dontlognull
-    timeout connect 5000
-    timeout client  50000
-    timeout server  50000
-
-listen stats
-    bind *:8404
-    stats enable
-    stats uri /stats
-    stats refresh 30s
-
-`)
-
-	// RKE2 API backend (port 6443)
-	config.WriteString(`frontend rke2-api-frontend
-    bind *:6443
-    mode tcp
-    option tcplog
-    default_backend rke2-api-backend
-
-backend rke2-api-backend
-    mode tcp
-    balance roundrobin
-    option tcp-check
-`)
-
-	for i, ip := range backendIPs {
-		config.WriteString(fmt.Sprintf("    server rke2-%d %s:6443 check fall 3 rise 2\n", i+1, ip))
-	}
-
-	// RKE2 Supervisor backend (port 9345)
-	config.WriteString(`
-
-frontend rke2-supervisor-frontend
-    bind *:9345
-    mode tcp
-    option tcplog
-    default_backend rke2-supervisor-backend
-
-backend rke2-supervisor-backend
-    mode tcp
-    balance roundrobin
-    option tcp-check
-`)
-
-	for i, ip := range backendIPs {
-		config.WriteString(fmt.Sprintf("    server rke2-supervisor-%d %s:9345 check fall 3 rise 2\n", i+1, ip))
-	}
-
-	return config.String()
-}
 
 // RKE2-specific installation functions
-func installRKE2Server(ctx *pulumi.Context, lbIP, vmPassword, serverIP string, vmDependency pulumi.Resource, isFirstServer bool, rke2Token pulumi.StringOutput, haproxyDependency pulumi.Resource) (*remote.Command, error) {
-	var rke2Command pulumi.StringInput
-
-	if isFirstServer {
-		// First server - initialize cluster
-		rke2Command = pulumi.Sprintf(`#!/bin/bash
-			set -e
-			set -x
-			# Set DNS resolver
-			sudo tee /etc/systemd/resolved.conf << 'EOF'
-[Resolve]
-DNS=192.168.90.1 8.8.8.8
-FallbackDNS=1.1.1.1
-DNSStubListener=no
-EOF
-			sudo systemctl restart systemd-resolved
-
-			# Create RKE2 config directory
-			sudo mkdir -p /etc/rancher/rke2
-
-			# Create RKE2 server configuration
-			sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
-token: bootstrap-token
-cluster-init: true
-tls-san:
-  - %s
-  - $(hostname -I | awk '{print $1}')
-disable-kube-proxy: true
-cni: none
-disable:
-  - rke2-ingress-nginx
-kube-apiserver-arg:
-  - '--audit-log-path=/var/lib/rancher/rke2/server/logs/audit.log'
-  - '--audit-log-maxage=30'
-  - '--audit-log-maxbackup=10'
-  - '--audit-log-maxsize=100'
-EOF
-
-
-
-
-			# Download and install RKE2
-			curl -sfL https://get.rke2.io | sudo sh -
-
-			# Enable and start RKE2 server
-			sudo systemctl enable --now rke2-server.service &
-
-			# Wait for RKE2 to be ready
-			sleep 120
-
-			# Install Helm
-			curl https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | sudo bash || true
-			
-			# Set up kubeconfig for non-root user
-			mkdir -p $HOME/.kube
-			sudo cp /etc/rancher/rke2/rke2.yaml $HOME/.kube/config
-			sudo chown $(id -u):$(id -g) $HOME/.kube/config
-			chmod 600 $HOME/.kube/config
-			export KUBECONFIG=$HOME/.kube/config
-			
-			# Install Cilium CNI
-			/usr/local/bin/helm repo add cilium https://helm.cilium.io/
-			/usr/local/bin/helm repo update
-			
-			API_SERVER_IP=%s
-			API_SERVER_PORT=6443
-
-			sudo cp /var/lib/rancher/rke2/bin/kubectl /usr/local/bin
-
-			# Install support for kubernetes gateway api
-			sudo /usr/local/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/standard-install.yaml 
-			sudo /usr/local/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/experimental-install.yaml --server-side --force-conflicts
-			
-			KUBECONFIG=$HOME/.kube/config /usr/local/bin/helm install cilium cilium/cilium \
-				--namespace kube-system \
-				--set kubeProxyReplacement=true \
-				--set k8sServiceHost=${API_SERVER_IP} \
-				--set k8sServicePort=${API_SERVER_PORT} \
-				--set hubble.relay.enabled=true \
-				--set l2announcements.enabled=true \
-				--set externalIPs.enabled=true \
-				--set gatewayAPI.enabled=true \
-				--set envoy.enabled=true \
-				--set envoy.log.defaultLevel=debug \
-				--set debug.enabled=true \
-				--set securityContext.capabilities.keepCapNetBindService=true \
-				--set gatewayAPI.enableAlpn=true \
-    			--set gatewayAPI.enableAppProtocol=true 
-			
-			# Install cilium CLI
-			CILIUM_CLI_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/cilium-cli/main/stable.txt)
-			CLI_ARCH=amd64
-			if [ "$(uname -m)" = "aarch64" ]; then CLI_ARCH=arm64; fi
-			curl -L --fail --remote-name-all https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-			sha256sum --check cilium-linux-${CLI_ARCH}.tar.gz.sha256sum
-			sudo tar xzvfC cilium-linux-${CLI_ARCH}.tar.gz /usr/local/bin
-			rm cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-			
-			# Install hubble CLI
-			HUBBLE_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/hubble/master/stable.txt)
-			HUBBLE_ARCH=amd64
-			if [ "$(uname -m)" = "aarch64" ]; then HUBBLE_ARCH=arm64; fi
-			curl -L --fail --remote-name-all https://github.com/cilium/hubble/releases/download/$HUBBLE_VERSION/hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-			sha256sum --check hubble-linux-${HUBBLE_ARCH}.tar.gz.sha256sum
-			sudo tar xzvfC hubble-linux-${HUBBLE_ARCH}.tar.gz /usr/local/bin
-			rm hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-			
-			# Setting up Longhorn pre-requisites
-			curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
-			chmod +x longhornctl
-			sudo mv longhornctl /usr/local/bin/longhornctl
-			kubectl --kubeconfig $HOME/.kube/config create namespace longhorn-system
-			longhornctl --kubeconfig $HOME/.kube/config --image longhornio/longhorn-cli:v1.10.1 install preflight
-
-			# Wait for all nodes to be ready
-			sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml wait --for=condition=Ready nodes --all --timeout=300s
-		`, lbIP, serverIP)
-	} else {
+func installRKE2Server(ctx *pulumi.Context, lbIP string, versions ClusterVersions, cni cniParams, server Host, vmDependencies []pulumi.Resource, isFirstServer bool, rke2Token pulumi.StringOutput, lbDependency pulumi.Resource) (*remote.Command, error) {
+	serverIP := server.IP
+
+	params := rke2ServerParams{
+		DNS:      strings.Join(server.DNS, " "),
+		LBIP:     lbIP,
+		ServerIP: serverIP,
+		Versions: versions,
+		CNI:      cni,
+	}
+	// First server - initialize cluster
+	script, err := renderScript("rke2-server-init.sh.tmpl", params)
+	var stdin pulumi.StringPtrInput
+	if !isFirstServer {
 		// Additional servers - join cluster
-		rke2Command = pulumi.Sprintf(`#!/bin/bash
-			set -e
-			set -x
-			# Set DNS resolver
-			sudo tee /etc/systemd/resolved.conf << 'EOF'
-[Resolve]
-DNS=192.168.90.1 8.8.8.8
-FallbackDNS=1.1.1.1
-DNSStubListener=no
-EOF
-			sudo systemctl restart systemd-resolved
-
-			# Wait for first server to be ready
-			until curl -k -s https://%s:9345/ping; do
-				echo "Waiting for first RKE2 server to be ready..."
-				sleep 10
-			done
-
-			# Create RKE2 config directory
-			sudo mkdir -p /etc/rancher/rke2
-
-			# Create RKE2 server configuration for joining
-			sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
-server: https://%s:9345
-token: %s
-tls-san:
-  - %s
-  - $(hostname -I | awk '{print $1}')
-write-kubeconfig-mode: "0644"
-disable-kube-proxy: true
-cni: none
-disable:
-  - rke2-ingress-nginx
-kube-apiserver-arg:
-  - '--audit-log-path=/var/lib/rancher/rke2/server/logs/audit.log'
-  - '--audit-log-maxage=30'
-  - '--audit-log-maxbackup=10'
-  - '--audit-log-maxsize=100'
-EOF
-
-			# Download and install RKE2
-			curl -sfL https://get.rke2.io | sudo sh -
-
-			# Enable and start RKE2 server
-			sudo systemctl enable --now rke2-server.service
-
-			# Set up kubeconfig for non-root user
-			mkdir -p $HOME/.kube
-			sudo cp /etc/rancher/rke2/rke2.yaml $HOME/.kube/config
-			sudo chown $(id -u):$(id -g) $HOME/.kube/config
-			chmod 600 $HOME/.kube/config
-			export KUBECONFIG=$HOME/.kube/config
-
-			echo "RKE2 server joined cluster successfully"
-		`, lbIP, lbIP, rke2Token, lbIP)
+		script, err = renderScript("rke2-server-join.sh.tmpl", params)
+		stdin = secretStdinFrom("RKE2_TOKEN", rke2Token, nil)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	resourceName := fmt.Sprintf("rke2-server-%s", strings.ReplaceAll(serverIP, ".", "-"))
-	dependencies := []pulumi.Resource{vmDependency}
-	if haproxyDependency != nil {
-		dependencies = append(dependencies, haproxyDependency)
+	dependencies := append([]pulumi.Resource(nil), vmDependencies...)
+	if lbDependency != nil {
+		dependencies = append(dependencies, lbDependency)
 		ctx.Log.Info(fmt.Sprintf("RKE2 server %s will wait for HAProxy installation", serverIP), nil)
 	}
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: rke2Command,
+		Connection: sshConnection(server),
+		Create:     pulumi.String(script),
+		Stdin:      stdin,
 	}, pulumi.DependsOn(dependencies))
 	return cmd, err
 }
 
-func installRKE2Worker(ctx *pulumi.Context, lbIP, vmPassword, workerIP string, vmDependency pulumi.Resource, serverDependency pulumi.Resource, rke2Token pulumi.StringOutput) (*remote.Command, error) {
-
-	rke2Command := pulumi.Sprintf(`
-		# Set DNS resolver
-		sudo tee /etc/resolv.conf << 'EOF'
-nameserver 192.168.90.1
-EOF
+func installRKE2Worker(ctx *pulumi.Context, lbIP string, versions ClusterVersions, worker Host, vmDependencies []pulumi.Resource, serverDependency pulumi.Resource, rke2Token pulumi.StringOutput) (*remote.Command, error) {
+	workerIP := worker.IP
 
-		# Wait for server to be ready
-		until curl -k -s https://%s:9345/ping; do
-			echo "Waiting for RKE2 server to be ready..."
-			sleep 10
-		done
-
-		# Create RKE2 config directory
-		sudo mkdir -p /etc/rancher/rke2
-
-		# Create RKE2 agent configuration
-		sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
-server: https://%s:9345
-token: %s
-EOF
-
-		# Download and install RKE2
-		curl -sfL https://get.rke2.io | INSTALL_RKE2_TYPE="agent" sudo sh -
-
-		# Enable and start RKE2 agent
-		sudo systemctl enable rke2-agent.service
-		sudo systemctl start rke2-agent.service
-
-		echo "RKE2 agent joined cluster successfully"
-	`, lbIP, lbIP, rke2Token)
+	rke2Command, err := renderScript("rke2-agent.sh.tmpl", agentParams{
+		ResolvConf: resolvConf(worker.DNS),
+		LBIP:       lbIP,
+		Versions:   versions,
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	resourceName := fmt.Sprintf("rke2-worker-%s", strings.ReplaceAll(workerIP, ".", "-"))
-	dependencies := []pulumi.Resource{vmDependency}
+	dependencies := append([]pulumi.Resource(nil), vmDependencies...)
 	if serverDependency != nil {
 		dependencies = append(dependencies, serverDependency)
 		ctx.Log.Info(fmt.Sprintf("RKE2 worker %s will wait for RKE2 Server installation", workerIP), nil)
 	}
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(workerIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: rke2Command,
+		Connection: sshConnection(worker),
+		Create:     pulumi.String(rke2Command),
+		Stdin:      secretStdinFrom("RKE2_TOKEN", rke2Token, nil),
 	}, pulumi.DependsOn(dependencies))
 
 	return cmd, err
 }
 
-func getRKE2Token(ctx *pulumi.Context, firstServerIP, vmPassword string, vmDependency pulumi.Resource) (*remote.Command, error) {
-	resourceName := fmt.Sprintf("rke2-token-%s", strings.ReplaceAll(firstServerIP, ".", "-"))
+func getRKE2Token(ctx *pulumi.Context, firstServer Host, vmDependency pulumi.Resource) (*remote.Command, error) {
+	resourceName := fmt.Sprintf("rke2-token-%s", strings.ReplaceAll(firstServer.IP, ".", "-"))
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(firstServerIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
+		Connection: sshConnection(firstServer),
 		Create: pulumi.String(`
 			#!/bin/bash
 			set -e
@@ -1272,12 +550,12 @@ func getRKE2Token(ctx *pulumi.Context, firstServerIP, vmPassword string, vmDepen
 
 			sudo cat /var/lib/rancher/rke2/server/node-token
 		`),
-	}, pulumi.DependsOn([]pulumi.Resource{vmDependency}))
+	}, pulumi.DependsOn([]pulumi.Resource{vmDependency}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 	return cmd, err
 }
 
-func getRKE2Kubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, lastServerCommand pulumi.Resource) (*remote.Command, error) {
-	resourceName := fmt.Sprintf("rke2-kubeconfig-%s", strings.ReplaceAll(serverIP, ".", "-"))
+func getRKE2Kubeconfig(ctx *pulumi.Context, serviceName string, server Host, lbIP string, lastServerCommand pulumi.Resource) (*remote.Command, error) {
+	resourceName := fmt.Sprintf("rke2-kubeconfig-%s", strings.ReplaceAll(server.IP, ".", "-"))
 
 	kubeconfigCommand := fmt.Sprintf(`
 		while [ ! -f /etc/rancher/rke2/rke2.yaml ]; do
@@ -1288,23 +566,16 @@ func getRKE2Kubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, l
 		sudo cat /etc/rancher/rke2/rke2.yaml | sed 's/127.0.0.1:6443/%s:6443/g'`, lbIP)
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: pulumi.String(kubeconfigCommand),
-	}, pulumi.DependsOn([]pulumi.Resource{lastServerCommand}))
+		Connection: sshConnection(server),
+		Create:     pulumi.String(kubeconfigCommand),
+	}, pulumi.DependsOn([]pulumi.Resource{lastServerCommand}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 
 	if err != nil {
 		return nil, err
 	}
 
-	kubeconfigPath := "./rke2-kubeconfig.yaml"
-	_, err = local.NewFile(ctx, "save-rke2-kubeconfig", &local.FileArgs{
+	kubeconfigPath := fmt.Sprintf("./%s-kubeconfig.yaml", serviceName)
+	_, err = local.NewFile(ctx, fmt.Sprintf("save-%s-kubeconfig", serviceName), &local.FileArgs{
 		Filename: pulumi.String(kubeconfigPath),
 		Content:  cmd.Stdout,
 	}, pulumi.DependsOn([]pulumi.Resource{cmd}),
@@ -1313,163 +584,26 @@ func getRKE2Kubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, l
 	if err != nil {
 		return nil, fmt.Errorf("failed to save rke2 kubeconfig locally: %w", err)
 	}
-	ctx.Export("rke2-kubeconfig", cmd.Stdout)
-	ctx.Export("rke2-kubeconfigPath", pulumi.String(kubeconfigPath))
-	ctx.Log.Info("RKE2 kubeconfig exported successfully", nil)
+	ctx.Export(serviceName+"-kubeconfig", pulumi.ToSecret(cmd.Stdout))
+	ctx.Export(serviceName+"-kubeconfigPath", pulumi.String(kubeconfigPath))
+	ctx.Log.Info(fmt.Sprintf("%s kubeconfig exported successfully", serviceName), nil)
 	return cmd, nil
 }
 
-func installKubeadmLoadBalancer(ctx *pulumi.Context, serviceCtx ServiceContext) error {
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		ctx.Log.Info("No load balancer configured for Kubeadm, skipping HAProxy installation", nil)
-		return nil
-	}
-
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbVMs, ok := serviceCtx.GlobalDeps[lbName+"-vms"]
-	if !ok {
-		return fmt.Errorf("load balancer VMs '%s' not found", lbName)
-	}
-
-	lbIPs, ok := serviceCtx.GlobalDeps[lbName+"-ips"].([]string)
-	if !ok || len(lbIPs) == 0 {
-		return fmt.Errorf("load balancer IPs '%s' not found", lbName)
-	}
-
-	lbVM := lbVMs.([]*vm.VirtualMachine)[0]
-	lbIP := lbIPs[0]
-
-	// Get backend IPs from control plane
-	backendIPs := []string{}
-	for _, nodeName := range serviceCtx.ServiceConfig.ControlPlane {
-		if ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string); ok {
-			backendIPs = append(backendIPs, ips...)
-		}
-	}
-
-	ctx.Log.Info(fmt.Sprintf("Installing HAProxy on %s for %d Kubeadm backends", lbIP, len(backendIPs)), nil)
-
-	haproxyConfig := generateKubeadmHAProxyConfig(backendIPs)
-
-	installScript := fmt.Sprintf(`#!/bin/bash
-	set -e
-	set -x
-echo "Installing HAProxy for Kubeadm on %s"
-
-# Update system
-sudo DEBIAN_FRONTEND=noninteractive apt-get update -y 
-sudo DEBIAN_FRONTEND=noninteractive apt-get install -y haproxy
-
-# Backup original config
-sudo cp /etc/haproxy/haproxy.cfg /etc/haproxy/haproxy.cfg.bak || true
-
-# Write new configuration
-sudo tee /etc/haproxy/haproxy.cfg << 'EOF'
-%s
-EOF
-
-# Validate configuration
-if ! sudo haproxy -f /etc/haproxy/haproxy.cfg -c; then
-    echo "HAProxy configuration validation failed!"
-    exit 1
-fi
-
-# Enable and restart HAProxy
-sudo systemctl enable haproxy
-sudo systemctl restart haproxy
-
-echo "HAProxy installation completed for Kubeadm"
-`, lbIP, haproxyConfig)
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-haproxy-%s", lbIP),
-		&remote.CommandArgs{
-			Connection: &remote.ConnectionArgs{
-				Host:           pulumi.String(lbIP),
-				User:           pulumi.String("rajeshk"),
-				PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-				PerDialTimeout: pulumi.IntPtr(30),
-				DialErrorLimit: pulumi.IntPtr(20),
-			},
-			Create: pulumi.String(installScript),
-		},
-		pulumi.DependsOn([]pulumi.Resource{lbVM}),
-		pulumi.Timeouts(&pulumi.CustomTimeouts{
-			Create: "10m",
-		}),
-	)
-
-	return err
-}
-
-func generateKubeadmHAProxyConfig(backendIPs []string) string {
-	var config strings.Builder
-	config.WriteString(`global
-    log /dev/log local0
-    log /dev/log local1 notice
-    chroot /var/lib/haproxy
-    stats socket /run/haproxy/admin.sock mode 660 level admin
-    stats timeout 30s
-    user haproxy
-    group haproxy
-    daemon
-
-defaults
-    log     global
-    mode    tcp
-    option  tcplog
-    option  dontlognull
-    timeout connect 5000
-    timeout client  50000
-    timeout server  50000
-
-listen stats
-    bind *:8404
-    stats enable
-    stats uri /stats
-    stats refresh 30s
-
-`)
-
-	// Kubeadm API backend (port 6443 only, no supervisor port needed)
-	config.WriteString(`frontend kubeadm-api-frontend
-    bind *:6443
-    mode tcp
-    option tcplog
-    default_backend kubeadm-api-backend
-
-backend kubeadm-api-backend
-    mode tcp
-    balance roundrobin
-    option tcp-check
-`)
-
-	for i, ip := range backendIPs {
-		config.WriteString(fmt.Sprintf("    server kubeadm-%d %s:6443 check fall 3 rise 2\n", i+1, ip))
-	}
-
-	return config.String()
-}
-
 func handleKubeadmService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	ctx.Log.Info("Installing Kubeadm Kubernetes cluster", nil)
+	exportClusterVersions(ctx, serviceCtx)
 
-	err := installKubeadmLoadBalancer(ctx, serviceCtx)
+	lbCmd, err := installClusterLoadBalancer(ctx, serviceCtx)
 	if err != nil {
 		return fmt.Errorf("failed to install Kubeadm load balancer: %w", err)
 	}
 
-	// Get load balancer IP
-	if len(serviceCtx.ServiceConfig.LoadBalancer) == 0 {
-		return fmt.Errorf("kubeadm service requires a load balancer configured")
-	}
-
-	lbName := serviceCtx.ServiceConfig.LoadBalancer[0]
-	lbKey := lbName + "-ips"
-	lbIPs, ok := serviceCtx.GlobalDeps[lbKey].([]string)
-	if !ok || len(lbIPs) == 0 {
-		return fmt.Errorf("kubeadm server needs loadbalancer IP but they are not available")
+	// The load balancer VIP, or the address of the single load balancer
+	lbIP, err := clusterEndpoint(serviceCtx)
+	if err != nil {
+		return err
 	}
-	lbIP := lbIPs[0]
 
 	ctx.Log.Info(fmt.Sprintf("Installing Kubeadm with LB IP: %s", lbIP), nil)
 
@@ -1479,55 +613,95 @@ func handleKubeadmService(ctx *pulumi.Context, serviceCtx ServiceContext) error
 	}
 
 	// Get control plane VMs and IPs
-	var controlPlaneVMs []*vm.VirtualMachine
+	var controlPlaneVMs []pulumi.Resource
+	var controlPlaneHosts []Host
 	var controlPlaneIPs []string
 	for _, nodeName := range controlPlaneNodes {
-		vms, ok := serviceCtx.GlobalDeps[nodeName+"-vms"]
+		ready, ok := serviceCtx.GlobalDeps[nodeName+"-ready"].([]pulumi.Resource)
 		if !ok {
 			return fmt.Errorf("control plane VMs for '%s' not found", nodeName)
 		}
-		ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string)
+		hosts, ok := serviceCtx.GlobalDeps[nodeName+"-hosts"].([]Host)
 		if !ok {
 			return fmt.Errorf("control plane IPs for '%s' not found", nodeName)
 		}
-		controlPlaneVMs = append(controlPlaneVMs, vms.([]*vm.VirtualMachine)...)
-		controlPlaneIPs = append(controlPlaneIPs, ips...)
+		controlPlaneVMs = append(controlPlaneVMs, ready...)
+		controlPlaneHosts = append(controlPlaneHosts, hosts...)
+		for _, host := range hosts {
+			controlPlaneIPs = append(controlPlaneIPs, host.IP)
+		}
 	}
 
 	ctx.Log.Info(fmt.Sprintf("Control plane: %d nodes at %v", len(controlPlaneIPs), controlPlaneIPs), nil)
 
 	// Initialize first control plane node
-	firstControlPlaneIP := controlPlaneIPs[0]
+	firstControlPlane := controlPlaneHosts[0]
 	firstControlPlaneVM := controlPlaneVMs[0]
 
-	ctx.Log.Info(fmt.Sprintf("Initializing first control plane node: %s", firstControlPlaneIP), nil)
-	initCmd, joinCommand, err := initKubeadmControlPlane(ctx, firstControlPlaneIP, lbIP, firstControlPlaneVM, serviceCtx)
+	// In kube-vip mode the first node announces the VIP before init, which reaches the API
+	// through it. The others only start kube-vip once they joined: kubeadm join wants an
+	// empty manifests directory.
+	kubeVIP := loadBalancerMode(serviceCtx.ServiceConfig) == "kube-vip"
+	if kubeVIP {
+		kubeVIPCmd, err := installKubeVIP(ctx, serviceCtx, firstControlPlane, kubeadmBootstrapKubeconfig, false, serviceCtx.after(firstControlPlaneVM))
+		if err != nil {
+			return fmt.Errorf("failed to install kube-vip on %s: %w", firstControlPlane.IP, err)
+		}
+		lbCmd = kubeVIPCmd
+	}
+
+	cni, err := clusterCNIParams(serviceCtx.ServiceConfig, firstControlPlane.IP)
+	if err != nil {
+		return err
+	}
+	valuesReady, err := installCiliumValues(ctx, serviceCtx, firstControlPlane, firstControlPlaneVM, cni)
+	if err != nil {
+		return fmt.Errorf("failed to write Cilium values on %s: %w", firstControlPlane.IP, err)
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Initializing first control plane node: %s", firstControlPlane.IP), nil)
+	initCmd, joinCommand, err := initKubeadmControlPlane(ctx, firstControlPlane, lbIP, valuesReady, lbCmd, serviceCtx)
 	if err != nil {
 		return fmt.Errorf("failed to initialize control plane: %w", err)
 	}
 
 	// Join additional control plane nodes if any
-	for i := 1; i < len(controlPlaneIPs); i++ {
+	for i := 1; i < len(controlPlaneHosts); i++ {
 		ctx.Log.Info(fmt.Sprintf("Joining control plane node %d: %s", i, controlPlaneIPs[i]), nil)
-		err := joinKubeadmControlPlane(ctx, controlPlaneIPs[i], controlPlaneVMs[i], joinCommand, serviceCtx)
+		joinCmd, err := joinKubeadmControlPlane(ctx, controlPlaneHosts[i], controlPlaneVMs[i], joinCommand, serviceCtx)
 		if err != nil {
 			return fmt.Errorf("failed to join control plane node %s: %w", controlPlaneIPs[i], err)
 		}
+		if kubeVIP {
+			kubeVIPCmd, err := installKubeVIP(ctx, serviceCtx, controlPlaneHosts[i], "", false, []pulumi.Resource{joinCmd})
+			if err != nil {
+				return fmt.Errorf("failed to install kube-vip on %s: %w", controlPlaneIPs[i], err)
+			}
+			serviceCtx.markDone(kubeVIPCmd)
+		}
 	}
 
 	// Export kubeconfig from first server
-	if firstControlPlaneIP != "" {
-		kubeconfigCmd, err := getKubeadmKubeconfig(ctx, firstControlPlaneIP, serviceCtx.VMPassword, lbIP, initCmd)
+	if firstControlPlane.IP != "" {
+		kubeconfigCmd, err := getKubeadmKubeconfig(ctx, serviceCtx.ServiceName, firstControlPlane, lbIP, initCmd)
 		if err != nil {
 			return fmt.Errorf("failed to extract kubeadm kubeconfig: %w", err)
 		}
-		ctx.Log.Info("Deploying Cilium Gateway on kubeadm...", nil)
-		err = deployCiliumGateway(ctx, firstControlPlaneIP, "kubeadm", kubeconfigCmd, "192.168.91.30", "192.168.91.35")
+		lbReady, err := installMetalLB(ctx, serviceCtx, firstControlPlane, kubeconfigCmd)
 		if err != nil {
-			ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on kubeadm: %v", err), nil)
-			return fmt.Errorf("failed to deploy Cilium Gateway on kubeadm: %w", err)
+			return fmt.Errorf("failed to install MetalLB on kubeadm: %w", err)
+		}
+		serviceCtx.markDone(initCmd, lbReady)
+		if cni.Name == "cilium" {
+			ctx.Log.Info("Deploying Cilium Gateway on kubeadm...", nil)
+			gatewayCmd, err := deployCiliumGateway(ctx, serviceCtx, firstControlPlane, lbReady)
+			if err != nil {
+				ctx.Log.Error(fmt.Sprintf("Cilium Gateway deployment failed on kubeadm: %v", err), nil)
+				return fmt.Errorf("failed to deploy Cilium Gateway on kubeadm: %w", err)
+			}
+			serviceCtx.markDone(gatewayCmd)
+			ctx.Log.Info("Cilium Gateway deployed successfully on kubeadm", nil)
 		}
-		ctx.Log.Info("Cilium Gateway deployed successfully on kubeadm", nil)
 	}
 
 	// Join worker nodes if configured
@@ -1535,21 +709,20 @@ func handleKubeadmService(ctx *pulumi.Context, serviceCtx ServiceContext) error
 	if len(workerNodeNames) > 0 {
 		ctx.Log.Info(fmt.Sprintf("Joining %d worker node groups", len(workerNodeNames)), nil)
 		for _, nodeName := range workerNodeNames {
-			vms, ok := serviceCtx.GlobalDeps[nodeName+"-vms"]
+			workerVMs, ok := serviceCtx.GlobalDeps[nodeName+"-ready"].([]pulumi.Resource)
 			if !ok {
 				continue
 			}
-			ips, ok := serviceCtx.GlobalDeps[nodeName+"-ips"].([]string)
+			hosts, ok := serviceCtx.GlobalDeps[nodeName+"-hosts"].([]Host)
 			if !ok {
 				continue
 			}
 
-			workerVMs := vms.([]*vm.VirtualMachine)
-			for i, workerIP := range ips {
-				ctx.Log.Info(fmt.Sprintf("Joining worker node: %s", workerIP), nil)
-				err := joinKubeadmWorker(ctx, workerIP, workerVMs[i], joinCommand, serviceCtx)
+			for i, worker := range hosts {
+				ctx.Log.Info(fmt.Sprintf("Joining worker node: %s", worker.IP), nil)
+				err := joinKubeadmWorker(ctx, worker, workerVMs[i], joinCommand, serviceCtx)
 				if err != nil {
-					return fmt.Errorf("failed to join worker %s: %w", workerIP, err)
+					return fmt.Errorf("failed to join worker %s: %w", worker.IP, err)
 				}
 			}
 		}
@@ -1562,12 +735,13 @@ func handleKubeadmService(ctx *pulumi.Context, serviceCtx ServiceContext) error
 // K3S Worker Installation Function
 // ========================================
 
-func initKubeadmControlPlane(ctx *pulumi.Context, ip string, lbIP string, vmResource *vm.VirtualMachine, serviceCtx ServiceContext) (*remote.Command, pulumi.StringOutput, error) {
+func initKubeadmControlPlane(ctx *pulumi.Context, host Host, lbIP string, vmResource, lbDependency pulumi.Resource, serviceCtx ServiceContext) (*remote.Command, pulumi.StringOutput, error) {
+	ip := host.IP
 	ctx.Log.Info(fmt.Sprintf("Hello From initKubeadmControlPlane on ip %s", ip), nil)
 
 	// Check if custom CA is provided (optional)
-	caCert := os.Getenv("K8S_CA_CERT")
-	caKey := os.Getenv("K8S_CA_KEY")
+	caCert := credential("kubeadmCaCert")
+	caKey := credential("kubeadmCaKey")
 
 	useCustomCA := caCert != "" && caKey != ""
 
@@ -1578,175 +752,43 @@ func initKubeadmControlPlane(ctx *pulumi.Context, ip string, lbIP string, vmReso
 	}
 
 	config := serviceCtx.ServiceConfig.Config
-	podCIDR := getConfigString(config, "pod-cidr", "10.244.0.0/16")
 	serviceCIDR := getConfigString(config, "service-cidr", "10.96.0.0/12")
+	cni, err := clusterCNIParams(serviceCtx.ServiceConfig, ip)
+	if err != nil {
+		return nil, pulumi.StringOutput{}, err
+	}
 
-	// Prepare CA setup script (empty if not using custom CA)
-	caSetupScript := ""
+	params := kubeadmParams{
+		AdvertiseIP: ip,
+		LBIP:        lbIP,
+		PodCIDR:     cni.PodCIDR,
+		ServiceCIDR: serviceCIDR,
+		Versions:    clusterVersions(serviceCtx.ServiceConfig),
+		KubeVIP:     loadBalancerMode(serviceCtx.ServiceConfig) == "kube-vip",
+		CNI:         cni,
+	}
+	caSecrets := map[string]string{}
 	if useCustomCA {
-		caSetupScript = fmt.Sprintf(`
-# ============================================
-# Copy custom CA files before kubeadm init
-# ============================================
-sudo mkdir -p /etc/kubernetes/pki
-
-cat > /tmp/ca.crt <<'CA_CERT_EOF'
-%s
-CA_CERT_EOF
-
-cat > /tmp/ca.key <<'CA_KEY_EOF'
-%s
-CA_KEY_EOF
-
-sudo cp /tmp/ca.crt /etc/kubernetes/pki/ca.crt
-sudo cp /tmp/ca.key /etc/kubernetes/pki/ca.key
-sudo chmod 600 /etc/kubernetes/pki/ca.key
-
-echo "Custom CA files copied to /etc/kubernetes/pki/"
-`, caCert, caKey)
-	}
-
-	installScript := fmt.Sprintf(`#!/bin/bash
-set -e
-set -x
-
-# Wait for apt locks
-wait_for_apt() {
-    while sudo fuser /var/lib/apt/lists/lock >/dev/null 2>&1 || \
-          sudo fuser /var/lib/dpkg/lock-frontend >/dev/null 2>&1 || \
-          sudo fuser /var/lib/dpkg/lock >/dev/null 2>&1; do
-        echo "Waiting for apt locks..."
-        sleep 5
-    done
-}
-
-%s
-
-# ============================================
-# Create kubeadm config file
-# ============================================
-sudo tee /tmp/kubeadm-config.yaml <<KUBEADM_EOF
----
-apiVersion: kubeadm.k8s.io/v1beta4
-kind: InitConfiguration
-localAPIEndpoint:
-  advertiseAddress: %s
-  bindPort: 6443
-nodeRegistration:
-  criSocket: unix:///var/run/containerd/containerd.sock
-  taints: []
----
-apiVersion: kubeadm.k8s.io/v1beta4
-kind: ClusterConfiguration
-kubernetesVersion: v1.34.3
-controlPlaneEndpoint: "%s:6443"
-networking:
-  podSubnet: %s
-  serviceSubnet: %s
----
-apiVersion: kubelet.config.k8s.io/v1beta1
-kind: KubeletConfiguration
-serverTLSBootstrap: true
-KUBEADM_EOF
-
-# ============================================
-# Initialize cluster
-# ============================================
-sudo kubeadm init \
-  --config=/tmp/kubeadm-config.yaml \
-  --upload-certs \
-  --skip-phases=addon/kube-proxy
-
-# Verify CA issuer
-echo "Verifying CA issuer for apiserver certificate:"
-openssl x509 -in /etc/kubernetes/pki/apiserver.crt -noout -issuer
-
-# Set up kubeconfig
-mkdir -p $HOME/.kube
-sudo cp -i /etc/kubernetes/admin.conf $HOME/.kube/config
-sudo chown $(id -u):$(id -g) $HOME/.kube/config
-
-# Remove control plane taint to allow pod scheduling
-kubectl taint nodes --all node-role.kubernetes.io/control-plane:NoSchedule- || true
-
-# Install Cilium CNI
-/usr/local/bin/helm repo add cilium https://helm.cilium.io/
-/usr/local/bin/helm repo update
-
-API_SERVER_IP=%s
-API_SERVER_PORT=6443
-
-# Install support for kubernetes gateway api
-kubectl apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/standard-install.yaml 
-kubectl apply -f https://github.com/kubernetes-sigs/gateway-api/releases/download/v1.4.1/experimental-install.yaml --server-side --force-conflicts
-
-KUBECONFIG=$HOME/.kube/config /usr/local/bin/helm install cilium cilium/cilium \
-    --namespace kube-system \
-    --set kubeProxyReplacement=true \
-    --set k8sServiceHost=${API_SERVER_IP} \
-    --set k8sServicePort=${API_SERVER_PORT} \
-    --set hubble.relay.enabled=true \
-    --set l2announcements.enabled=true \
-    --set externalIPs.enabled=true \
-    --set gatewayAPI.enabled=true \
-    --set envoy.enabled=true \
-    --set debug.enabled=true \
-    --set securityContext.capabilities.keepCapNetBindService=true \
-	--set gatewayAPI.enableAlpn=true \
-    --set gatewayAPI.enableAppProtocol=true 
-
-# install cilium binary
-CILIUM_CLI_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/cilium-cli/main/stable.txt)
-CLI_ARCH=amd64
-if [ "$(uname -m)" = "aarch64" ]; then CLI_ARCH=arm64; fi
-curl -L --fail --remote-name-all https://github.com/cilium/cilium-cli/releases/download/${CILIUM_CLI_VERSION}/cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-sha256sum --check cilium-linux-${CLI_ARCH}.tar.gz.sha256sum
-sudo tar xzvfC cilium-linux-${CLI_ARCH}.tar.gz /usr/local/bin
-rm cilium-linux-${CLI_ARCH}.tar.gz{,.sha256sum}
-cilium status
-
-# Approve pending kubelet serving certificates
-echo "Approving kubelet serving certificates..."
-sleep 10  # Give kubelets time to generate CSRs
-kubectl get csr | grep Pending | awk '{print $1}' | xargs kubectl certificate approve || true
-
-# install hubble binary
-HUBBLE_VERSION=$(curl -s https://raw.githubusercontent.com/cilium/hubble/master/stable.txt)
-HUBBLE_ARCH=amd64
-if [ "$(uname -m)" = "aarch64" ]; then HUBBLE_ARCH=arm64; fi
-curl -L --fail --remote-name-all https://github.com/cilium/hubble/releases/download/$HUBBLE_VERSION/hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-sha256sum --check hubble-linux-${HUBBLE_ARCH}.tar.gz.sha256sum
-sudo tar xzvfC hubble-linux-${HUBBLE_ARCH}.tar.gz /usr/local/bin
-rm hubble-linux-${HUBBLE_ARCH}.tar.gz{,.sha256sum}
-
-# Upload certificates and get the certificate key
-CERT_KEY=$(sudo kubeadm init phase upload-certs --upload-certs 2>/dev/null | tail -1)
-
-# Generate join command with certificate key
-JOIN_CMD=$(sudo kubeadm token create --print-join-command)
-echo "$JOIN_CMD --certificate-key $CERT_KEY --control-plane" | sudo tee /tmp/kubeadm-join-command.txt
-
-echo "Control plane initialized successfully"
-
-echo "Setup kube-bench"
-curl -L https://github.com/aquasecurity/kube-bench/releases/download/v0.14.1/kube-bench_0.14.1_linux_amd64.tar.gz -o kube-bench.tar.gz
-tar -xvf kube-bench.tar.gz
-sudo mv kube-bench /usr/local/bin/
-sudo mkdir -p /etc/kube-bench
-sudo cp -r cfg/ /etc/kube-bench/
-sudo kube-bench version
-`, caSetupScript, ip, lbIP, podCIDR, serviceCIDR, ip)
-
-	connection := &remote.ConnectionArgs{
-		Host:       pulumi.String(ip),
-		User:       pulumi.String("rajeshk"),
-		PrivateKey: pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
+		params.CustomCA = true
+		caSecrets = map[string]string{"KUBEADM_CA_CERT": caCert, "KUBEADM_CA_KEY": caKey}
 	}
+	installScript, err := renderScript("kubeadm-init.sh.tmpl", params)
+	if err != nil {
+		return nil, pulumi.StringOutput{}, err
+	}
+
+	connection := sshConnection(host)
 
+	// controlPlaneEndpoint has to answer before init can finish
+	dependencies := serviceCtx.after(vmResource)
+	if lbDependency != nil {
+		dependencies = append(dependencies, lbDependency)
+	}
 	cmd, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-init-%s", ip), &remote.CommandArgs{
 		Connection: connection,
 		Create:     pulumi.String(installScript),
-	}, pulumi.DependsOn([]pulumi.Resource{vmResource}))
+		Stdin:      secretStdin(caSecrets),
+	}, pulumi.DependsOn(dependencies))
 
 	if err != nil {
 		return nil, pulumi.StringOutput{}, err
@@ -1755,8 +797,8 @@ sudo kube-bench version
 	// Read the join command
 	joinCmd, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-join-command-%s", ip), &remote.CommandArgs{
 		Connection: connection,
-		Create:     pulumi.String("cat /tmp/kubeadm-join-command.txt"),
-	}, pulumi.DependsOn([]pulumi.Resource{cmd}))
+		Create:     pulumi.String("sudo cat /etc/kubernetes/kubeadm-join-command"),
+	}, pulumi.DependsOn([]pulumi.Resource{cmd}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 
 	if err != nil {
 		return nil, pulumi.StringOutput{}, err
@@ -1765,11 +807,12 @@ sudo kube-bench version
 	return cmd, joinCmd.Stdout, nil
 }
 
-func joinKubeadmControlPlane(ctx *pulumi.Context, ip string, vmResource *vm.VirtualMachine, joinCommand pulumi.StringOutput, serviceCtx ServiceContext) error {
+func joinKubeadmControlPlane(ctx *pulumi.Context, host Host, vmResource pulumi.Resource, joinCommand pulumi.StringOutput, serviceCtx ServiceContext) (*remote.Command, error) {
+	ip := host.IP
 
 	// Check if custom CA is provided (optional)
-	caCert := os.Getenv("CA_CERT")
-	caKey := os.Getenv("CA_KEY")
+	caCert := credential("kubeadmCaCert")
+	caKey := credential("kubeadmCaKey")
 
 	useCustomCA := caCert != "" && caKey != ""
 
@@ -1779,192 +822,54 @@ func joinKubeadmControlPlane(ctx *pulumi.Context, ip string, vmResource *vm.Virt
 		ctx.Log.Info("No custom CA provided - using cluster's CA", nil)
 	}
 
-	// Prepare CA setup script (empty if not using custom CA)
-	caSetupScript := ""
+	params := kubeadmParams{}
+	caSecrets := map[string]string{}
 	if useCustomCA {
-		caSetupScript = fmt.Sprintf(`
-# ============================================
-# Copy custom CA files before kubeadm join
-# ============================================
-sudo mkdir -p /etc/kubernetes/pki
-
-cat > /tmp/ca.crt <<'CA_CERT_EOF'
-%s
-CA_CERT_EOF
-
-cat > /tmp/ca.key <<'CA_KEY_EOF'
-%s
-CA_KEY_EOF
-
-sudo cp /tmp/ca.crt /etc/kubernetes/pki/ca.crt
-sudo cp /tmp/ca.key /etc/kubernetes/pki/ca.key
-sudo chmod 600 /etc/kubernetes/pki/ca.key
-
-echo "Custom CA files copied to /etc/kubernetes/pki/"
-`, caCert, caKey)
-	}
-
-	joinScript := joinCommand.ApplyT(func(cmd string) string {
-		return fmt.Sprintf(`#!/bin/bash
-set -e
-set -x
-
-echo "Setup kube-bench"
-curl -L https://github.com/aquasecurity/kube-bench/releases/download/v0.14.1/kube-bench_0.14.1_linux_amd64.tar.gz -o kube-bench.tar.gz
-tar -xvf kube-bench.tar.gz
-sudo mv kube-bench /usr/local/bin/
-sudo mkdir -p /etc/kube-bench
-sudo cp -r cfg/ /etc/kube-bench/
-sudo kube-bench version
-
-%s
-
-# ============================================
-# Parse join command and create config file
-# ============================================
-
-# Parse the join command
-JOIN_CMD="%s"
-
-# Extract components from join command
-API_ENDPOINT=$(echo "$JOIN_CMD" | grep -oP 'join \K[^ ]+')
-TOKEN=$(echo "$JOIN_CMD" | grep -oP -- '--token \K[^ ]+')
-CA_HASH=$(echo "$JOIN_CMD" | grep -oP -- '--discovery-token-ca-cert-hash \K[^ ]+')
-CERT_KEY=$(echo "$JOIN_CMD" | grep -oP -- '--certificate-key \K[^ ]+')
-
-echo "Parsed join parameters:"
-echo "  API Endpoint: $API_ENDPOINT"
-echo "  Token: $TOKEN"
-echo "  CA Hash: $CA_HASH"
-echo "  Certificate Key: $CERT_KEY"
-
-# Create kubeadm join config file with KubeletConfiguration
-sudo tee /tmp/kubeadm-join-config.yaml <<KUBEADM_JOIN_EOF
----
-apiVersion: kubeadm.k8s.io/v1beta4
-kind: JoinConfiguration
-discovery:
-  bootstrapToken:
-    token: ${TOKEN}
-    apiServerEndpoint: "${API_ENDPOINT}"
-    caCertHashes:
-      - "${CA_HASH}"
-controlPlane:
-  certificateKey: ${CERT_KEY}
-nodeRegistration:
-  criSocket: unix:///var/run/containerd/containerd.sock
-  taints: []
----
-apiVersion: kubelet.config.k8s.io/v1beta1
-kind: KubeletConfiguration
-serverTLSBootstrap: true
-KUBEADM_JOIN_EOF
-
-# Join using config file instead of command line
-echo "Joining cluster with config file..."
-sudo kubeadm join --config=/tmp/kubeadm-join-config.yaml
-
-# Verify CA issuer
-echo "Verifying CA issuer for apiserver certificate:"
-openssl x509 -in /etc/kubernetes/pki/apiserver.crt -noout -issuer
-
-echo "Control plane node joined successfully"
-
-# Set up kubeconfig
-mkdir -p $HOME/.kube
-sudo cp -i /etc/kubernetes/admin.conf $HOME/.kube/config
-sudo chown $(id -u):$(id -g) $HOME/.kube/config
-
-# Wait for kubelet CSR and approve
-echo "Waiting for kubelet serving CSR..."
-sleep 10
-kubectl get csr | grep Pending | awk '{print $1}' | xargs kubectl certificate approve || true
-`, caSetupScript, cmd)
-	}).(pulumi.StringOutput)
-
-	connection := &remote.ConnectionArgs{
-		Host:           pulumi.String(ip),
-		User:           pulumi.String("rajeshk"),
-		PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-		PerDialTimeout: pulumi.IntPtr(30),
-		DialErrorLimit: pulumi.IntPtr(20),
-	}
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-join-cp-%s", ip), &remote.CommandArgs{
-		Connection: connection,
-		Create:     joinScript,
-	}, pulumi.DependsOn([]pulumi.Resource{vmResource}))
+		params.CustomCA = true
+		caSecrets = map[string]string{"KUBEADM_CA_CERT": caCert, "KUBEADM_CA_KEY": caKey}
+	}
+	joinScript, err := renderScript("kubeadm-join-control-plane.sh.tmpl", params)
+	if err != nil {
+		return nil, err
+	}
 
-	return err
-}
+	connection := sshConnection(host)
 
-func joinKubeadmWorker(ctx *pulumi.Context, ip string, vmResource *vm.VirtualMachine, joinCommand pulumi.StringOutput, serviceCtx ServiceContext) error {
-	joinScript := joinCommand.ApplyT(func(cmd string) string {
-		return fmt.Sprintf(`#!/bin/bash
-set -e
-
-# Prerequisites
-swapoff -a
-sed -i '/ swap / s/^\(.*\)$/#\1/g' /etc/fstab
-
-cat <<EOF | tee /etc/modules-load.d/k8s.conf
-overlay
-br_netfilter
-EOF
-
-modprobe overlay
-modprobe br_netfilter
-
-cat <<EOF | tee /etc/sysctl.d/k8s.conf
-net.bridge.bridge-nf-call-iptables  = 1
-net.bridge.bridge-nf-call-ip6tables = 1
-net.ipv4.ip_forward                 = 1
-EOF
-
-sysctl --system
-
-# Install containerd
-apt-get update
-apt-get install -y containerd
-mkdir -p /etc/containerd
-containerd config default | tee /etc/containerd/config.toml
-sed -i 's/SystemdCgroup = false/SystemdCgroup = true/' /etc/containerd/config.toml
-systemctl restart containerd
-systemctl enable containerd
-
-# Install kubeadm, kubelet, kubectl
-apt-get install -y apt-transport-https ca-certificates curl gpg
-mkdir -p -m 755 /etc/apt/keyrings
-curl -fsSL https://pkgs.k8s.io/core:/stable:/v1.34/deb/Release.key | gpg --dearmor -o /etc/apt/keyrings/kubernetes-apt-keyring.gpg
-echo 'deb [signed-by=/etc/apt/keyrings/kubernetes-apt-keyring.gpg] https://pkgs.k8s.io/core:/stable:/v1.34/deb/ /' | tee /etc/apt/sources.list.d/kubernetes.list
-apt-get update
-apt-get install -y kubelet kubeadm kubectl
-apt-mark hold kubelet kubeadm kubectl
-systemctl enable kubelet
-
-# Join as worker
-%s
-`, cmd)
-	}).(pulumi.StringOutput)
-
-	connection := &remote.ConnectionArgs{
-		Host:           pulumi.String(ip),
-		User:           pulumi.String("rajeshk"),
-		PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-		PerDialTimeout: pulumi.IntPtr(30),
-		DialErrorLimit: pulumi.IntPtr(20),
-	}
-
-	_, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-join-worker-%s", ip), &remote.CommandArgs{
+	joinCmd, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-join-cp-%s", ip), &remote.CommandArgs{
 		Connection: connection,
-		Create:     joinScript,
-	}, pulumi.DependsOn([]pulumi.Resource{vmResource}))
+		Create:     pulumi.String(joinScript),
+		Stdin:      secretStdinFrom("KUBEADM_JOIN_COMMAND", joinCommand, caSecrets),
+	}, pulumi.DependsOn(serviceCtx.after(vmResource)))
+	if err != nil {
+		return nil, err
+	}
+	serviceCtx.markDone(joinCmd)
+	return joinCmd, nil
+}
+
+func joinKubeadmWorker(ctx *pulumi.Context, host Host, vmResource pulumi.Resource, joinCommand pulumi.StringOutput, serviceCtx ServiceContext) error {
+	ip := host.IP
+	joinScript, err := renderScript("kubeadm-join-worker.sh.tmpl", kubeadmParams{Versions: clusterVersions(serviceCtx.ServiceConfig)})
+	if err != nil {
+		return err
+	}
+
+	connection := sshConnection(host)
 
-	return err
+	joinCmd, err := remote.NewCommand(ctx, fmt.Sprintf("kubeadm-join-worker-%s", ip), &remote.CommandArgs{
+		Connection: connection,
+		Create:     pulumi.String(joinScript),
+		Stdin:      secretStdinFrom("KUBEADM_JOIN_COMMAND", joinCommand, nil),
+	}, pulumi.DependsOn(serviceCtx.after(vmResource)))
+	if err != nil {
+		return err
+	}
+	serviceCtx.markDone(joinCmd)
+	return nil
 }
 
-func getKubeadmKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string, initCmd pulumi.Resource) (*remote.Command, error) {
-	resourceName := fmt.Sprintf("kubeadm-kubeconfig-%s", strings.ReplaceAll(serverIP, ".", "-"))
+func getKubeadmKubeconfig(ctx *pulumi.Context, serviceName string, server Host, lbIP string, initCmd pulumi.Resource) (*remote.Command, error) {
+	resourceName := fmt.Sprintf("kubeadm-kubeconfig-%s", strings.ReplaceAll(server.IP, ".", "-"))
 
 	kubeconfigCommand := fmt.Sprintf(`
 	  while [ ! -f /etc/kubernetes/admin.conf ]; do
@@ -1975,22 +880,15 @@ func getKubeadmKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string
 	  sudo cat /etc/kubernetes/admin.conf | sed 's/127.0.0.1:6443/%s:6443/g'`, lbIP)
 
 	cmd, err := remote.NewCommand(ctx, resourceName, &remote.CommandArgs{
-		Connection: &remote.ConnectionArgs{
-			Host:           pulumi.String(serverIP),
-			User:           pulumi.String("rajeshk"),
-			PrivateKey:     pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
-			Password:       pulumi.String(vmPassword),
-			PerDialTimeout: pulumi.IntPtr(30),
-			DialErrorLimit: pulumi.IntPtr(20),
-		},
-		Create: pulumi.String(kubeconfigCommand),
-	}, pulumi.DependsOn([]pulumi.Resource{initCmd}))
+		Connection: sshConnection(server),
+		Create:     pulumi.String(kubeconfigCommand),
+	}, pulumi.DependsOn([]pulumi.Resource{initCmd}), pulumi.AdditionalSecretOutputs([]string{"stdout"}))
 
 	if err != nil {
 		return nil, err
 	}
-	kubeconfigPath := "./kubeadm-kubeconfig.yaml"
-	_, err = local.NewFile(ctx, "save-kubeadm-kubeconfig", &local.FileArgs{
+	kubeconfigPath := fmt.Sprintf("./%s-kubeconfig.yaml", serviceName)
+	_, err = local.NewFile(ctx, fmt.Sprintf("save-%s-kubeconfig", serviceName), &local.FileArgs{
 		Filename: pulumi.String(kubeconfigPath),
 		Content:  cmd.Stdout,
 	}, pulumi.DependsOn([]pulumi.Resource{cmd}),
@@ -1999,13 +897,22 @@ func getKubeadmKubeconfig(ctx *pulumi.Context, serverIP, vmPassword, lbIP string
 	if err != nil {
 		return nil, fmt.Errorf("failed to save kubeadm kubeconfig locally: %w", err)
 	}
-	ctx.Export("kubeadm-kubeconfig", cmd.Stdout)
-	ctx.Export("kubeadm-kubeconfigPath", pulumi.String(kubeconfigPath))
-	ctx.Log.Info("Kubeadm kubeconfig exported successfully", nil)
+	ctx.Export(serviceName+"-kubeconfig", pulumi.ToSecret(cmd.Stdout))
+	ctx.Export(serviceName+"-kubeconfigPath", pulumi.String(kubeconfigPath))
+	ctx.Log.Info(fmt.Sprintf("%s kubeconfig exported successfully", serviceName), nil)
 	return cmd, nil
 
 }
 
+// resolvConf renders /etc/resolv.conf for a host's resolvers
+func resolvConf(dns []string) string {
+	lines := make([]string, 0, len(dns))
+	for _, server := range dns {
+		lines = append(lines, "nameserver "+server)
+	}
+	return strings.Join(lines, "\n")
+}
+
 // Helper function to get config values with defaults
 func getConfigString(config map[string]interface{}, key string, defaultValue string) string {
 	if val, ok := config[key]; ok {
@@ -2016,6 +923,15 @@ func getConfigString(config map[string]interface{}, key string, defaultValue str
 	return defaultValue
 }
 
+func getConfigInt(config map[string]interface{}, key string, defaultValue int) int {
+	if val, ok := config[key]; ok {
+		if number, ok := val.(float64); ok {
+			return int(number)
+		}
+	}
+	return defaultValue
+}
+
 func handleHarvesterService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
 	// Harvester is special - VMs boot from iPXE and configure themselves
 	// This handler just logs information about Harvester deployment
@@ -2085,9 +1001,14 @@ func handleHarvesterService(ctx *pulumi.Context, serviceCtx ServiceContext) erro
 	ctx.Log.Info("  Note: VIP, token, and network settings are defined in these configs", nil)
 
 	// Export only the basics
-	ctx.Export("harvester-node-count", pulumi.Int(nodeCount))
-	ctx.Export("harvester-boot-server", pulumi.String(bootServerURL))
-	ctx.Export("harvester-version", pulumi.String(version))
+	ctx.Export(serviceCtx.ServiceName+"-node-count", pulumi.Int(nodeCount))
+	ctx.Export(serviceCtx.ServiceName+"-boot-server", pulumi.String(bootServerURL))
+	ctx.Export(serviceCtx.ServiceName+"-version", pulumi.String(version))
+
+	// Nothing is installed over SSH, services that depend on Harvester wait for its nodes
+	for _, harvesterVM := range harvesterVMs {
+		serviceCtx.markDone(harvesterVM)
+	}
 
 	ctx.Log.Info("", nil)
 	ctx.Log.Info("Post-Installation:", nil)
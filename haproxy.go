@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// defaultHAProxyPorts are the load balancer ports of each cluster type when its config sets no
+// ports. Servers join and agents connect through the load balancer on these, so a ports list
+// of a cluster has to keep their frontends.
+// K3s and RKE2 turn off anonymous auth, so their API servers answer /readyz with 401.
+var defaultHAProxyPorts = map[string][]HAProxyPort{
+	"k3s": {
+		{Name: "api", Frontend: 6443, Backend: 6443, Check: "https", CheckPath: "/readyz", CheckStatus: []int{200, 401}},
+	},
+	"rke2": {
+		{Name: "api", Frontend: 6443, Backend: 6443, Check: "https", CheckPath: "/readyz", CheckStatus: []int{200, 401}},
+		{Name: "supervisor", Frontend: 9345, Backend: 9345, Check: "https", CheckPath: "/ping"},
+	},
+	"kubeadm": {
+		{Name: "api", Frontend: 6443, Backend: 6443, Check: "https", CheckPath: "/readyz"},
+	},
+}
+
+// statsPasswordHash stands in for the hash of the haproxyStats credential in haproxy.cfg. The
+// install script computes the hash on the host and puts it in place.
+const statsPasswordHash = "@STATS_PASSWORD_HASH@"
+
+// haproxyTimeout matches HAProxy time values: a number with an optional unit
+var haproxyTimeout = regexp.MustCompile(`^[0-9]+(us|ms|s|m|h|d)?$`)
+
+// haproxyInstallParams fill scripts/haproxy-install.sh.tmpl. Without Install the script only
+// applies Config to a running HAProxy.
+type haproxyInstallParams struct {
+	Service   string
+	LBIP      string
+	Config    string // Contents of /etc/haproxy/haproxy.cfg
+	Frontends []int  // Ports the health probe expects to accept connections after a reload
+	Install   bool
+	StatsAuth bool // Reads HAPROXY_STATS_PASSWORD from stdin and hashes it into the config
+}
+
+// haproxyConfig is what generateHAProxyConfig renders haproxy.cfg from
+type haproxyConfig struct {
+	Options   HAProxyOptions
+	Backends  []HAProxyBackend
+	StatsAuth bool // The stats page listens on every address behind a login
+}
+
+// haproxyPorts returns the `ports` config of a service, or the ports of its cluster type when
+// it sets none. The list has been checked by validateHAProxyPorts while loading the config.
+func haproxyPorts(config *ServiceConfig) ([]HAProxyPort, error) {
+	raw, set := config.Config["ports"]
+	if !set {
+		return defaultHAProxyPorts[config.Type], nil
+	}
+	var ports []HAProxyPort
+	if err := decodeConfigValue(raw, &ports); err != nil {
+		return nil, fmt.Errorf("invalid ports config: %w", err)
+	}
+	return ports, nil
+}
+
+// haproxyOptions returns the `haproxy` config of a service with the defaults filled in
+func haproxyOptions(config *ServiceConfig) (HAProxyOptions, error) {
+	var options HAProxyOptions
+	if raw, set := config.Config["haproxy"]; set {
+		if err := decodeConfigValue(raw, &options); err != nil {
+			return options, fmt.Errorf("invalid haproxy config: %w", err)
+		}
+	}
+	defaults := []struct {
+		value    *string
+		fallback string
+	}{
+		{&options.Balance, "roundrobin"},
+		{&options.Timeouts.Connect, "5s"},
+		{&options.Timeouts.Client, "50s"},
+		{&options.Timeouts.Server, "50s"},
+		{&options.Timeouts.Check, "5s"},
+		{&options.Stats.User, "admin"},
+	}
+	for _, d := range defaults {
+		if *d.value == "" {
+			*d.value = d.fallback
+		}
+	}
+	if options.Stats.Port == 0 {
+		options.Stats.Port = 8404
+	}
+	if options.Prometheus != nil && options.Prometheus.Port == 0 {
+		options.Prometheus.Port = 8405
+	}
+	return options, nil
+}
+
+// decodeConfigValue decodes a value of a service's config map into its typed form
+func decodeConfigValue(raw, target interface{}) error {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+// validateHAProxyConfig checks the ports and haproxy options of every enabled service that
+// installs HAProxy: the standalone haproxy type and clusters with a load balancer
+func validateHAProxyConfig(services Services, errs *ConfigErrors) {
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		standalone := config.Type == "haproxy"
+		if !standalone && (!isClusterType(config.Type) || len(config.LoadBalancer) == 0) {
+			continue
+		}
+		reserved := validateHAProxyOptions(config, fmt.Sprintf("services.%s.config.haproxy", name), errs)
+
+		path := fmt.Sprintf("services.%s.config.ports", name)
+		raw, set := config.Config["ports"]
+		if standalone {
+			if !set {
+				errs.add(path, "required for service type 'haproxy'")
+			}
+			if config.BackendDiscovery == "" {
+				errs.add(fmt.Sprintf("services.%s.backendDiscovery", name), "required for service type 'haproxy', names the VM group behind the load balancer")
+			}
+		}
+		if !set {
+			continue
+		}
+
+		before := len(*errs)
+		checkSchema(raw, jsonSchemaFor(reflect.TypeOf([]HAProxyPort{})), path, errs)
+		if len(*errs) > before {
+			continue
+		}
+		ports, err := haproxyPorts(config)
+		if err != nil {
+			errs.add(path, "%v", err)
+			continue
+		}
+		if len(ports) == 0 {
+			errs.add(path, "needs at least one port")
+		}
+
+		portNames := make(map[string]bool)
+		frontends := make(map[int]bool)
+		for i, port := range ports {
+			at := fmt.Sprintf("%s[%d]", path, i)
+			if port.Name == "" || strings.ContainsAny(port.Name, " \t") {
+				errs.add(at+".name", "must be a non-empty name without spaces, got %q", port.Name)
+			} else if portNames[port.Name] {
+				errs.add(at+".name", "port '%s' is listed more than once", port.Name)
+			}
+			portNames[port.Name] = true
+			if port.Frontend < 1 || port.Frontend > 65535 {
+				errs.add(at+".frontend", "%d is not a TCP port", port.Frontend)
+			}
+			if port.Backend < 1 || port.Backend > 65535 {
+				errs.add(at+".backend", "%d is not a TCP port", port.Backend)
+			}
+			if frontends[port.Frontend] {
+				errs.add(at+".frontend", "frontend %d is listed more than once", port.Frontend)
+			} else if user, taken := reserved[port.Frontend]; taken {
+				errs.add(at+".frontend", "port %d is already used by %s", port.Frontend, user)
+			}
+			frontends[port.Frontend] = true
+			httpCheck := port.Check == "http" || port.Check == "https"
+			if port.CheckPath != "" && !httpCheck {
+				errs.add(at+".checkPath", "only used with check: http or https")
+			}
+			if len(port.CheckStatus) > 0 && !httpCheck {
+				errs.add(at+".checkStatus", "only used with check: http or https")
+			}
+			for _, status := range port.CheckStatus {
+				if status < 100 || status > 599 {
+					errs.add(at+".checkStatus", "%d is not an HTTP status", status)
+				}
+			}
+		}
+		for _, port := range defaultHAProxyPorts[config.Type] {
+			if !frontends[port.Frontend] {
+				errs.add(path, "%s nodes reach the cluster through frontend %d (%s), keep it in the list", config.Type, port.Frontend, port.Name)
+			}
+		}
+	}
+}
+
+// validateHAProxyOptions checks the haproxy map of a service config. It returns the ports of
+// the stats page and exporter, which the ports list must not reuse, or nil when the map is
+// invalid.
+func validateHAProxyOptions(config *ServiceConfig, path string, errs *ConfigErrors) map[int]string {
+	if raw, set := config.Config["haproxy"]; set {
+		before := len(*errs)
+		checkSchema(raw, jsonSchemaFor(reflect.TypeOf(HAProxyOptions{})), path, errs)
+		if len(*errs) > before {
+			return nil
+		}
+	}
+	options, err := haproxyOptions(config)
+	if err != nil {
+		errs.add(path, "%v", err)
+		return nil
+	}
+
+	timeouts := map[string]string{
+		"connect": options.Timeouts.Connect,
+		"client":  options.Timeouts.Client,
+		"server":  options.Timeouts.Server,
+		"check":   options.Timeouts.Check,
+	}
+	for _, key := range []string{"connect", "client", "server", "check"} {
+		if !haproxyTimeout.MatchString(timeouts[key]) {
+			errs.add(path+".timeouts."+key, "must be a number with an optional unit (us, ms, s, m, h, d), got %q", timeouts[key])
+		}
+	}
+	if strings.ContainsAny(options.Stats.User, " \t:") {
+		errs.add(path+".stats.user", "must not contain spaces or colons, got %q", options.Stats.User)
+	}
+
+	reserved := map[int]string{}
+	if options.Stats.Port < 1 || options.Stats.Port > 65535 {
+		errs.add(path+".stats.port", "%d is not a TCP port", options.Stats.Port)
+	}
+	reserved[options.Stats.Port] = "the stats page"
+	if options.Prometheus != nil {
+		port := options.Prometheus.Port
+		if port < 1 || port > 65535 {
+			errs.add(path+".prometheus.port", "%d is not a TCP port", port)
+		} else if port == options.Stats.Port {
+			errs.add(path+".prometheus.port", "port %d is already used by the stats page", port)
+		}
+		reserved[port] = "the Prometheus exporter"
+	}
+	return reserved
+}
+
+// haproxyBackends pairs every port of a service with the servers behind it
+func haproxyBackends(serviceName string, ports []HAProxyPort, ips []string) []HAProxyBackend {
+	backends := make([]HAProxyBackend, 0, len(ports))
+	for _, port := range ports {
+		backends = append(backends, HAProxyBackend{Name: serviceName + "-" + port.Name, Port: port, IPs: ips})
+	}
+	return backends
+}
+
+// generateHAProxyConfig renders haproxy.cfg: the stats page, the optional Prometheus exporter
+// and one frontend and backend per port
+func generateHAProxyConfig(c haproxyConfig) string {
+	options := c.Options
+	var config strings.Builder
+	config.WriteString(fmt.Sprintf(`global
+    log /dev/log local0
+    log /dev/log local1 notice
+    chroot /var/lib/haproxy
+    stats socket /run/haproxy/admin.sock mode 660 level admin
+    stats timeout 30s
+    user haproxy
+    group haproxy
+    daemon
+
+defaults
+    log     global
+    mode    tcp
+    option  tcplog
+    option  dontlognull
+    timeout connect %s
+    timeout client  %s
+    timeout server  %s
+    timeout check   %s
+`, options.Timeouts.Connect, options.Timeouts.Client, options.Timeouts.Server, options.Timeouts.Check))
+
+	// Without a password the stats page is only reachable from the load balancer itself
+	statsBind := "127.0.0.1"
+	if c.StatsAuth {
+		statsBind = "*"
+		config.WriteString(fmt.Sprintf(`
+userlist stats-users
+    user %s password %s
+`, options.Stats.User, statsPasswordHash))
+	}
+	config.WriteString(fmt.Sprintf(`
+listen stats
+    bind %s:%d
+    mode http
+    option httplog
+`, statsBind, options.Stats.Port))
+	if c.StatsAuth {
+		config.WriteString("    http-request auth realm HAProxy unless { http_auth(stats-users) }\n")
+	}
+	config.WriteString(`    stats enable
+    stats uri /stats
+    stats refresh 30s
+`)
+
+	if options.Prometheus != nil {
+		config.WriteString(fmt.Sprintf(`
+frontend prometheus
+    bind *:%d
+    mode http
+    http-request use-service prometheus-exporter if { path /metrics }
+    no log
+`, options.Prometheus.Port))
+	}
+
+	for _, backend := range c.Backends {
+		port := backend.Port
+		mode, logOption := "tcp", "tcplog"
+		if port.Mode == "http" {
+			mode, logOption = "http", "httplog"
+		}
+		balance := options.Balance
+		if port.Balance != "" {
+			balance = port.Balance
+		}
+		config.WriteString(fmt.Sprintf(`
+frontend %[1]s-frontend
+    bind *:%[2]d
+    mode %[3]s
+    option %[4]s
+    default_backend %[1]s-backend
+
+backend %[1]s-backend
+    mode %[3]s
+    balance %[5]s
+`, backend.Name, port.Frontend, mode, logOption, balance))
+
+		serverCheck := " check fall 3 rise 2"
+		switch port.Check {
+		case "", "tcp":
+			config.WriteString("    option tcp-check\n")
+		case "http", "https":
+			checkPath := port.CheckPath
+			if checkPath == "" {
+				checkPath = "/"
+			}
+			config.WriteString(fmt.Sprintf("    option httpchk\n    http-check send meth GET uri %s\n", checkPath))
+			config.WriteString("    " + httpCheckExpect(port.CheckStatus) + "\n")
+			if port.Check == "https" {
+				// Cluster certificates are self-signed, the check only needs the handshake
+				serverCheck = " check check-ssl verify none fall 3 rise 2"
+			}
+		case "none":
+			serverCheck = ""
+		}
+		for i, ip := range backend.IPs {
+			config.WriteString(fmt.Sprintf("    server %s-%d %s:%d%s\n", backend.Name, i+1, ip, port.Backend, serverCheck))
+		}
+	}
+
+	return config.String()
+}
+
+// httpCheckExpect returns the http-check expect line accepting the given statuses
+func httpCheckExpect(statuses []int) string {
+	switch len(statuses) {
+	case 0:
+		return "http-check expect status 200"
+	case 1:
+		return fmt.Sprintf("http-check expect status %d", statuses[0])
+	}
+	codes := make([]string, len(statuses))
+	for i, status := range statuses {
+		codes[i] = fmt.Sprint(status)
+	}
+	return fmt.Sprintf("http-check expect rstatus ^(%s)$", strings.Join(codes, "|"))
+}
+
+// installHAProxy installs HAProxy on one load balancer host and writes the config for backends.
+// The command runs again when the config changes, for example when a server joins the backends,
+// and then only validates and reloads the new config. The config is part of both scripts, so a
+// change updates the command; triggers would replace it and rerun the install instead.
+func installHAProxy(ctx *pulumi.Context, serviceName string, lb Host, dependencies []pulumi.Resource, options HAProxyOptions, backends []HAProxyBackend) (*remote.Command, error) {
+	statsPassword := credential("haproxyStats")
+	stdin := secretStdin(map[string]string{})
+	if statsPassword != "" {
+		stdin = secretStdin(map[string]string{"HAPROXY_STATS_PASSWORD": statsPassword})
+	}
+	params := haproxyInstallParams{
+		Service:   serviceName,
+		LBIP:      lb.IP,
+		Config:    generateHAProxyConfig(haproxyConfig{Options: options, Backends: backends, StatsAuth: statsPassword != ""}),
+		Install:   true,
+		StatsAuth: statsPassword != "",
+	}
+	for _, backend := range backends {
+		params.Frontends = append(params.Frontends, backend.Port.Frontend)
+	}
+	installScript, err := renderScript("haproxy-install.sh.tmpl", params)
+	if err != nil {
+		return nil, err
+	}
+	params.Install = false
+	reloadScript, err := renderScript("haproxy-install.sh.tmpl", params)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []pulumi.ResourceOption{
+		pulumi.DependsOn(dependencies),
+		pulumi.Timeouts(&pulumi.CustomTimeouts{
+			Create: "10m",
+			Update: "10m",
+		}),
+	}
+	// The default K3s instance keeps the command it had before instances were named
+	if serviceName == "k3s" {
+		opts = append(opts, pulumi.Aliases([]pulumi.Alias{{Name: pulumi.String("haproxy-install-" + lb.IP)}}))
+	}
+
+	return remote.NewCommand(ctx, fmt.Sprintf("%s-haproxy-%s", serviceName, lb.IP),
+		&remote.CommandArgs{
+			Connection: sshConnection(lb),
+			Create:     pulumi.String(installScript),
+			Update:     pulumi.String(reloadScript),
+			Stdin:      stdin,
+		},
+		opts...,
+	)
+}
+
+// installClusterLoadBalancer installs HAProxy on the VMs of a cluster's loadBalancer group,
+// forwarding its ports to the backendDiscovery group or else the cluster's servers. With a vip
+// keepalived runs on top, see installKeepalived. It returns what the cluster nodes wait for,
+// or nil when the cluster has no load balancer or runs kube-vip instead.
+func installClusterLoadBalancer(ctx *pulumi.Context, serviceCtx ServiceContext) (pulumi.Resource, error) {
+	config := serviceCtx.ServiceConfig
+	if loadBalancerMode(config) == "kube-vip" {
+		ctx.Log.Info(fmt.Sprintf("%s control-plane nodes hold their VIP with kube-vip, skipping HAProxy installation", serviceCtx.ServiceName), nil)
+		return nil, nil
+	}
+	if len(config.LoadBalancer) == 0 {
+		ctx.Log.Info(fmt.Sprintf("No load balancer configured for %s, skipping HAProxy installation", serviceCtx.ServiceName), nil)
+		return nil, nil
+	}
+
+	lbName := config.LoadBalancer[0]
+	lbVMs, ok := serviceCtx.GlobalDeps[lbName+"-ready"].([]pulumi.Resource)
+	if !ok || len(lbVMs) == 0 {
+		return nil, fmt.Errorf("load balancer VMs '%s' not found", lbName)
+	}
+	lbHosts, ok := serviceCtx.GlobalDeps[lbName+"-hosts"].([]Host)
+	if !ok || len(lbHosts) == 0 {
+		return nil, fmt.Errorf("load balancer IPs '%s' not found", lbName)
+	}
+
+	backendIPs := serviceCtx.IPs
+	if config.BackendDiscovery != "" {
+		backendIPs, ok = serviceCtx.GlobalDeps[config.BackendDiscovery+"-ips"].([]string)
+		if !ok {
+			return nil, fmt.Errorf("backend IPs '%s' not found", config.BackendDiscovery)
+		}
+	}
+	ports, err := haproxyPorts(config)
+	if err != nil {
+		return nil, err
+	}
+	options, err := haproxyOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a VIP validation allows a single load balancer only
+	vip, _ := clusterVIP(config)
+	if vip == "" {
+		lbHosts = lbHosts[:1]
+	}
+	backends := haproxyBackends(serviceCtx.ServiceName, ports, backendIPs)
+	haproxyCmds := make([]pulumi.Resource, 0, len(lbHosts))
+	for i, lb := range lbHosts {
+		ctx.Log.Info(fmt.Sprintf("Installing HAProxy on %s for %d %s backends", lb.IP, len(backendIPs), serviceCtx.ServiceName), nil)
+		cmd, err := installHAProxy(ctx, serviceCtx.ServiceName, lb, serviceCtx.after(lbVMs[i]), options, backends)
+		if err != nil {
+			return nil, err
+		}
+		haproxyCmds = append(haproxyCmds, cmd)
+	}
+	if vip == "" {
+		return haproxyCmds[0], nil
+	}
+	return installKeepalived(ctx, serviceCtx, lbHosts, haproxyCmds)
+}
+
+// handleHAProxyService installs HAProxy on every target VM, forwarding the configured ports to
+// the VMs of the backendDiscovery group
+func handleHAProxyService(ctx *pulumi.Context, serviceCtx ServiceContext) error {
+	config := serviceCtx.ServiceConfig
+	backendIPs, ok := serviceCtx.GlobalDeps[config.BackendDiscovery+"-ips"].([]string)
+	if !ok || len(backendIPs) == 0 {
+		return fmt.Errorf("backend IPs '%s' not found", config.BackendDiscovery)
+	}
+	ports, err := haproxyPorts(config)
+	if err != nil {
+		return err
+	}
+	options, err := haproxyOptions(config)
+	if err != nil {
+		return err
+	}
+	backends := haproxyBackends(serviceCtx.ServiceName, ports, backendIPs)
+
+	for i, lb := range serviceCtx.Hosts {
+		ctx.Log.Info(fmt.Sprintf("Installing HAProxy on %s for %d backends in '%s'", lb.IP, len(backendIPs), config.BackendDiscovery), nil)
+		cmd, err := installHAProxy(ctx, serviceCtx.ServiceName, lb, serviceCtx.after(serviceCtx.Ready[i]), options, backends)
+		if err != nil {
+			return fmt.Errorf("failed to install HAProxy on %s: %w", lb.IP, err)
+		}
+		serviceCtx.markDone(cmd)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// defaultVRRPID is the keepalived virtual_router_id of a cluster VIP without vrrp-id
+const defaultVRRPID = 51
+
+// keepalivedParams fill scripts/keepalived-install.sh.tmpl. With Auth set the script reads
+// KEEPALIVED_AUTH_PASS from stdin.
+type keepalivedParams struct {
+	Service   string
+	Name      string // vrrp_instance name
+	HostIP    string
+	Peers     []string // The other load balancers, reached by unicast VRRP
+	State     string   // MASTER or BACKUP
+	Priority  int
+	VRRPID    int
+	VIP       string
+	Interface string // Empty to use the interface holding HostIP
+	Auth      bool
+}
+
+// failoverCheckParams fill scripts/keepalived-failover-check.sh.tmpl
+type failoverCheckParams struct {
+	Service string
+	HostIP  string
+	VIP     string
+	Port    int // Frontend that has to answer on the VIP while a backup holds it
+}
+
+// clusterVIP returns the virtual IP of a cluster's load balancers and its VRRP id, or an empty
+// VIP when the cluster uses the address of its single load balancer
+func clusterVIP(config *ServiceConfig) (string, int) {
+	return getConfigString(config.Config, "vip", ""), getConfigInt(config.Config, "vrrp-id", defaultVRRPID)
+}
+
+// clusterEndpoint returns the address nodes, certificates and kubeconfigs use for the API of
+// a cluster: its VIP, or else the first VM of its load balancer group
+func clusterEndpoint(serviceCtx ServiceContext) (string, error) {
+	config := serviceCtx.ServiceConfig
+	if vip, _ := clusterVIP(config); vip != "" {
+		return vip, nil
+	}
+	if len(config.LoadBalancer) == 0 {
+		return "", fmt.Errorf("%s requires a load balancer configured", serviceCtx.ServiceName)
+	}
+	lbIPs, ok := serviceCtx.GlobalDeps[config.LoadBalancer[0]+"-ips"].([]string)
+	if !ok || len(lbIPs) == 0 {
+		return "", fmt.Errorf("%s needs the load balancer IP but it is not available", serviceCtx.ServiceName)
+	}
+	return lbIPs[0], nil
+}
+
+// validateClusterVIPs checks the load-balancer-mode, vip, vrrp-id and vip-interface config of
+// enabled clusters. A load balancer group with more than one VM
+// needs a VIP, since nodes can only be pointed at one address; kube-vip needs one to announce.
+func validateClusterVIPs(stack *StackConfig, errs *ConfigErrors) {
+	groups := make(map[string]VM)
+	vmIPs := make(map[string]string)
+	for _, vmDef := range stack.VMs {
+		groups[vmDef.Name] = vmDef
+		for _, ip := range vmDef.IPs {
+			vmIPs[ip] = vmDef.Name
+		}
+	}
+
+	vips := make(map[string]string)
+	vrrpIDs := make(map[int]string)
+	for _, name := range sortedEnabledServices(stack.Services) {
+		config := stack.Services[name]
+		if !isClusterType(config.Type) {
+			continue
+		}
+		path := fmt.Sprintf("services.%s.config", name)
+
+		kubeVIP := false
+		if raw, set := config.Config["load-balancer-mode"]; set {
+			switch raw {
+			case "haproxy":
+			case "kube-vip":
+				kubeVIP = true
+			default:
+				errs.add(path+".load-balancer-mode", "must be haproxy or kube-vip, got %v", raw)
+			}
+		}
+		if kubeVIP {
+			if len(config.LoadBalancer) > 0 {
+				errs.add(fmt.Sprintf("services.%s.loadBalancer", name), "not used with load-balancer-mode kube-vip, the control-plane nodes hold the VIP")
+			}
+			for _, key := range []string{"vrrp-id", "ports"} {
+				if _, used := config.Config[key]; used {
+					errs.add(path+"."+key, "only used with load-balancer-mode haproxy")
+				}
+			}
+		}
+
+		value, set := config.Config["vip"]
+		if !set && kubeVIP {
+			errs.add(path+".vip", "required with load-balancer-mode kube-vip")
+			continue
+		}
+		if !set {
+			for _, key := range []string{"vrrp-id", "vip-interface"} {
+				if _, used := config.Config[key]; used {
+					errs.add(path+"."+key, "only used together with vip")
+				}
+			}
+			if len(config.LoadBalancer) > 0 {
+				if lb, exists := groups[config.LoadBalancer[0]]; exists && lb.Count > 1 {
+					errs.add(path+".vip", "load balancer group '%s' has %d VMs, set a vip to run them as an active/passive pair", lb.Name, lb.Count)
+				}
+			}
+			continue
+		}
+
+		vip, ok := value.(string)
+		if !ok || net.ParseIP(vip).To4() == nil {
+			errs.add(path+".vip", "must be an IPv4 address, got %v", value)
+			continue
+		}
+		if len(config.LoadBalancer) == 0 && !kubeVIP {
+			errs.add(path+".vip", "needs a loadBalancer group to hold it, or load-balancer-mode kube-vip")
+		}
+		if group, taken := vmIPs[vip]; taken {
+			errs.add(path+".vip", "%s is already the address of a VM in group '%s'", vip, group)
+		}
+		if other, taken := vips[vip]; taken {
+			errs.add(path+".vip", "%s is already the VIP of service '%s'", vip, other)
+		}
+		vips[vip] = name
+
+		if raw, set := config.Config["vip-interface"]; set {
+			if _, ok := raw.(string); !ok {
+				errs.add(path+".vip-interface", "must be a string, got %v", raw)
+			}
+		}
+		if kubeVIP {
+			continue
+		}
+		if raw, set := config.Config["vrrp-id"]; set {
+			if number, ok := raw.(float64); !ok || number != float64(int(number)) || number < 1 || number > 255 {
+				errs.add(path+".vrrp-id", "must be a whole number from 1 to 255, got %v", raw)
+				continue
+			}
+		}
+		_, vrrpID := clusterVIP(config)
+		if other, taken := vrrpIDs[vrrpID]; taken {
+			errs.add(path+".vrrp-id", "%d is already used by service '%s', set a different vrrp-id", vrrpID, other)
+		}
+		vrrpIDs[vrrpID] = name
+	}
+}
+
+// installKeepalived runs keepalived on every load balancer so the first one holds the VIP and
+// the others take it over when it or its HAProxy fails. With more than one load balancer a
+// failover check on the first one follows. It returns the resource the cluster nodes wait for.
+func installKeepalived(ctx *pulumi.Context, serviceCtx ServiceContext, lbHosts []Host, haproxyCmds []pulumi.Resource) (pulumi.Resource, error) {
+	config := serviceCtx.ServiceConfig
+	vip, vrrpID := clusterVIP(config)
+	auth := credential("keepalivedAuth")
+	stdin := secretStdin(map[string]string{})
+	if auth != "" {
+		stdin = secretStdin(map[string]string{"KEEPALIVED_AUTH_PASS": auth})
+	}
+
+	var keepalivedCmds []pulumi.Resource
+	for i, lb := range lbHosts {
+		var peers []string
+		for _, other := range lbHosts {
+			if other.IP != lb.IP {
+				peers = append(peers, other.IP)
+			}
+		}
+		state := "MASTER"
+		if i > 0 {
+			state = "BACKUP"
+		}
+		script, err := renderScript("keepalived-install.sh.tmpl", keepalivedParams{
+			Service:   serviceCtx.ServiceName,
+			Name:      serviceCtx.ServiceName + "-vip",
+			HostIP:    lb.IP,
+			Peers:     peers,
+			State:     state,
+			Priority:  150 - 10*i,
+			VRRPID:    vrrpID,
+			VIP:       vip,
+			Interface: getConfigString(config.Config, "vip-interface", ""),
+			Auth:      auth != "",
+		})
+		if err != nil {
+			return nil, err
+		}
+		ctx.Log.Info(fmt.Sprintf("Installing keepalived on %s as %s for VIP %s", lb.IP, state, vip), nil)
+		cmd, err := remote.NewCommand(ctx, fmt.Sprintf("%s-keepalived-%s", serviceCtx.ServiceName, lb.IP), &remote.CommandArgs{
+			Connection: sshConnection(lb),
+			Create:     pulumi.String(script),
+			Stdin:      stdin,
+		}, pulumi.DependsOn([]pulumi.Resource{haproxyCmds[i]}))
+		if err != nil {
+			return nil, err
+		}
+		keepalivedCmds = append(keepalivedCmds, cmd)
+	}
+	if len(lbHosts) == 1 {
+		return keepalivedCmds[0], nil
+	}
+
+	ports, err := haproxyPorts(config)
+	if err != nil {
+		return nil, err
+	}
+	script, err := renderScript("keepalived-failover-check.sh.tmpl", failoverCheckParams{
+		Service: serviceCtx.ServiceName,
+		HostIP:  lbHosts[0].IP,
+		VIP:     vip,
+		Port:    ports[0].Frontend,
+	})
+	if err != nil {
+		return nil, err
+	}
+	check, err := remote.NewCommand(ctx, fmt.Sprintf("%s-vip-failover-check", serviceCtx.ServiceName), &remote.CommandArgs{
+		Connection: sshConnection(lbHosts[0]),
+		Create:     pulumi.String(script),
+	}, pulumi.DependsOn(keepalivedCmds), pulumi.Timeouts(&pulumi.CustomTimeouts{Create: "5m"}))
+	if err != nil {
+		return nil, err
+	}
+	return check, nil
+}
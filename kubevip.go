@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// kubeVIPPaths are the kubelet's static pod directory and the admin kubeconfig of each
+// cluster type
+var kubeVIPPaths = map[string]struct{ manifests, kubeconfig string }{
+	"k3s":     {"/var/lib/rancher/k3s/agent/pod-manifests", "/etc/rancher/k3s/k3s.yaml"},
+	"rke2":    {"/var/lib/rancher/rke2/agent/pod-manifests", "/etc/rancher/rke2/rke2.yaml"},
+	"kubeadm": {"/etc/kubernetes/manifests", "/etc/kubernetes/admin.conf"},
+}
+
+// kubeadmBootstrapKubeconfig is what kube-vip uses on the first kubeadm node during init:
+// admin.conf only gets its RBAC binding once the API server it announces is up
+const kubeadmBootstrapKubeconfig = "/etc/kubernetes/super-admin.conf"
+
+// kubeVIPParams fill scripts/kube-vip.sh.tmpl
+type kubeVIPParams struct {
+	Service     string
+	HostIP      string
+	VIP         string
+	Interface   string // Empty to use the interface holding HostIP
+	Version     string
+	ManifestDir string
+	Kubeconfig  string // Host file mounted as the kubeconfig kube-vip elects its leader with
+	WaitForVIP  bool   // Wait until an earlier node answers on the VIP before going on
+}
+
+// loadBalancerMode returns how a cluster reaches its API: `haproxy` through the VMs of its
+// loadBalancer group, or `kube-vip` through a VIP its control-plane nodes hold themselves
+func loadBalancerMode(config *ServiceConfig) string {
+	return getConfigString(config.Config, "load-balancer-mode", "haproxy")
+}
+
+// installKubeVIP writes the kube-vip static pod on one control-plane node. kubeconfig
+// overrides the admin kubeconfig of the cluster type when not empty. With waitForVIP the
+// command only finishes once an earlier node serves the API on the VIP, so a node joining
+// through the VIP can depend on it.
+func installKubeVIP(ctx *pulumi.Context, serviceCtx ServiceContext, host Host, kubeconfig string, waitForVIP bool, dependencies []pulumi.Resource) (*remote.Command, error) {
+	config := serviceCtx.ServiceConfig
+	paths, ok := kubeVIPPaths[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("kube-vip is not supported for service type '%s'", config.Type)
+	}
+	if kubeconfig == "" {
+		kubeconfig = paths.kubeconfig
+	}
+	vip, _ := clusterVIP(config)
+
+	script, err := renderScript("kube-vip.sh.tmpl", kubeVIPParams{
+		Service:     serviceCtx.ServiceName,
+		HostIP:      host.IP,
+		VIP:         vip,
+		Interface:   getConfigString(config.Config, "vip-interface", ""),
+		Version:     clusterVersions(config).KubeVIP,
+		ManifestDir: paths.manifests,
+		Kubeconfig:  kubeconfig,
+		WaitForVIP:  waitForVIP,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Installing kube-vip on %s for VIP %s", host.IP, vip), nil)
+	return remote.NewCommand(ctx, fmt.Sprintf("%s-kube-vip-%s", serviceCtx.ServiceName, host.IP), &remote.CommandArgs{
+		Connection: sshConnection(host),
+		Create:     pulumi.String(script),
+	}, pulumi.DependsOn(dependencies), pulumi.Timeouts(&pulumi.CustomTimeouts{Create: "10m"}))
+}
+
+// clusterNodeLoadBalancer returns what the install of one k3s or RKE2 server waits for: the
+// cluster's HAProxy, or in kube-vip mode the kube-vip pod of that server. A server after the
+// first gets its pod once the previous server is installed and the VIP answers.
+func clusterNodeLoadBalancer(ctx *pulumi.Context, serviceCtx ServiceContext, server Host, serverReady, lbCmd, previousServer pulumi.Resource) (pulumi.Resource, error) {
+	if loadBalancerMode(serviceCtx.ServiceConfig) != "kube-vip" {
+		return lbCmd, nil
+	}
+	dependencies := serviceCtx.after(serverReady)
+	if previousServer != nil {
+		dependencies = append(dependencies, previousServer)
+	}
+	cmd, err := installKubeVIP(ctx, serviceCtx, server, "", previousServer != nil, dependencies)
+	if err != nil {
+		return nil, fmt.Errorf("cannot install kube-vip on %s: %w", server.IP, err)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readLayer loads one config layer: a YAML file with the keys of the proxmoxInfra namespace,
+// written without the namespace prefix. Top-level keys starting with `x-` only hold YAML
+// anchors for the rest of the file and are dropped.
+func readLayer(at, path string, properties map[string]interface{}, errs *ConfigErrors) map[string]interface{} {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errs.add(at, "cannot read %s: %v", path, err)
+		return nil
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		errs.add(at, "cannot parse %s: %v", path, err)
+		return nil
+	}
+	if document == nil {
+		return nil
+	}
+	top, ok := jsonValue(document).(map[string]interface{})
+	if !ok {
+		errs.add(at, "%s must be a map of config keys", path)
+		return nil
+	}
+
+	layer := make(map[string]interface{})
+	for key, value := range top {
+		key = strings.TrimPrefix(key, "proxmoxInfra:")
+		switch {
+		case isAnchorKey(key):
+		case key == "layers":
+			errs.add(at, "%s cannot include further layers", path)
+		case properties[key] == nil:
+			errs.add(key, "unknown key in %s", path)
+		default:
+			layer[key] = value
+		}
+	}
+	return layer
+}
+
+// isAnchorKey reports whether a top-level config key only holds YAML anchors
+func isAnchorKey(key string) bool {
+	return strings.HasPrefix(key, "x-")
+}
+
+// jsonValue converts a decoded YAML value into what encoding/json would have produced for
+// the same document, so layers and stack config go through the same schema check
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[key] = jsonValue(item)
+		}
+		return converted
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, item := range value {
+			converted[i] = jsonValue(item)
+		}
+		return converted
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	}
+	return value
+}
+
+// mergeLayer applies overlay on top of base. Maps merge key by key and a null value removes
+// the key. Lists whose items all have a name, like vms and templates, merge item by item
+// with new names appended; any other list or value replaces the one below it.
+func mergeLayer(base, overlay interface{}) interface{} {
+	switch overlay := overlay.(type) {
+	case map[string]interface{}:
+		merged := make(map[string]interface{})
+		if baseMap, ok := base.(map[string]interface{}); ok {
+			for key, value := range baseMap {
+				merged[key] = value
+			}
+		}
+		for key, value := range overlay {
+			if value == nil {
+				delete(merged, key)
+				continue
+			}
+			merged[key] = mergeLayer(merged[key], value)
+		}
+		return merged
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok || !namedItems(baseList) || !namedItems(overlay) {
+			return overlay
+		}
+		merged := make([]interface{}, len(baseList))
+		copy(merged, baseList)
+		positions := make(map[string]int, len(baseList))
+		for i, item := range baseList {
+			positions[item.(map[string]interface{})["name"].(string)] = i
+		}
+		for _, item := range overlay {
+			name := item.(map[string]interface{})["name"].(string)
+			if i, exists := positions[name]; exists {
+				merged[i] = mergeLayer(merged[i], item)
+			} else {
+				positions[name] = len(merged)
+				merged = append(merged, mergeLayer(nil, item))
+			}
+		}
+		return merged
+	}
+	return overlay
+}
+
+// namedItems reports whether every item of a list is a map with a string name
+func namedItems(list []interface{}) bool {
+	for _, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := fields["name"].(string); !ok {
+			return false
+		}
+	}
+	return len(list) > 0
+}
+
+// layeredConfig merges the layer files listed under the stack's `layers` key in order, then
+// the stack's own keys on top: a later layer wins over an earlier one and the stack config
+// wins over every layer
+func layeredConfig(stackRaw, properties map[string]interface{}, errs *ConfigErrors) map[string]interface{} {
+	paths, _ := stackRaw["layers"].([]interface{})
+	merged := make(map[string]interface{})
+	for i, path := range paths {
+		file, ok := path.(string)
+		if !ok {
+			// Reported by the schema check
+			continue
+		}
+		layer := readLayer(fmt.Sprintf("layers[%d]", i), file, properties, errs)
+		merged = mergeLayer(merged, layer).(map[string]interface{})
+	}
+	return mergeLayer(merged, stackRaw).(map[string]interface{})
+}
+
+// effectiveConfig prints the config a stack deploys with after merging its layers, read from
+// Pulumi.<stack>.yaml without the Pulumi engine. Secret values stay encrypted and print as
+// [secret].
+func effectiveConfig(stackName string) (string, error) {
+	var project struct {
+		Name string `yaml:"name"`
+	}
+	data, err := os.ReadFile("Pulumi.yaml")
+	if err != nil {
+		return "", err
+	}
+	if err := yaml.Unmarshal(data, &project); err != nil {
+		return "", fmt.Errorf("Pulumi.yaml: %w", err)
+	}
+
+	stackFile := "Pulumi." + stackName + ".yaml"
+	var settings struct {
+		Config map[string]interface{} `yaml:"config"`
+	}
+	data, err = os.ReadFile(stackFile)
+	if err != nil {
+		return "", err
+	}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return "", fmt.Errorf("%s: %w", stackFile, err)
+	}
+
+	schema := stackConfigSchema()
+	properties := schema["properties"].(map[string]interface{})
+	var errs ConfigErrors
+	stackRaw := make(map[string]interface{})
+	names := make([]string, 0, len(settings.Config))
+	for name := range settings.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := settings.Config[name]
+		key, found := strings.CutPrefix(name, project.Name+":")
+		if !found || isAnchorKey(key) {
+			continue
+		}
+		if properties[key] == nil {
+			errs.add(key, "unknown key in %s%s", stackFile, suggestField(key, properties))
+			continue
+		}
+		if secure, ok := value.(map[string]interface{}); ok && len(secure) == 1 && secure["secure"] != nil {
+			value = "[secret]"
+		}
+		// Pulumi hands every string key over as text, whatever YAML type it was written as
+		if properties[key].(map[string]interface{})["type"] == "string" {
+			switch value.(type) {
+			case nil, string, map[string]interface{}, []interface{}:
+			default:
+				value = fmt.Sprint(value)
+			}
+		}
+		stackRaw[key] = jsonValue(value)
+	}
+
+	merged := layeredConfig(stackRaw, properties, &errs)
+	checkSchema(merged, schema, "", &errs)
+	if len(errs) > 0 {
+		return "", errs
+	}
+
+	// Round trip through JSON so whole numbers print as integers rather than floats
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	var plain interface{}
+	if err := yaml.Unmarshal(encoded, &plain); err != nil {
+		return "", err
+	}
+	var output strings.Builder
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(plain); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
@@ -2,25 +2,72 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
 func main() {
+	// `go run . schema` prints the JSON Schema of the stack config for editors and CI
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		schema, err := exportConfigSchema()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(schema)
+		return
+	}
+	// `go run . effective-config <stack>` prints the stack config merged with its layers
+	if len(os.Args) > 1 && os.Args[1] == "effective-config" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: go run . effective-config <stack>")
+			os.Exit(2)
+		}
+		merged, err := effectiveConfig(os.Args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Print(merged)
+		return
+	}
+
 	pulumi.Run(func(ctx *pulumi.Context) error {
 
 		if err := checkRequiredEnvVars(); err != nil {
 			return err
 		}
 
+		stack, err := loadConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		if err := resolveCredentials(ctx, stack.Credentials); err != nil {
+			return fmt.Errorf("failed to resolve credentials: %w", err)
+		}
+		if err := ctx.RegisterStackTransformation(maskSecretScripts(stack.Password)); err != nil {
+			return err
+		}
 		provider, err := setupProxmoxProvider(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to setup Proxmox provider: %w", err)
 		}
-		vmPassword, _, vms, services, vmCreationConfig, haproxyConfig, err := loadConfig(ctx)
+		vmPassword, vms, services, templates := stack.Password, stack.VMs, stack.Services, stack.Templates
+
+		var renderer *scriptRenderer
+		if stack.Render {
+			renderer, err = enableScriptRender(ctx, stack)
+			if err != nil {
+				return fmt.Errorf("failed to enable script rendering: %w", err)
+			}
+		}
+
+		templateDeps, err := createTemplates(ctx, templates)
 		if err != nil {
-			return fmt.Errorf("failed to load config: %w", err)
+			return fmt.Errorf("failed to create templates: %w", err)
 		}
+
 		//ctx.Log.Info("No VMs configured - nothing to deploy", nil)
 		if len(vms) == 0 {
 			ctx.Log.Info("No VMs configured - nothing to deploy", nil)
@@ -29,7 +76,7 @@ func main() {
 
 		ctx.Log.Info(fmt.Sprintf("=== PHASE 1: Infrastructure - Creating %d VM groups ===", len(vms)), nil)
 
-		vmGroups, err := createVMs(ctx, provider, vms, vmPassword, vmCreationConfig)
+		vmGroups, err := createVMs(ctx, provider, vms, vmPassword, &stack.VMCreation, templateDeps)
 		if err != nil {
 			return fmt.Errorf("failed to create VMs: %s", err)
 		}
@@ -62,8 +109,11 @@ func main() {
 
 		if services != nil {
 			ctx.Log.Info("=== PHASE 2: Services - Installing software on VMs ===", nil)
-			globalDeps := buildGlobalDependency(vmGroups, vms)
-			globalDeps["haproxy-config"] = haproxyConfig
+			readiness, err := createReadinessChecks(ctx, vmGroups, vms, vmPassword)
+			if err != nil {
+				return fmt.Errorf("failed to create readiness checks: %w", err)
+			}
+			globalDeps := buildGlobalDependency(vmGroups, vms, vmPassword, readiness)
 			err = executeServices(ctx, services, vmGroups, globalDeps, vmPassword)
 			if err != nil {
 				return fmt.Errorf("failed to execute services: %w", err)
@@ -80,6 +130,9 @@ func main() {
 				ctx.Log.Info(fmt.Sprintf("Services: Installed %v", enabledServices), nil)
 			}
 		}
+		if renderer != nil {
+			renderer.export(ctx)
+		}
 		return nil
 	})
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// metalLBParams fill scripts/metallb.sh.tmpl
+type metalLBParams struct {
+	Service   string
+	Kubectl   string // kubectl invocation including the cluster's kubeconfig
+	Version   string
+	Addresses []string
+	L2        MetalLBL2
+	BGP       *MetalLBBGP // Announce over BGP instead of L2 when set
+}
+
+// loadBalancerProvider returns what serves the LoadBalancer services of a cluster:
+// loadBalancerProvider when set, else Cilium LB IPAM and L2 announcements on Cilium clusters and
+// nothing on clusters with another CNI
+func loadBalancerProvider(config *ServiceConfig) string {
+	if config.LoadBalancerProvider != "" {
+		return config.LoadBalancerProvider
+	}
+	if clusterCNI(config) == "cilium" {
+		return "cilium"
+	}
+	return ""
+}
+
+// metalLBOptions returns the `metallb` config of a cluster
+func metalLBOptions(config *ServiceConfig) (MetalLBOptions, error) {
+	var options MetalLBOptions
+	if raw, set := config.Config["metallb"]; set {
+		if err := decodeConfigValue(raw, &options); err != nil {
+			return options, fmt.Errorf("invalid metallb config: %w", err)
+		}
+	}
+	return options, nil
+}
+
+// metalLBAddresses returns the addresses of the MetalLB pool of a cluster: metallb.addresses, or
+// else the range of the cluster type
+func metalLBAddresses(config *ServiceConfig) ([]string, error) {
+	options, err := metalLBOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Addresses) > 0 {
+		return options.Addresses, nil
+	}
+	pool := defaultLoadBalancerPools[config.Type]
+	return []string{pool[0] + "-" + pool[1]}, nil
+}
+
+// metalLBAddressBlock returns a MetalLB address, a CIDR or a start-stop range, as a pool block
+func metalLBAddressBlock(address string) CiliumPoolBlock {
+	if start, stop, isRange := strings.Cut(address, "-"); isRange {
+		return CiliumPoolBlock{Start: strings.TrimSpace(start), Stop: strings.TrimSpace(stop)}
+	}
+	return CiliumPoolBlock{CIDR: address}
+}
+
+// installMetalLB installs MetalLB with the address pool and advertisement of its metallb config
+// on the first server of a cluster with loadBalancerProvider metallb, and returns what the
+// gateway waits for. The command runs again when the config or version changes. Clusters served
+// by another provider get kubeconfigReady back.
+func installMetalLB(ctx *pulumi.Context, serviceCtx ServiceContext, server Host, kubeconfigReady pulumi.Resource) (pulumi.Resource, error) {
+	config := serviceCtx.ServiceConfig
+	if loadBalancerProvider(config) != "metallb" {
+		return kubeconfigReady, nil
+	}
+	kubectl, err := clusterKubectl(config.Type)
+	if err != nil {
+		return nil, err
+	}
+	options, err := metalLBOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := metalLBAddresses(config)
+	if err != nil {
+		return nil, err
+	}
+	params := metalLBParams{
+		Service:   serviceCtx.ServiceName,
+		Kubectl:   kubectl,
+		Version:   clusterVersions(config).MetalLB,
+		Addresses: addresses,
+		BGP:       options.BGP,
+	}
+	if options.L2 != nil {
+		params.L2 = *options.L2
+	}
+	script, err := renderScript("metallb.sh.tmpl", params)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Log.Info(fmt.Sprintf("Installing MetalLB %s on %s", params.Version, serviceCtx.ServiceName), nil)
+	cmd, err := remote.NewCommand(ctx, fmt.Sprintf("%s-metallb", serviceCtx.ServiceName), &remote.CommandArgs{
+		Connection: sshConnection(server),
+		Create:     pulumi.String(script),
+		Update:     pulumi.String(script),
+	}, pulumi.DependsOn([]pulumi.Resource{kubeconfigReady}), pulumi.Timeouts(&pulumi.CustomTimeouts{Create: "15m", Update: "15m"}))
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// validateMetalLBConfig checks loadBalancerProvider and the metallb map of every enabled
+// service: only clusters take a provider, cilium needs cni cilium, and the metallb map belongs
+// to metallb clusters and has to make valid MetalLB objects. Its addresses are checked by
+// validateLoadBalancerPools.
+func validateMetalLBConfig(services Services, errs *ConfigErrors) {
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		isCluster := isClusterType(config.Type)
+		if config.LoadBalancerProvider != "" {
+			path := fmt.Sprintf("services.%s.loadBalancerProvider", name)
+			if !isCluster {
+				errs.add(path, "only used by k3s, rke2 and kubeadm clusters")
+			} else if config.LoadBalancerProvider == "cilium" && clusterCNI(config) != "cilium" {
+				errs.add(path, "cilium needs cni cilium, use metallb with cni %s", clusterCNI(config))
+			}
+		}
+		raw, set := config.Config["metallb"]
+		if !set {
+			continue
+		}
+		path := fmt.Sprintf("services.%s.config.metallb", name)
+		if !isCluster || loadBalancerProvider(config) != "metallb" {
+			errs.add(path, "only used by k3s, rke2 and kubeadm clusters with loadBalancerProvider metallb")
+			continue
+		}
+		before := len(*errs)
+		checkSchema(raw, jsonSchemaFor(reflect.TypeOf(MetalLBOptions{})), path, errs)
+		if len(*errs) > before {
+			continue
+		}
+		options, _ := metalLBOptions(config)
+		if options.L2 != nil && options.BGP != nil {
+			errs.add(path, "announces either over l2 or over bgp, not both")
+		}
+		if options.L2 != nil {
+			for i, iface := range options.L2.Interfaces {
+				if !labelValuePattern.MatchString(iface) || iface == "" {
+					errs.add(fmt.Sprintf("%s.l2.interfaces[%d]", path, i), "%q is not an interface name", iface)
+				}
+			}
+			validateCiliumL2Policy(CiliumL2Policy{NodeSelector: options.L2.NodeSelector}, path+".l2", errs)
+		}
+		if options.BGP != nil {
+			if !validASN(options.BGP.MyASN) {
+				errs.add(path+".bgp.myASN", "must be between 1 and 4294967295, got %d", options.BGP.MyASN)
+			}
+			if len(options.BGP.Peers) == 0 {
+				errs.add(path+".bgp.peers", "needs at least one peer")
+			}
+			for i, peer := range options.BGP.Peers {
+				peerPath := fmt.Sprintf("%s.bgp.peers[%d]", path, i)
+				if net.ParseIP(peer.Address) == nil {
+					errs.add(peerPath+".address", "must be an IP address, got %q", peer.Address)
+				}
+				if !validASN(peer.ASN) {
+					errs.add(peerPath+".asn", "must be between 1 and 4294967295, got %d", peer.ASN)
+				}
+				if peer.Port < 0 || peer.Port > 65535 {
+					errs.add(peerPath+".port", "must be between 1 and 65535, got %d", peer.Port)
+				}
+			}
+		}
+	}
+}
+
+// validASN reports whether asn is a 4-byte BGP autonomous system number
+func validASN(asn int) bool {
+	return asn >= 1 && int64(asn) <= 4294967295
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve"
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/storage"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"gopkg.in/yaml.v3"
+)
+
+// NetworkConfigData is what a group's networkConfig template is rendered with, once per VM
+type NetworkConfigData struct {
+	Name    string            // VM name, e.g. rke2-servers-1
+	Index   int64             // Index of the VM in its group
+	IP      string            // Allocated IP from ips
+	Prefix  int               // Prefix length used for IP
+	Gateway string            // Effective gateway of the group
+	Extra   map[string]string // This VM's entry of every extraIps list
+}
+
+// netplanNetwork is the subset of cloud-init network-config v2 that is validated before deploying
+type netplanNetwork struct {
+	Version   int                         `yaml:"version"`
+	Renderer  string                      `yaml:"renderer,omitempty"`
+	Ethernets map[string]netplanInterface `yaml:"ethernets,omitempty"`
+	Bonds     map[string]netplanInterface `yaml:"bonds,omitempty"`
+	Vlans     map[string]netplanInterface `yaml:"vlans,omitempty"`
+	Bridges   map[string]netplanInterface `yaml:"bridges,omitempty"`
+}
+
+type netplanInterface struct {
+	DHCP4       bool                   `yaml:"dhcp4,omitempty"`
+	DHCP6       bool                   `yaml:"dhcp6,omitempty"`
+	Addresses   []string               `yaml:"addresses,omitempty"`
+	Gateway4    string                 `yaml:"gateway4,omitempty"`
+	Gateway6    string                 `yaml:"gateway6,omitempty"`
+	Routes      []netplanRoute         `yaml:"routes,omitempty"`
+	Nameservers netplanNameservers     `yaml:"nameservers,omitempty"`
+	MTU         int                    `yaml:"mtu,omitempty"`
+	Interfaces  []string               `yaml:"interfaces,omitempty"` // bonds and bridges
+	Parameters  map[string]interface{} `yaml:"parameters,omitempty"`
+	ID          *int                   `yaml:"id,omitempty"`   // vlans
+	Link        string                 `yaml:"link,omitempty"` // vlans
+}
+
+type netplanRoute struct {
+	To     string `yaml:"to"`
+	Via    string `yaml:"via"`
+	Metric int    `yaml:"metric,omitempty"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+var bondModes = map[string]bool{
+	"balance-rr": true, "active-backup": true, "balance-xor": true, "broadcast": true,
+	"802.3ad": true, "balance-tlb": true, "balance-alb": true,
+}
+
+// renderNetworkConfig renders the group's networkConfig template for one VM
+func renderNetworkConfig(vmDef VM, vmIndex int64) (string, error) {
+	tmpl, err := template.New(vmDef.Name).Option("missingkey=error").Parse(vmDef.NetworkConfig)
+	if err != nil {
+		return "", fmt.Errorf("VM '%s': networkConfig is not a valid template: %w", vmDef.Name, err)
+	}
+
+	data := NetworkConfigData{
+		Name:    fmt.Sprintf("%s-%d", vmDef.Name, vmIndex),
+		Index:   vmIndex,
+		Prefix:  vmDef.PrefixLength,
+		Gateway: vmDef.Gateway,
+		Extra:   make(map[string]string),
+	}
+	if vmIndex < int64(len(vmDef.IPs)) {
+		data.IP = vmDef.IPs[vmIndex]
+	}
+	for name, ips := range vmDef.ExtraIPs {
+		if vmIndex >= int64(len(ips)) {
+			return "", fmt.Errorf("VM '%s': extraIps.%s needs %d entries, got %d", vmDef.Name, name, vmDef.Count, len(ips))
+		}
+		data.Extra[name] = ips[vmIndex]
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("VM '%s-%d': failed to render networkConfig: %w", vmDef.Name, vmIndex, err)
+	}
+	return rendered.String(), nil
+}
+
+// validateNetworkConfig checks a rendered network-config for the mistakes that leave a VM
+// unreachable: bad addresses, bonds or VLANs pointing at undefined links, and the SSH IP
+// services connect to not being assigned anywhere.
+func validateNetworkConfig(rendered, sshIP string) error {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal([]byte(rendered), &raw); err != nil {
+		return fmt.Errorf("not valid YAML: %w", err)
+	}
+
+	// cloud-init accepts both "network: {version: 2, ...}" and the bare form
+	body := []byte(rendered)
+	if inner, nested := raw["network"]; nested {
+		var err error
+		if body, err = yaml.Marshal(inner); err != nil {
+			return err
+		}
+	}
+
+	var network netplanNetwork
+	if err := yaml.Unmarshal(body, &network); err != nil {
+		return fmt.Errorf("invalid network config: %w", err)
+	}
+	if network.Version != 2 {
+		return fmt.Errorf("version: need 2, got %d", network.Version)
+	}
+
+	kinds := map[string]map[string]netplanInterface{
+		"ethernets": network.Ethernets,
+		"bonds":     network.Bonds,
+		"vlans":     network.Vlans,
+		"bridges":   network.Bridges,
+	}
+	defined := make(map[string]string)
+	for kind, interfaces := range kinds {
+		for name := range interfaces {
+			if other, exists := defined[name]; exists {
+				return fmt.Errorf("interface %s is defined in both %s and %s", name, other, kind)
+			}
+			defined[name] = kind
+		}
+	}
+	if len(defined) == 0 {
+		return fmt.Errorf("no interfaces defined")
+	}
+
+	sshIPAssigned := false
+	anyDHCP := false
+	addresses := make(map[string]string)
+	for kind, interfaces := range kinds {
+		for name, iface := range interfaces {
+			path := fmt.Sprintf("%s.%s", kind, name)
+			anyDHCP = anyDHCP || iface.DHCP4 || iface.DHCP6
+
+			for _, address := range iface.Addresses {
+				ip, _, err := net.ParseCIDR(address)
+				if err != nil {
+					return fmt.Errorf("%s.addresses: %s is not in CIDR notation", path, address)
+				}
+				if other, exists := addresses[ip.String()]; exists {
+					return fmt.Errorf("%s.addresses: %s is also assigned to %s", path, ip, other)
+				}
+				addresses[ip.String()] = path
+				if ip.String() == sshIP {
+					sshIPAssigned = true
+				}
+			}
+			for _, gateway := range []string{iface.Gateway4, iface.Gateway6} {
+				if gateway != "" && net.ParseIP(gateway) == nil {
+					return fmt.Errorf("%s: gateway %s is not an IP address", path, gateway)
+				}
+			}
+			for i, route := range iface.Routes {
+				if route.To != "default" {
+					if _, _, err := net.ParseCIDR(route.To); err != nil {
+						return fmt.Errorf("%s.routes[%d].to: %s is not in CIDR notation", path, i, route.To)
+					}
+				}
+				if net.ParseIP(route.Via) == nil {
+					return fmt.Errorf("%s.routes[%d].via: %s is not an IP address", path, i, route.Via)
+				}
+			}
+			for _, server := range iface.Nameservers.Addresses {
+				if net.ParseIP(server) == nil {
+					return fmt.Errorf("%s.nameservers: %s is not an IP address", path, server)
+				}
+			}
+
+			switch kind {
+			case "bonds", "bridges":
+				if len(iface.Interfaces) == 0 {
+					return fmt.Errorf("%s.interfaces: at least one member interface is required", path)
+				}
+				for _, member := range iface.Interfaces {
+					if _, exists := network.Ethernets[member]; !exists && kind == "bonds" {
+						return fmt.Errorf("%s.interfaces: %s is not defined under ethernets", path, member)
+					}
+					if _, exists := defined[member]; !exists {
+						return fmt.Errorf("%s.interfaces: %s is not defined", path, member)
+					}
+				}
+				if mode, ok := iface.Parameters["mode"].(string); ok && kind == "bonds" && !bondModes[mode] {
+					return fmt.Errorf("%s.parameters.mode: unknown bond mode %s", path, mode)
+				}
+			case "vlans":
+				if iface.ID == nil || *iface.ID < 1 || *iface.ID > 4094 {
+					return fmt.Errorf("%s.id: need a VLAN id between 1 and 4094", path)
+				}
+				if _, exists := defined[iface.Link]; !exists {
+					return fmt.Errorf("%s.link: %s is not defined", path, iface.Link)
+				}
+			}
+		}
+	}
+
+	if sshIP != "" && !sshIPAssigned && !anyDHCP {
+		return fmt.Errorf("allocated IP %s is not assigned to any interface, services could not reach the VM", sshIP)
+	}
+	return nil
+}
+
+// validateGroupNetworkConfig renders and validates the network config of every VM in a group
+func validateGroupNetworkConfig(vmDef VM) error {
+	for i := range vmDef.Count {
+		rendered, err := renderNetworkConfig(vmDef, i)
+		if err != nil {
+			return err
+		}
+		sshIP := ""
+		if i < int64(len(vmDef.IPs)) {
+			sshIP = vmDef.IPs[i]
+		}
+		if err := validateNetworkConfig(rendered, sshIP); err != nil {
+			return fmt.Errorf("VM '%s-%d' networkConfig: %w", vmDef.Name, i, err)
+		}
+	}
+	return nil
+}
+
+// uploadNetworkConfig renders the VM's network config and uploads it as a snippet.
+// The returned file ID is passed to cloud-init as network-data.
+func uploadNetworkConfig(ctx *pulumi.Context, provider *proxmoxve.Provider, vmIndex int64, vmDef VM, nodeName string) (pulumi.StringOutput, error) {
+	rendered, err := renderNetworkConfig(vmDef, vmIndex)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	vmName := fmt.Sprintf("%s-%d", vmDef.Name, vmIndex)
+	file, err := storage.NewFile(ctx, vmName+"-network-config", &storage.FileArgs{
+		ContentType: pulumi.String("snippets"),
+		DatastoreId: pulumi.String(vmDef.SnippetDatastore),
+		NodeName:    pulumi.String(nodeName),
+		SourceRaw: &storage.FileSourceRawArgs{
+			Data:     pulumi.String(strings.TrimSpace(rendered) + "\n"),
+			FileName: pulumi.String(vmName + "-network-config.yaml"),
+		},
+	}, pulumi.Provider(provider))
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to upload network config for %s: %w", vmName, err)
+	}
+	return file.ID().ToStringOutput(), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// readinessScript blocks until cloud-init has finished, the guest agent is running and no
+// package manager holds its locks. Service scripts start from a settled machine after this.
+const readinessScript = `#!/bin/bash
+set -e
+
+if command -v cloud-init >/dev/null 2>&1; then
+    echo "Waiting for cloud-init to finish..."
+    rc=0
+    sudo cloud-init status --wait >/dev/null || rc=$?
+    # 2 means cloud-init finished with recoverable errors
+    if [ $rc -ne 0 ] && [ $rc -ne 2 ]; then
+        echo "cloud-init failed:"
+        sudo cloud-init status --long || true
+        exit 1
+    fi
+fi
+
+echo "Waiting for qemu-guest-agent..."
+for i in $(seq 1 60); do
+    if systemctl is-active --quiet qemu-guest-agent; then
+        break
+    fi
+    sleep 5
+done
+if ! systemctl is-active --quiet qemu-guest-agent; then
+    echo "qemu-guest-agent is not running - install and enable it in the template"
+    exit 1
+fi
+
+package_locks_held() {
+    if command -v fuser >/dev/null 2>&1; then
+        sudo fuser /var/lib/apt/lists/lock /var/lib/dpkg/lock-frontend /var/lib/dpkg/lock >/dev/null 2>&1 && return 0
+    fi
+    pgrep -x apt-get >/dev/null || pgrep -x dpkg >/dev/null || \
+        pgrep -x zypper >/dev/null || pgrep -f transactional-update >/dev/null
+}
+
+echo "Waiting for package manager locks..."
+while package_locks_held; do
+    sleep 5
+done
+
+echo "VM is ready"
+`
+
+// createReadinessChecks adds a readiness resource per cloud-init VM. Services depend on
+// these instead of the raw VM, which only guarantees that Proxmox started the machine.
+// iPXE VMs install themselves without SSH access, so the VM is its own gate.
+func createReadinessChecks(ctx *pulumi.Context, vmGroups map[string][]*vm.VirtualMachine, vms []VM, vmPassword string) (map[string][]pulumi.Resource, error) {
+	readiness := make(map[string][]pulumi.Resource)
+
+	for _, vmDef := range vms {
+		groupVMs, exists := vmGroups[vmDef.Name]
+		if !exists {
+			continue
+		}
+
+		var gates []pulumi.Resource
+		for i, vmInstance := range groupVMs {
+			if vmDef.BootMethod == "ipxe" || i >= len(vmDef.IPs) {
+				gates = append(gates, vmInstance)
+				continue
+			}
+
+			connection := sshConnection(groupHosts(vmDef, vmPassword)[i])
+
+			ready, err := remote.NewCommand(ctx, fmt.Sprintf("%s-%d-ready", vmDef.Name, i), &remote.CommandArgs{
+				Connection: connection,
+				Create:     pulumi.String(readinessScript),
+				// Run again whenever the VM is replaced
+				Triggers: pulumi.Array{vmInstance.ID()},
+			}, pulumi.DependsOn([]pulumi.Resource{vmInstance}),
+				pulumi.Timeouts(&pulumi.CustomTimeouts{
+					Create: "20m",
+				}))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create readiness check for %s-%d: %w", vmDef.Name, i, err)
+			}
+			gates = append(gates, ready)
+		}
+		readiness[vmDef.Name] = gates
+	}
+	return readiness, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	renderDir        = "rendered"
+	appliedRenderDir = "rendered/.applied"
+)
+
+// secretPatterns mask credentials that end up inside scripts. Shell variables ($VAR) are
+// left alone, they are resolved on the host and show what the script reads.
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(-----BEGIN [A-Z ]*PRIVATE KEY-----)(?s:.*?)(-----END [A-Z ]*PRIVATE KEY-----)`), "${1}\n***\n${2}"},
+	{regexp.MustCompile(`(K3S_TOKEN=)[^\s$]\S*`), "${1}***"},
+	{regexp.MustCompile(`(--token[ =])[^\s$]\S*`), "${1}***"},
+	{regexp.MustCompile(`(--discovery-token-ca-cert-hash[ =])[^\s$]\S*`), "${1}***"},
+	{regexp.MustCompile(`(--certificate-key[ =])[^\s$]\S*`), "${1}***"},
+	{regexp.MustCompile(`(?m)(^\s*token:\s*)[^\s$]\S*`), "${1}***"},
+}
+
+// scriptRenderer writes the script of every remote command to ./rendered/<service>/<host>/,
+// so a preview shows what `pulumi up` would run on each machine without reading Go.
+// Updates write to ./rendered/.applied/ instead, which the next preview diffs against.
+type scriptRenderer struct {
+	dryRun   bool
+	hosts    map[string]string // Host IP -> service instance whose scripts run there
+	secrets  []string          // Exact values masked in addition to secretPatterns
+	mu       sync.Mutex
+	statuses pulumi.StringMap // Resource name -> new, changed, unchanged or applied
+}
+
+// enableScriptRender registers the renderer for every remote command created after it
+func enableScriptRender(ctx *pulumi.Context, stack *StackConfig) (*scriptRenderer, error) {
+	renderer := &scriptRenderer{
+		dryRun:   ctx.DryRun(),
+		hosts:    renderHosts(stack),
+		statuses: pulumi.StringMap{},
+	}
+	renderer.secrets = secretValues(stack.Password)
+
+	// Start from an empty tree so scripts of removed hosts do not linger
+	if renderer.dryRun {
+		entries, err := os.ReadDir(renderDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Name() == filepath.Base(appliedRenderDir) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(renderDir, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := os.RemoveAll(appliedRenderDir); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.RegisterStackTransformation(renderer.transform); err != nil {
+		return nil, err
+	}
+	ctx.Log.Info(fmt.Sprintf("Render: writing service scripts to ./%s", renderer.outputDir()), nil)
+	return renderer, nil
+}
+
+// renderHosts maps every host of an enabled service to the service instance. Hosts outside
+// any service, such as Proxmox nodes building templates, are rendered under "other".
+func renderHosts(stack *StackConfig) map[string]string {
+	groupIPs := make(map[string][]string)
+	for _, vmDef := range stack.VMs {
+		groupIPs[vmDef.Name] = vmDef.IPs
+	}
+	hosts := make(map[string]string)
+	for _, name := range getEnabledServices(stack.Services) {
+		for _, ref := range serviceRoles(name, stack.Services[name]) {
+			for _, ip := range groupIPs[ref.group] {
+				if _, claimed := hosts[ip]; !claimed {
+					hosts[ip] = name
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+func (r *scriptRenderer) outputDir() string {
+	if r.dryRun {
+		return renderDir
+	}
+	return appliedRenderDir
+}
+
+func (r *scriptRenderer) transform(args *pulumi.ResourceTransformationArgs) *pulumi.ResourceTransformationResult {
+	if args.Type != "command:remote:Command" {
+		return nil
+	}
+	command, ok := args.Props.(*remote.CommandArgs)
+	if !ok || command.Create == nil || command.Connection == nil {
+		return nil
+	}
+
+	name := args.Name
+	// Scripts built from outputs that are unknown during a preview (tokens of new clusters)
+	// never resolve here and are not rendered
+	status := pulumi.All(command.Connection.ToConnectionOutput(), command.Create.ToStringPtrOutput()).ApplyT(
+		func(values []interface{}) (string, error) {
+			connection := values[0].(remote.Connection)
+			script := values[1].(*string)
+			if script == nil {
+				return "", nil
+			}
+			return r.write(connection.Host, name, *script)
+		}).(pulumi.StringOutput)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The connection carries the SSH key, so the combined output is secret. Statuses are not.
+	r.statuses[name] = pulumi.Unsecret(status).(pulumi.StringOutput)
+	return nil
+}
+
+// write stores one masked script and, during a preview, its diff against the last applied render
+func (r *scriptRenderer) write(host, name, script string) (string, error) {
+	service, ok := r.hosts[host]
+	if !ok {
+		service = "other"
+	}
+	relative := filepath.Join(service, host, name+".sh")
+	path := filepath.Join(r.outputDir(), relative)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	masked := r.mask(script)
+	if err := os.WriteFile(path, []byte(masked), 0o644); err != nil {
+		return "", err
+	}
+	if !r.dryRun {
+		return "applied", nil
+	}
+
+	appliedPath := filepath.Join(appliedRenderDir, relative)
+	applied, err := os.ReadFile(appliedPath)
+	if os.IsNotExist(err) {
+		return "new", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(applied, []byte(masked)) {
+		return "unchanged", nil
+	}
+
+	// diff exits with 1 when the files differ, which is the expected case here
+	diff, err := exec.Command("diff", "-u", appliedPath, path).Output()
+	if err != nil && len(diff) == 0 {
+		diff = []byte(fmt.Sprintf("diff not available (%v), compare %s with %s\n", err, appliedPath, path))
+	}
+	if err := os.WriteFile(path+".diff", diff, 0o644); err != nil {
+		return "", err
+	}
+	return "changed", nil
+}
+
+func (r *scriptRenderer) mask(script string) string {
+	for _, secret := range r.secrets {
+		script = strings.ReplaceAll(script, secret, "***")
+	}
+	for _, secret := range secretPatterns {
+		script = secret.pattern.ReplaceAllString(script, secret.replacement)
+	}
+	return script
+}
+
+// export publishes the status of every rendered script, which also makes Pulumi wait for
+// the files to be written before the program exits
+func (r *scriptRenderer) export(ctx *pulumi.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx.Export("renderedScripts", r.statuses)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigError is one problem in the stack config, located by its config path
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+// ConfigErrors collects every problem found while loading the stack config so they can be
+// reported together instead of one per `pulumi up`
+type ConfigErrors []ConfigError
+
+func (e *ConfigErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e ConfigErrors) Error() string {
+	var report strings.Builder
+	report.WriteString(fmt.Sprintf("invalid stack config (%d problems):", len(e)))
+	for _, problem := range e {
+		report.WriteString(fmt.Sprintf("\n  %s: %s", problem.Path, problem.Message))
+	}
+	return report.String()
+}
+
+// jsonFieldName returns the config key of a struct field and whether it may be omitted
+func jsonFieldName(field reflect.StructField) (string, bool, bool) {
+	if !field.IsExported() {
+		return "", false, false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = field.Name
+	}
+	omitempty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty, true
+}
+
+// jsonSchemaFor builds a JSON Schema (draft 2020-12 subset) from a Go type. Struct fields
+// without omitempty are required, unknown keys are rejected, and an `enum:"a,b"` tag
+// restricts a string field to the listed values.
+func jsonSchemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, omitempty, ok := jsonFieldName(field)
+			if !ok {
+				continue
+			}
+			property := jsonSchemaFor(field.Type)
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		// interface{} and anything else accepts any value
+		return map[string]interface{}{}
+	}
+}
+
+// stackConfigSchema returns the JSON Schema of the proxmoxInfra config namespace
+func stackConfigSchema() map[string]interface{} {
+	schema := jsonSchemaFor(reflect.TypeOf(StackConfig{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "proxmoxInfra stack config"
+	// Unknown keys are mistakes; only `x-` keys may hold YAML anchor templates
+	schema["additionalProperties"] = false
+	schema["patternProperties"] = map[string]interface{}{"^x-": map[string]interface{}{}}
+
+	// Service types come from the registry, so a new handler needs no schema change
+	properties := schema["properties"].(map[string]interface{})
+	instance := properties["services"].(map[string]interface{})["additionalProperties"].(map[string]interface{})
+	instance["properties"].(map[string]interface{})["type"].(map[string]interface{})["enum"] = serviceTypeNames()
+	return schema
+}
+
+// exportConfigSchema renders the stack config schema as indented JSON
+func exportConfigSchema() (string, error) {
+	out, err := json.MarshalIndent(stackConfigSchema(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// checkSchema validates a decoded JSON value against a schema produced by jsonSchemaFor
+// and records every mismatch under its config path
+func checkSchema(value interface{}, schema map[string]interface{}, path string, errs *ConfigErrors) {
+	if value == nil {
+		return
+	}
+
+	switch schema["type"] {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			errs.add(path, "must be a string, got %s", jsonTypeName(value))
+			return
+		}
+		if enum, ok := schema["enum"].([]string); ok && !containsString(enum, str) {
+			errs.add(path, "must be one of %s, got %q", strings.Join(enum, ", "), str)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs.add(path, "must be true or false, got %s", jsonTypeName(value))
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			errs.add(path, "must be a whole number, got %s", jsonTypeName(value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs.add(path, "must be a number, got %s", jsonTypeName(value))
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.add(path, "must be a list, got %s", jsonTypeName(value))
+			return
+		}
+		itemSchema := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			checkSchema(item, itemSchema, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(path, "must be an object, got %s", jsonTypeName(value))
+			return
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		properties, isStruct := schema["properties"].(map[string]interface{})
+		for _, key := range keys {
+			childPath := joinConfigPath(path, key)
+			if isStruct {
+				property, known := properties[key]
+				if !known {
+					if schema["additionalProperties"] == false {
+						errs.add(childPath, "unknown field%s", suggestField(key, properties))
+					}
+					continue
+				}
+				checkSchema(object[key], property.(map[string]interface{}), childPath, errs)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				checkSchema(object[key], additional, childPath, errs)
+			}
+		}
+		if required, ok := schema["required"].([]string); ok {
+			for _, key := range required {
+				if _, present := object[key]; !present {
+					errs.add(joinConfigPath(path, key), "required")
+				}
+			}
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case float64:
+		return fmt.Sprintf("%v", value)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// suggestField points at a known key that differs only in case, the most common typo
+// (for example control-plane style keys from older docs or loadbalancer vs loadBalancer)
+func suggestField(key string, properties map[string]interface{}) string {
+	normalized := strings.ToLower(strings.ReplaceAll(key, "-", ""))
+	for known := range properties {
+		if strings.ToLower(known) == normalized {
+			return fmt.Sprintf(" (did you mean %q?)", known)
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// scriptFiles holds the install scripts run on cluster hosts, one text/template per file
+//
+//go:embed scripts/*.sh.tmpl
+var scriptFiles embed.FS
+
+var scriptTemplates = template.Must(template.New("scripts").ParseFS(scriptFiles, "scripts/*.sh.tmpl"))
+
+// k3sServerParams fill scripts/k3s-server-init.sh.tmpl and scripts/k3s-server-join.sh.tmpl.
+// Both read SUSE_REGISTRATION_CODE from stdin, joining servers also K3S_TOKEN.
+type k3sServerParams struct {
+	ResolvConf string // Contents of /etc/resolv.conf
+	SUSEEmail  string // SUSE Customer Center account the server registers with
+	LBIP       string
+	ServerIP   string
+	Versions   ClusterVersions
+	CNI        cniParams
+}
+
+// rke2ServerParams fill scripts/rke2-server-init.sh.tmpl and scripts/rke2-server-join.sh.tmpl.
+// Joining servers read RKE2_TOKEN from stdin.
+type rke2ServerParams struct {
+	DNS      string // Space separated resolvers
+	LBIP     string
+	ServerIP string
+	Versions ClusterVersions
+	CNI      cniParams
+}
+
+// agentParams fill scripts/k3s-agent.sh.tmpl and scripts/rke2-agent.sh.tmpl, which read
+// K3S_TOKEN or RKE2_TOKEN from stdin
+type agentParams struct {
+	ResolvConf string // Contents of /etc/resolv.conf
+	LBIP       string
+	Versions   ClusterVersions
+}
+
+// kubeadmParams fill the scripts/kubeadm-*.sh.tmpl scripts. With CustomCA set they read
+// KUBEADM_CA_CERT and KUBEADM_CA_KEY from stdin, and joining nodes read KUBEADM_JOIN_COMMAND.
+type kubeadmParams struct {
+	CustomCA    bool
+	AdvertiseIP string
+	LBIP        string
+	PodCIDR     string
+	ServiceCIDR string
+	KubeVIP     bool // kube-vip moves from super-admin.conf to admin.conf once init is done
+	Versions    ClusterVersions
+	CNI         cniParams
+}
+
+// scriptSecrets renders the shell assignments a script reads from stdin with its read-secrets
+// snippet. Passed as the command's stdin, secrets stay out of the Create script and its diff.
+func scriptSecrets(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var assignments strings.Builder
+	for _, name := range names {
+		quoted := "'" + strings.ReplaceAll(values[name], "'", `'\''`) + "'"
+		assignments.WriteString(name + "=" + quoted + "\n")
+	}
+	return assignments.String()
+}
+
+// secretStdin passes secrets known while planning to a script as a secret stdin
+func secretStdin(values map[string]string) pulumi.StringOutput {
+	return pulumi.ToSecret(pulumi.String(scriptSecrets(values))).(pulumi.StringOutput)
+}
+
+// secretStdinFrom passes one secret output, such as a cluster token, to a script as stdin
+func secretStdinFrom(name string, value pulumi.StringOutput, extra map[string]string) pulumi.StringOutput {
+	return pulumi.ToSecret(value.ApplyT(func(secret string) string {
+		values := map[string]string{name: secret}
+		for key, value := range extra {
+			values[key] = value
+		}
+		return scriptSecrets(values)
+	})).(pulumi.StringOutput)
+}
+
+// contentHash identifies rendered content, such as a config file, in command triggers
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// renderScript executes one embedded script template with its parameters
+func renderScript(name string, params interface{}) (string, error) {
+	var script bytes.Buffer
+	if err := scriptTemplates.ExecuteTemplate(&script, name, params); err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// SecretSource resolves the references of one backend, such as an environment variable
+// name or a Vault path, to the secret they point at
+type SecretSource interface {
+	Resolve(ref string) (string, error)
+}
+
+// envSource reads environment variables. An unset variable resolves to an empty value.
+type envSource struct{}
+
+func (envSource) Resolve(ref string) (string, error) {
+	return os.Getenv(ref), nil
+}
+
+// fileSource reads files, with environment variables in the path expanded
+type fileSource struct{}
+
+func (fileSource) Resolve(ref string) (string, error) {
+	path := os.ExpandEnv(ref)
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// configSource reads Pulumi config values, normally stored with `pulumi config set --secret`
+type configSource struct {
+	ctx *pulumi.Context
+}
+
+func (s configSource) Resolve(ref string) (string, error) {
+	namespace, key := "", ref
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		namespace, key = ref[:i], ref[i+1:]
+	}
+	value, err := config.New(s.ctx, namespace).Try(key)
+	if err != nil {
+		return "", fmt.Errorf("pulumi config %s is not set", ref)
+	}
+	return value, nil
+}
+
+// vaultSource reads a field of a HashiCorp Vault KV secret, version 2 or 1, addressed by
+// VAULT_ADDR with the token from VAULT_TOKEN or ~/.vault-token like the vault CLI
+type vaultSource struct {
+	addr      string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func newVaultSource() vaultSource {
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	return vaultSource{
+		addr:      strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		token:     token,
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (v vaultSource) Resolve(ref string) (string, error) {
+	secretPath, field, _ := strings.Cut(ref, "#")
+	mount, path, _ := strings.Cut(secretPath, "/")
+	if field == "" || mount == "" || path == "" {
+		return "", fmt.Errorf("vault reference %q must look like <mount>/<path>#<field>", ref)
+	}
+	if v.addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	// KV version 2 keeps the secret under <mount>/data/<path> next to its metadata
+	data, found, err := v.read(mount + "/data/" + path)
+	if err != nil {
+		return "", err
+	}
+	inner, isV2 := data["data"].(map[string]interface{})
+	if _, hasMetadata := data["metadata"]; found && isV2 && hasMetadata {
+		data = inner
+	} else {
+		data, found, err = v.read(secretPath)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("vault secret %s not found", secretPath)
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", secretPath, field)
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s field %s is not a string", secretPath, field)
+	}
+	return text, nil
+}
+
+// read returns the data of a Vault API path and false when the path does not exist
+func (v vaultSource) read(path string) (map[string]interface{}, bool, error) {
+	request, err := http.NewRequest(http.MethodGet, v.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	request.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		request.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	response, err := v.client.Do(request)
+	if err != nil {
+		return nil, false, fmt.Errorf("vault request failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("vault returned %s for %s: %s", response.Status, path, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, false, fmt.Errorf("vault response for %s: %w", path, err)
+	}
+	return secret.Data, true, nil
+}
+
+// backend returns the source kind and reference of a SecretRef, or an error unless exactly one is set
+func (r SecretRef) backend() (string, string, error) {
+	var kinds []string
+	kind, ref := "", ""
+	for _, candidate := range []struct{ kind, ref string }{
+		{"env", r.Env}, {"file", r.File}, {"config", r.Config}, {"vault", r.Vault},
+	} {
+		if candidate.ref != "" {
+			kinds = append(kinds, candidate.kind)
+			kind, ref = candidate.kind, candidate.ref
+		}
+	}
+	if len(kinds) != 1 {
+		return "", "", fmt.Errorf("must set exactly one of env, file, config or vault, got %d", len(kinds))
+	}
+	return kind, ref, nil
+}
+
+// credentialRef is one credential of CredentialsConfig with its config key and reference
+type credentialRef struct {
+	name     string
+	ref      SecretRef
+	declared bool
+	required bool
+}
+
+// credentialRefs lists every credential, falling back to the `default` tag of undeclared ones
+func credentialRefs(credentials CredentialsConfig) []credentialRef {
+	value := reflect.ValueOf(credentials)
+	refs := make([]credentialRef, 0, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := jsonFieldName(field)
+		credential := credentialRef{name: name, required: field.Tag.Get("required") == "true"}
+		if declared := value.Field(i).Interface().(*SecretRef); declared != nil {
+			credential.ref, credential.declared = *declared, true
+		} else {
+			kind, ref, _ := strings.Cut(field.Tag.Get("default"), ":")
+			switch kind {
+			case "env":
+				credential.ref.Env = ref
+			case "file":
+				credential.ref.File = ref
+			}
+		}
+		refs = append(refs, credential)
+	}
+	return refs
+}
+
+// validateCredentials reports declared references that do not name exactly one source
+func validateCredentials(credentials CredentialsConfig, errs *ConfigErrors) {
+	for _, credential := range credentialRefs(credentials) {
+		if !credential.declared {
+			continue
+		}
+		if _, _, err := credential.ref.backend(); err != nil {
+			errs.add("credentials."+credential.name, "%v", err)
+		}
+	}
+}
+
+// credentials holds every resolved credential by its config key. resolveCredentials fills it
+// once in main, before any resource that needs a credential is created.
+var credentials = map[string]string{}
+
+// resolveCredentials reads every credential from its source and reports all that are missing
+// or cannot be read together
+func resolveCredentials(ctx *pulumi.Context, declared CredentialsConfig) error {
+	sources := map[string]SecretSource{
+		"env":    envSource{},
+		"file":   fileSource{},
+		"config": configSource{ctx: ctx},
+		"vault":  newVaultSource(),
+	}
+
+	var errs ConfigErrors
+	for _, credential := range credentialRefs(declared) {
+		path := "credentials." + credential.name
+		kind, ref, err := credential.ref.backend()
+		if err != nil {
+			// An undeclared credential whose default path is empty, like TLS_CERT_PATH unset
+			if credential.required {
+				errs.add(path, "not declared and has no default source")
+			}
+			continue
+		}
+		value, err := sources[kind].Resolve(ref)
+		if err != nil {
+			errs.add(path, "cannot read %s %s: %v", kind, ref, err)
+			continue
+		}
+		if value == "" && credential.required {
+			errs.add(path, "%s %s is empty", kind, ref)
+			continue
+		}
+		credentials[credential.name] = value
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// credential returns the plain value of a credential, for building scripts and files
+func credential(name string) string {
+	return credentials[name]
+}
+
+// secretValues returns the VM password and every credential except the public SSH key, the
+// values that must never appear in a script, log or plain output
+func secretValues(password string) []string {
+	values := []string{}
+	if password != "" {
+		values = append(values, password)
+	}
+	for name, value := range credentials {
+		if name != "sshPublicKey" && value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// maskSecretScripts marks the script of a remote command as secret when it still embeds one
+// of the secret values, so Pulumi masks it in diffs and encrypts it in state. Scripts built
+// from secret outputs such as cluster tokens are secret already.
+func maskSecretScripts(password string) pulumi.ResourceTransformation {
+	secrets := secretValues(password)
+	return func(args *pulumi.ResourceTransformationArgs) *pulumi.ResourceTransformationResult {
+		if args.Type != "command:remote:Command" {
+			return nil
+		}
+		command, ok := args.Props.(*remote.CommandArgs)
+		if !ok {
+			return nil
+		}
+		script, ok := command.Create.(pulumi.String)
+		if !ok {
+			return nil
+		}
+		for _, secret := range secrets {
+			if strings.Contains(string(script), secret) {
+				command.Create = pulumi.ToSecret(script).(pulumi.StringOutput)
+				return &pulumi.ResourceTransformationResult{Props: command, Opts: args.Opts}
+			}
+		}
+		return nil
+	}
+}
+
+// secretCredential returns a credential as a secret output, so Pulumi encrypts it in state
+// and hides it in diffs
+func secretCredential(name string) pulumi.StringOutput {
+	return pulumi.ToSecret(pulumi.String(credentials[name])).(pulumi.StringOutput)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeVault serves a KV version 2 mount at secret/ and a version 1 mount at kv/, and
+// answers 403 for anything under secret/forbidden
+func fakeVault(t *testing.T) *httptest.Server {
+	t.Helper()
+	responses := map[string]string{
+		"/v1/secret/data/cluster": `{"data": {"data": {"token": "v2-token", "port": 6443}, "metadata": {"version": 3}}}`,
+		"/v1/kv/cluster":          `{"data": {"token": "v1-token"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			t.Errorf("%s: missing Vault token header", r.URL.Path)
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/secret/data/forbidden") {
+			http.Error(w, `{"errors": ["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		body, found := responses[r.URL.Path]
+		if !found {
+			http.Error(w, `{"errors": []}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVaultSource(t *testing.T) {
+	server := fakeVault(t)
+	source := vaultSource{addr: server.URL, token: "test-token", client: server.Client()}
+
+	for _, tc := range []struct {
+		name, ref, want, wantErr string
+	}{
+		{"kv v2", "secret/cluster#token", "v2-token", ""},
+		{"kv v1 after 404", "kv/cluster#token", "v1-token", ""},
+		{"missing field", "secret/cluster#password", "", "has no field password"},
+		{"non-string field", "secret/cluster#port", "", "field port is not a string"},
+		{"missing secret", "kv/absent#token", "", "not found"},
+		{"forbidden", "secret/forbidden#token", "", "403 Forbidden"},
+		{"malformed reference", "secret/cluster", "", "must look like"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := source.Resolve(tc.ref)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("Resolve(%q) error = %v, want one containing %q", tc.ref, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q): %v", tc.ref, err)
+			}
+			if got != tc.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tc.ref, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// proxmoxNodeAddress returns the SSH address for a Proxmox node, falling back to the API endpoint host
+func proxmoxNodeAddress(tmpl VMTemplate) (string, error) {
+	if tmpl.NodeAddress != "" {
+		return tmpl.NodeAddress, nil
+	}
+	endpoint, err := url.Parse(os.Getenv("PROXMOX_VE_ENDPOINT"))
+	if err != nil || endpoint.Hostname() == "" {
+		return "", fmt.Errorf("template '%s': no nodeAddress set and PROXMOX_VE_ENDPOINT has no usable host", tmpl.Name)
+	}
+	return endpoint.Hostname(), nil
+}
+
+// createTemplates imports every declared cloud image and registers it as a template.
+// The returned map is keyed by VMID so cloned VMs can depend on their template. Editing a
+// template replaces its command: the old template is destroyed first, then built again.
+func createTemplates(ctx *pulumi.Context, templates []VMTemplate) (map[int64]pulumi.Resource, error) {
+	templateDeps := make(map[int64]pulumi.Resource)
+
+	for _, tmpl := range templates {
+		host, err := proxmoxNodeAddress(tmpl)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.Log.Info(fmt.Sprintf("Building template '%s' (VMID %d) on %s", tmpl.Name, tmpl.VMID, tmpl.ProxmoxNode), nil)
+
+		cmd, err := remote.NewCommand(ctx, fmt.Sprintf("template-%d", tmpl.VMID), &remote.CommandArgs{
+			Connection: &remote.ConnectionArgs{
+				Host:           pulumi.String(host),
+				User:           pulumi.String(os.Getenv("PROXMOX_VE_SSH_USERNAME")),
+				PrivateKey:     secretCredential("sshPrivateKey"),
+				PerDialTimeout: pulumi.IntPtr(30),
+				DialErrorLimit: pulumi.IntPtr(20),
+			},
+			Create: pulumi.String(generateTemplateBuildScript(tmpl)),
+			Delete: pulumi.String(fmt.Sprintf(`
+if qm status %d >/dev/null 2>&1; then
+    qm destroy %d --purge
+fi
+`, tmpl.VMID, tmpl.VMID)),
+		}, pulumi.Timeouts(&pulumi.CustomTimeouts{
+			Create: "30m",
+		}), pulumi.ReplaceOnChanges([]string{"create"}), pulumi.DeleteBeforeReplace(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build template '%s': %w", tmpl.Name, err)
+		}
+
+		templateDeps[tmpl.VMID] = cmd
+		ctx.Export(fmt.Sprintf("template-%s-vmid", tmpl.Name), pulumi.Int(tmpl.VMID))
+	}
+	return templateDeps, nil
+}
+
+func generateTemplateBuildScript(tmpl VMTemplate) string {
+	// Work on a copy so a local source image is never modified by virt-customize
+	source := tmpl.ImagePath
+	if source == "" {
+		source = tmpl.ImageURL
+	}
+	imagePath := fmt.Sprintf("/var/tmp/pulumi-templates/%d/%s", tmpl.VMID, imageFileName(source))
+	fetch := fmt.Sprintf(`
+mkdir -p /var/tmp/pulumi-templates/$VMID
+cp '%s' "$IMAGE"
+`, tmpl.ImagePath)
+	if tmpl.ImagePath == "" {
+		fetch = fmt.Sprintf(`
+mkdir -p /var/tmp/pulumi-templates/$VMID
+wget -q -O "$IMAGE" '%s'
+`, tmpl.ImageURL)
+	}
+
+	checksum := ""
+	if tmpl.Checksum != "" {
+		checksum = fmt.Sprintf(`
+echo '%s  '"$IMAGE" | sha256sum --check -
+`, tmpl.Checksum)
+	}
+
+	customize := ""
+	if !tmpl.SkipCustomize {
+		packages := append([]string{"qemu-guest-agent"}, tmpl.Packages...)
+		var args strings.Builder
+		args.WriteString(fmt.Sprintf(" --install %s", strings.Join(packages, ",")))
+		args.WriteString(" --run-command 'systemctl enable qemu-guest-agent'")
+		for _, c := range tmpl.Commands {
+			args.WriteString(fmt.Sprintf(" --run-command '%s'", strings.ReplaceAll(c, "'", `'\''`)))
+		}
+		// cloud-init must run again on every clone, so drop whatever state the image carries
+		args.WriteString(" --run-command 'cloud-init clean --logs --machine-id || true'")
+		args.WriteString(" --truncate /etc/machine-id")
+
+		customize = fmt.Sprintf(`
+if ! command -v virt-customize >/dev/null 2>&1; then
+    DEBIAN_FRONTEND=noninteractive apt-get install -y libguestfs-tools
+fi
+virt-customize -a "$IMAGE"%s
+
+# Check: qemu-guest-agent is installed in the image
+virt-customize -a "$IMAGE" --run-command 'command -v qemu-ga'
+`, args.String())
+	}
+
+	firmware := ""
+	if tmpl.Firmware == "ovmf" {
+		firmware = `qm set $VMID --bios ovmf --machine q35 --efidisk0 $STORAGE:0,efitype=4m,pre-enrolled-keys=0
+`
+	}
+
+	orphanCheck := ""
+	if tmpl.StoragePath != "" {
+		orphanCheck = fmt.Sprintf(`
+# Check: no orphaned cloud-init file left in the image directory
+if ls '%s'/images/$VMID/ 2>/dev/null | grep -q cloudinit; then
+    echo "Orphaned cloud-init disk found in %s/images/$VMID/ - remove it before building"
+    exit 1
+fi
+`, tmpl.StoragePath, tmpl.StoragePath)
+	}
+
+	return fmt.Sprintf(`#!/bin/bash
+set -e
+set -x
+
+VMID=%d
+STORAGE=%s
+IMAGE=%s
+
+# Check: this is the node the template belongs to, Proxmox node names are their hostnames
+if [ "$(hostname -s)" != '%s' ]; then
+    echo "Connected to node $(hostname -s), not %s - set nodeAddress of template %s to the address of %s"
+    exit 1
+fi
+
+if qm status $VMID >/dev/null 2>&1; then
+    echo "VMID $VMID already exists - destroy it or pick another vmId"
+    exit 1
+fi
+%s%s%s%s
+qm create $VMID \
+    --name %s \
+    --memory %d \
+    --cores %d \
+    --net0 virtio,bridge=%s \
+    --scsihw virtio-scsi-pci \
+    --ostype l26 \
+    --agent enabled=1 \
+    --serial0 socket \
+    --vga serial0
+%sqm set $VMID --scsi0 $STORAGE:0,import-from=$IMAGE
+qm set $VMID --boot order=scsi0
+
+# Check: the template must not carry a cloud-init drive, Pulumi creates it on clone
+for disk in $(qm config $VMID | grep cloudinit | cut -d: -f1); do
+    qm set $VMID --delete $disk
+done
+if qm config $VMID | grep -q cloudinit; then
+    echo "Template $VMID still has a cloud-init drive attached"
+    exit 1
+fi
+
+qm template $VMID
+rm -rf /var/tmp/pulumi-templates/$VMID
+echo "Template %s registered as VMID $VMID"
+`, tmpl.VMID, tmpl.Datastore, imagePath, tmpl.ProxmoxNode, tmpl.ProxmoxNode, tmpl.Name, tmpl.ProxmoxNode,
+		fetch, checksum, customize, orphanCheck,
+		tmpl.Name, tmpl.Memory, tmpl.CPU, tmpl.Bridge, firmware, tmpl.Name)
+}
+
+func imageFileName(imageURL string) string {
+	parsed, err := url.Parse(imageURL)
+	if err != nil {
+		return "image.qcow2"
+	}
+	parts := strings.Split(parsed.Path, "/")
+	if name := parts[len(parts)-1]; name != "" {
+		return name
+	}
+	return "image.qcow2"
+}
@@ -0,0 +1,158 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+set -x
+export KUBECONFIG=$HOME/.kube/config
+echo "Deploying the Cilium gateway apps on rke2"
+
+# Namespaces of the gateway and its certificates
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml create namespace cilium-gateway --dry-run=client -o yaml | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml create namespace certificates --dry-run=client -o yaml | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+
+# TLS secret rancher-tls from files, written untraced
+{ set +x; } 2>/dev/null
+TLS_DIR=$(mktemp -d)
+printf '%s\n' "$TLS_CERT_0" > "$TLS_DIR/tls.crt"
+printf '%s\n' "$TLS_KEY_0" > "$TLS_DIR/tls.key"
+set -x
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n certificates create secret tls rancher-tls \
+    --cert="$TLS_DIR/tls.crt" \
+    --key="$TLS_DIR/tls.key" \
+    --dry-run=client -o yaml | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+rm -r "$TLS_DIR"
+
+# cert-manager issues apps-tls from the ClusterIssuer letsencrypt
+cat << 'GATEWAY_EOF' | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: apps-tls
+  namespace: certificates
+spec:
+  secretName: apps-tls
+  issuerRef:
+    name: letsencrypt
+    kind: ClusterIssuer
+    group: cert-manager.io
+  dnsNames:
+  - "*.apps.example.com"
+GATEWAY_EOF
+
+# wildcard-tls is an existing secret in cilium-gateway
+
+# Let the gateway read the certificates in certificates
+cat << 'GATEWAY_EOF' | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+apiVersion: gateway.networking.k8s.io/v1beta1
+kind: ReferenceGrant
+metadata:
+  name: allow-apps
+  namespace: certificates
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: Gateway
+    namespace: cilium-gateway
+  to:
+  - group: ""
+    kind: Secret
+GATEWAY_EOF
+
+# Gateway
+cat << 'GATEWAY_EOF' | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: apps
+  namespace: cilium-gateway
+spec:
+  gatewayClassName: cilium
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 80
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: rancher
+    protocol: HTTPS
+    port: 443
+    hostname: "rancher.example.com"
+    tls:
+      mode: Terminate
+      certificateRefs:
+      - name: rancher-tls
+        namespace: certificates
+        kind: Secret
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: apps
+    protocol: HTTPS
+    port: 443
+    hostname: "*.apps.example.com"
+    tls:
+      mode: Terminate
+      certificateRefs:
+      - name: apps-tls
+        namespace: certificates
+        kind: Secret
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: wildcard
+    protocol: HTTPS
+    port: 8443
+    tls:
+      mode: Terminate
+      certificateRefs:
+      - name: wildcard-tls
+        namespace: cilium-gateway
+        kind: Secret
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: passthrough
+    protocol: TLS
+    port: 9443
+    tls:
+      mode: Passthrough
+    allowedRoutes:
+      namespaces:
+        from: All
+GATEWAY_EOF
+
+# LoadBalancer IP pool, one per cluster under the name it always had
+cat << 'GATEWAY_EOF' | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+apiVersion: cilium.io/v2alpha1
+kind: CiliumLoadBalancerIPPool
+metadata:
+  name: rancher-master-cluster-pool
+spec:
+  blocks:
+  - cidr: 192.168.92.0/28
+  - start: 192.168.92.20
+    stop: 192.168.92.25
+GATEWAY_EOF
+
+# L2 announcements of LoadBalancer and external IPs
+cat << 'GATEWAY_EOF' | sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f -
+apiVersion: cilium.io/v2alpha1
+kind: CiliumL2AnnouncementPolicy
+metadata:
+  name: default-l2-announcement-policy
+spec:
+  externalIPs: true
+  loadBalancerIPs: true
+  interfaces:
+  - '^eth[0-9]+$'
+  nodeSelector:
+    matchLabels:
+      node-role.kubernetes.io/worker: "true"
+  serviceSelector:
+    matchLabels:
+      announce: "l2"
+GATEWAY_EOF
+
+echo "Cilium gateway setup complete on rke2"
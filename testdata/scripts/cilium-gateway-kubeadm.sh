@@ -0,0 +1,90 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+set -x
+export KUBECONFIG=$HOME/.kube/config
+echo "Deploying the Cilium gateway rancher-master-gateway on kubeadm"
+
+# Namespaces of the gateway and its certificates
+kubectl create namespace cilium-gateway --dry-run=client -o yaml | kubectl apply -f -
+kubectl create namespace certificates --dry-run=client -o yaml | kubectl apply -f -
+
+# TLS secret rajesh-tls-cert from files, written untraced
+{ set +x; } 2>/dev/null
+TLS_DIR=$(mktemp -d)
+printf '%s\n' "$TLS_CERT_0" > "$TLS_DIR/tls.crt"
+printf '%s\n' "$TLS_KEY_0" > "$TLS_DIR/tls.key"
+set -x
+kubectl -n certificates create secret tls rajesh-tls-cert \
+    --cert="$TLS_DIR/tls.crt" \
+    --key="$TLS_DIR/tls.key" \
+    --dry-run=client -o yaml | kubectl apply -f -
+rm -r "$TLS_DIR"
+
+# Let the gateway read the certificates in certificates
+cat << 'GATEWAY_EOF' | kubectl apply -f -
+apiVersion: gateway.networking.k8s.io/v1beta1
+kind: ReferenceGrant
+metadata:
+  name: allow-gateway-to-use-cert
+  namespace: certificates
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: Gateway
+    namespace: cilium-gateway
+  to:
+  - group: ""
+    kind: Secret
+GATEWAY_EOF
+
+# Gateway
+cat << 'GATEWAY_EOF' | kubectl apply -f -
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: rancher-master-gateway
+  namespace: cilium-gateway
+spec:
+  gatewayClassName: cilium
+  listeners:
+  - name: rancher-master-gateway
+    protocol: HTTPS
+    port: 443
+    tls:
+      mode: Terminate
+      certificateRefs:
+      - name: rajesh-tls-cert
+        namespace: certificates
+        kind: Secret
+    allowedRoutes:
+      namespaces:
+        from: All
+GATEWAY_EOF
+
+# LoadBalancer IP pool, one per cluster under the name it always had
+cat << 'GATEWAY_EOF' | kubectl apply -f -
+apiVersion: cilium.io/v2alpha1
+kind: CiliumLoadBalancerIPPool
+metadata:
+  name: rancher-master-cluster-pool
+spec:
+  blocks:
+  - start: 192.168.91.30
+    stop: 192.168.91.35
+GATEWAY_EOF
+
+# L2 announcements of LoadBalancer and external IPs
+cat << 'GATEWAY_EOF' | kubectl apply -f -
+apiVersion: cilium.io/v2alpha1
+kind: CiliumL2AnnouncementPolicy
+metadata:
+  name: default-l2-announcement-policy
+spec:
+  externalIPs: true
+  loadBalancerIPs: true
+GATEWAY_EOF
+
+echo "Cilium gateway setup complete on kubeadm"
@@ -0,0 +1,41 @@
+#!/bin/bash
+set -e
+set -x
+echo "Writing the Cilium values of k3s on 192.168.91.11"
+
+install -D -m 600 /dev/stdin $HOME/.cilium/values.yaml << 'CILIUM_VALUES_EOF'
+debug:
+  enabled: true
+externalIPs:
+  enabled: true
+gatewayAPI:
+  enableAlpn: true
+  enableAppProtocol: true
+  enabled: true
+hubble:
+  relay:
+    enabled: true
+  ui:
+    enabled: true
+k8sServiceHost: 192.168.91.11
+k8sServicePort: 6443
+kubeProxyReplacement: true
+l2announcements:
+  enabled: true
+securityContext:
+  capabilities:
+    keepCapNetBindService: true
+CILIUM_VALUES_EOF
+
+# A new cluster installs Cilium from this file on its first server. One that already runs
+# Cilium gets the new values right away.
+export KUBECONFIG=$HOME/.kube/config
+if [ -f "$KUBECONFIG" ] && /usr/local/bin/helm status cilium --namespace kube-system >/dev/null 2>&1; then
+    /usr/local/bin/helm repo add cilium https://helm.cilium.io/ --force-update
+    /usr/local/bin/helm repo update cilium
+    /usr/local/bin/helm upgrade --install cilium cilium/cilium --version 1.18.5 \
+        --namespace kube-system \
+        --values $HOME/.cilium/values.yaml
+else
+    echo "Cilium is not installed yet, the first server of k3s installs it with these values"
+fi
@@ -0,0 +1,143 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+set -x
+echo "Installing HAProxy for ingress-lb on 192.168.91.5"
+
+# Update system (non-interactive)
+sudo DEBIAN_FRONTEND=noninteractive apt-get update -y
+sudo DEBIAN_FRONTEND=noninteractive apt-get install -y haproxy
+sudo systemctl enable haproxy
+
+# Every failure from here on puts the previous config back
+rollback() {
+    echo "$1, rolling back to the previous HAProxy config"
+    sudo cp /etc/haproxy/haproxy.cfg.bak /etc/haproxy/haproxy.cfg
+    sudo systemctl reload haproxy || sudo systemctl restart haproxy
+    exit 1
+}
+
+sudo cp /etc/haproxy/haproxy.cfg /etc/haproxy/haproxy.cfg.bak
+sudo tee /etc/haproxy/haproxy.cfg > /dev/null << 'HAPROXY_EOF'
+global
+    log /dev/log local0
+    log /dev/log local1 notice
+    chroot /var/lib/haproxy
+    stats socket /run/haproxy/admin.sock mode 660 level admin
+    stats timeout 30s
+    user haproxy
+    group haproxy
+    daemon
+
+defaults
+    log     global
+    mode    tcp
+    option  tcplog
+    option  dontlognull
+    timeout connect 3s
+    timeout client  1m
+    timeout server  1m
+    timeout check   2s
+
+userlist stats-users
+    user ops password @STATS_PASSWORD_HASH@
+
+listen stats
+    bind *:9000
+    mode http
+    option httplog
+    http-request auth realm HAProxy unless { http_auth(stats-users) }
+    stats enable
+    stats uri /stats
+    stats refresh 30s
+
+frontend prometheus
+    bind *:8405
+    mode http
+    http-request use-service prometheus-exporter if { path /metrics }
+    no log
+
+frontend ingress-lb-http-frontend
+    bind *:80
+    mode http
+    option httplog
+    default_backend ingress-lb-http-backend
+
+backend ingress-lb-http-backend
+    mode http
+    balance leastconn
+    option httpchk
+    http-check send meth GET uri /healthz
+    http-check expect status 200
+    server ingress-lb-http-1 192.168.91.11:30080 check fall 3 rise 2
+    server ingress-lb-http-2 192.168.91.12:30080 check fall 3 rise 2
+
+frontend ingress-lb-https-frontend
+    bind *:443
+    mode tcp
+    option tcplog
+    default_backend ingress-lb-https-backend
+
+backend ingress-lb-https-backend
+    mode tcp
+    balance source
+    option httpchk
+    http-check send meth GET uri /healthz
+    http-check expect rstatus ^(200|204)$
+    server ingress-lb-https-1 192.168.91.11:30443 check check-ssl verify none fall 3 rise 2
+    server ingress-lb-https-2 192.168.91.12:30443 check check-ssl verify none fall 3 rise 2
+
+frontend ingress-lb-raw-frontend
+    bind *:8080
+    mode tcp
+    option tcplog
+    default_backend ingress-lb-raw-backend
+
+backend ingress-lb-raw-backend
+    mode tcp
+    balance leastconn
+    server ingress-lb-raw-1 192.168.91.11:30808
+    server ingress-lb-raw-2 192.168.91.12:30808
+
+HAPROXY_EOF
+
+# Only a hash of the stats password goes into the config (statsPasswordHash), untraced
+{ set +x; } 2>/dev/null
+STATS_HASH=$(printf '%s' "$HAPROXY_STATS_PASSWORD" | openssl passwd -6 -stdin)
+sudo sed -i "s|@STATS_PASSWORD_HASH@|$STATS_HASH|" /etc/haproxy/haproxy.cfg
+set -x
+sudo chmod 640 /etc/haproxy/haproxy.cfg
+
+if ! sudo haproxy -f /etc/haproxy/haproxy.cfg -c; then
+    rollback "HAProxy configuration validation failed"
+fi
+
+# A reload hands the listeners over without dropping connections
+if systemctl is-active --quiet haproxy; then
+    sudo systemctl reload haproxy
+else
+    sudo systemctl start haproxy
+fi
+
+# Health probe: HAProxy keeps running and every frontend accepts connections
+healthy() {
+    systemctl is-active --quiet haproxy || return 1
+    for port in 80 443 8080; do
+        timeout 2 bash -c "exec 3<>/dev/tcp/127.0.0.1/$port" 2>/dev/null || return 1
+    done
+}
+for attempt in $(seq 1 10); do
+    if healthy; then
+        break
+    fi
+    if [ "$attempt" = 10 ]; then
+        rollback "HAProxy does not serve every frontend with the new config"
+    fi
+    sleep 2
+done
+
+sudo systemctl status haproxy --no-pager
+
+echo "HAProxy config applied for ingress-lb"
@@ -0,0 +1,95 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+set -x
+echo "Updating the HAProxy config for k3s on 192.168.91.5"
+
+# Every failure from here on puts the previous config back
+rollback() {
+    echo "$1, rolling back to the previous HAProxy config"
+    sudo cp /etc/haproxy/haproxy.cfg.bak /etc/haproxy/haproxy.cfg
+    sudo systemctl reload haproxy || sudo systemctl restart haproxy
+    exit 1
+}
+
+sudo cp /etc/haproxy/haproxy.cfg /etc/haproxy/haproxy.cfg.bak
+sudo tee /etc/haproxy/haproxy.cfg > /dev/null << 'HAPROXY_EOF'
+global
+    log /dev/log local0
+    log /dev/log local1 notice
+    chroot /var/lib/haproxy
+    stats socket /run/haproxy/admin.sock mode 660 level admin
+    stats timeout 30s
+    user haproxy
+    group haproxy
+    daemon
+
+defaults
+    log     global
+    mode    tcp
+    option  tcplog
+    option  dontlognull
+    timeout connect 5s
+    timeout client  50s
+    timeout server  50s
+    timeout check   5s
+
+listen stats
+    bind 127.0.0.1:8404
+    mode http
+    option httplog
+    stats enable
+    stats uri /stats
+    stats refresh 30s
+
+frontend k3s-api-frontend
+    bind *:6443
+    mode tcp
+    option tcplog
+    default_backend k3s-api-backend
+
+backend k3s-api-backend
+    mode tcp
+    balance roundrobin
+    option httpchk
+    http-check send meth GET uri /readyz
+    http-check expect rstatus ^(200|401)$
+    server k3s-api-1 192.168.91.11:6443 check check-ssl verify none fall 3 rise 2
+    server k3s-api-2 192.168.91.12:6443 check check-ssl verify none fall 3 rise 2
+    server k3s-api-3 192.168.91.13:6443 check check-ssl verify none fall 3 rise 2
+
+HAPROXY_EOF
+
+if ! sudo haproxy -f /etc/haproxy/haproxy.cfg -c; then
+    rollback "HAProxy configuration validation failed"
+fi
+
+# A reload hands the listeners over without dropping connections
+if systemctl is-active --quiet haproxy; then
+    sudo systemctl reload haproxy
+else
+    sudo systemctl start haproxy
+fi
+
+# Health probe: HAProxy keeps running and every frontend accepts connections
+healthy() {
+    systemctl is-active --quiet haproxy || return 1
+    for port in 6443; do
+        timeout 2 bash -c "exec 3<>/dev/tcp/127.0.0.1/$port" 2>/dev/null || return 1
+    done
+}
+for attempt in $(seq 1 10); do
+    if healthy; then
+        break
+    fi
+    if [ "$attempt" = 10 ]; then
+        rollback "HAProxy does not serve every frontend with the new config"
+    fi
+    sleep 2
+done
+
+sudo systemctl status haproxy --no-pager
+
+echo "HAProxy config applied for k3s"
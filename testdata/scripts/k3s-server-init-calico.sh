@@ -0,0 +1,87 @@
+#!/bin/bash
+		set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+		set -x
+		sudo bash -c "cat > /etc/resolv.conf << 'EOF'
+nameserver 1.1.1.1
+nameserver 8.8.8.8
+EOF"
+		{ set +x; } 2>/dev/null
+		sudo transactional-update register --url=https://scc.suse.com -e user@example.com -r "$SUSE_REGISTRATION_CODE"
+		set -x
+		
+		# Install K3s with the server flags of the cluster CNI
+		curl -L https://get.k3s.io | sudo INSTALL_K3S_VERSION=v1.34.3+k3s1 sh -s - server \
+			--cluster-init \
+			--tls-san=192.168.91.5 \
+			--tls-san=$(hostname -I | awk '{print $1}') \
+			--flannel-backend=none \
+			--disable-network-policy \
+			--disable=traefik \
+			--disable=servicelb
+		
+		sudo systemctl enable --now k3s
+		
+		# Wait for kubeconfig file and API endpoint
+		echo "Waiting for K3s kubeconfig..."
+		until sudo test -f /etc/rancher/k3s/k3s.yaml; do
+			sleep 2
+		done
+		
+		# Wait for API server to respond (ignore node status)
+		echo "Waiting for K3s API server..."
+		until sudo /usr/local/bin/k3s kubectl get --raw /healthz >/dev/null 2>&1; do
+			sleep 5
+		done
+
+		# Set up kubeconfig for non-root user
+		mkdir -p $HOME/.kube
+		sudo cp /etc/rancher/k3s/k3s.yaml $HOME/.kube/config
+		sudo chown $(id -u):$(id -g) $HOME/.kube/config
+		chmod 600 $HOME/.kube/config
+		export KUBECONFIG=$HOME/.kube/config
+		
+		# Install Helm
+		curl https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | sudo bash -s -- --version v3.19.0 || true
+		
+# Install Calico v3.31.2 through the Tigera operator
+kubectl apply --server-side -f https://raw.githubusercontent.com/projectcalico/calico/v3.31.2/manifests/tigera-operator.yaml
+kubectl wait --for condition=established --timeout=120s crd/installations.operator.tigera.io crd/apiservers.operator.tigera.io
+cat <<CALICO_EOF | kubectl apply -f -
+apiVersion: operator.tigera.io/v1
+kind: Installation
+metadata:
+  name: default
+spec:
+  calicoNetwork:
+    containerIPForwarding: Enabled
+    ipPools:
+    - name: default-ipv4-ippool
+      blockSize: 26
+      cidr: 10.42.0.0/16
+      encapsulation: VXLANCrossSubnet
+      natOutgoing: Enabled
+      nodeSelector: all()
+---
+apiVersion: operator.tigera.io/v1
+kind: APIServer
+metadata:
+  name: default
+spec: {}
+CALICO_EOF
+		
+		# Now wait for nodes to be ready
+		echo "Waiting for nodes to be ready..."
+		sudo /usr/local/bin/k3s kubectl wait --for=condition=Ready nodes --all --timeout=300s
+
+		# Setting up Longhorn pre-requisites
+		#curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
+		#chmod +x longhornctl
+		#sudo mv longhornctl /usr/local/bin/longhornctl
+		#sudo transactional-update pkg install -y nfs-client cryptsetup device-mapper
+		
+		
+		sudo ls /var/lib/rancher/k3s/server/node-token
+	
\ No newline at end of file
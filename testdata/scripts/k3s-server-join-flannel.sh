@@ -0,0 +1,45 @@
+#!/bin/bash
+			set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+			printf '%s' "$K3S_TOKEN" | sudo install -D -m 600 /dev/stdin /etc/rancher/k3s/cluster-token
+			set -x
+			sudo bash -c "cat > /etc/resolv.conf << 'EOF'
+nameserver 1.1.1.1
+nameserver 8.8.8.8
+EOF"
+			{ set +x; } 2>/dev/null
+			sudo transactional-update register --url=https://scc.suse.com -e user@example.com -r "$SUSE_REGISTRATION_CODE"
+			set -x
+			# Wait for first server to be ready
+			until curl -k -s https://192.168.91.5:6443/ping; do
+				echo "Waiting for first K3s server to be ready..."
+				sleep 10
+			done
+			
+			# Install K3s with the CNI flags of the first server
+			curl -sfL https://get.k3s.io | sudo INSTALL_K3S_VERSION=v1.34.3+k3s1 sh -s - server \
+			--server https://192.168.91.5:6443 \
+			--token-file /etc/rancher/k3s/cluster-token \
+			--tls-san=192.168.91.5 --tls-san=$(hostname -I | awk '{print $1}') \
+			--flannel-backend=vxlan \
+			--disable=traefik \
+			--disable=servicelb
+
+			sudo systemctl enable --now k3s
+
+			# Set up kubeconfig for non-root user
+			mkdir -p $HOME/.kube
+			sudo cp /etc/rancher/k3s/k3s.yaml $HOME/.kube/config
+			sudo chown $(id -u):$(id -g) $HOME/.kube/config
+			chmod 600 $HOME/.kube/config
+
+			# Setting up Longhorn pre-requisites
+			curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
+			chmod +x longhornctl
+			sudo mv longhornctl /usr/local/bin/longhornctl
+			sudo transactional-update pkg install -y nfs-client cryptsetup device-mapper
+
+			echo "K3s server joined cluster successfully"
+		
\ No newline at end of file
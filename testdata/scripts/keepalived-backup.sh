@@ -0,0 +1,56 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+set -x
+echo "Installing keepalived for k3s on 192.168.91.6 (BACKUP, VIP 192.168.91.4)"
+
+sudo DEBIAN_FRONTEND=noninteractive apt-get install -y keepalived
+
+IFACE=eth0
+if [ -z "$IFACE" ]; then
+    echo "No interface with address 192.168.91.6 found"
+    exit 1
+fi
+
+# The config holds the VRRP password, so it is root-only
+sudo install -D -m 600 /dev/stdin /etc/keepalived/keepalived.conf << KEEPALIVED_EOF
+global_defs {
+    enable_script_security
+    script_user root
+}
+
+# A node whose HAProxy stopped drops below its peers and hands over the VIP
+vrrp_script chk_haproxy {
+    script "/usr/bin/systemctl is-active --quiet haproxy"
+    interval 2
+    fall 2
+    rise 2
+    weight -60
+}
+
+vrrp_instance k3s-vip {
+    state BACKUP
+    interface $IFACE
+    virtual_router_id 51
+    priority 140
+    advert_int 1
+    unicast_src_ip 192.168.91.6
+    unicast_peer {
+        192.168.91.5
+    }
+    virtual_ipaddress {
+        192.168.91.4/32 dev $IFACE
+    }
+    track_script {
+        chk_haproxy
+    }
+}
+KEEPALIVED_EOF
+
+sudo systemctl enable keepalived
+sudo systemctl restart keepalived
+sudo systemctl status keepalived --no-pager
+
+echo "keepalived installation completed for k3s"
@@ -0,0 +1,41 @@
+#!/bin/bash
+set -e
+set -x
+# Runs on the master: hands the VIP to a backup by stopping keepalived, checks that HAProxy
+# still answers on the VIP, then takes the VIP back
+VIP=192.168.91.4
+
+holds_vip() {
+    [ -n "$(ip -o -4 addr show to "$VIP/32")" ]
+}
+wait_for() {
+    for _ in $(seq 1 30); do
+        if "$@"; then
+            return 0
+        fi
+        sleep 2
+    done
+    return 1
+}
+backup_serves() {
+    ! holds_vip && timeout 2 bash -c "</dev/tcp/$VIP/6443"
+}
+
+if ! wait_for holds_vip; then
+    echo "192.168.91.5 should hold $VIP as master but does not"
+    exit 1
+fi
+
+sudo systemctl stop keepalived
+if ! wait_for backup_serves; then
+    sudo systemctl start keepalived
+    echo "No backup took over $VIP:6443 after the master stopped"
+    exit 1
+fi
+sudo systemctl start keepalived
+
+if ! wait_for holds_vip; then
+    echo "192.168.91.5 did not take $VIP back"
+    exit 1
+fi
+echo "Failover check passed for k3s: $VIP moved to a backup and back"
@@ -0,0 +1,87 @@
+#!/bin/bash
+set -e
+set -x
+echo "Installing kube-vip v0.8.9 for k3s on 192.168.91.11 (VIP 192.168.91.4)"
+
+# The interface that holds this host's address carries the VIP
+IFACE=$(ip -o -4 addr show to 192.168.91.11/32 | awk '{print $2; exit}')
+if [ -z "$IFACE" ]; then
+    echo "No interface with address 192.168.91.11 found"
+    exit 1
+fi
+
+# An earlier control-plane node holds the VIP; this node joins the cluster through it
+for attempt in $(seq 1 60); do
+    if timeout 2 bash -c 'exec 3<>/dev/tcp/192.168.91.4/6443' 2>/dev/null; then
+        break
+    fi
+    if [ "$attempt" = 60 ]; then
+        echo "Nothing answers on 192.168.91.4:6443"
+        exit 1
+    fi
+    sleep 5
+done
+
+# The kubelet starts kube-vip as a static pod, which elects one control-plane node to hold
+# the VIP and answer ARP for it. The kubeconfig is mounted with type File so the pod waits
+# for the cluster to write it instead of the kubelet creating a directory in its place.
+sudo mkdir -p /var/lib/rancher/k3s/agent/pod-manifests
+sudo tee /var/lib/rancher/k3s/agent/pod-manifests/kube-vip.yaml > /dev/null << KUBE_VIP_EOF
+apiVersion: v1
+kind: Pod
+metadata:
+  name: kube-vip
+  namespace: kube-system
+spec:
+  containers:
+  - name: kube-vip
+    image: ghcr.io/kube-vip/kube-vip:v0.8.9
+    imagePullPolicy: IfNotPresent
+    args:
+    - manager
+    env:
+    - name: vip_arp
+      value: "true"
+    - name: port
+      value: "6443"
+    - name: vip_interface
+      value: $IFACE
+    - name: vip_cidr
+      value: "32"
+    - name: cp_enable
+      value: "true"
+    - name: cp_namespace
+      value: kube-system
+    - name: vip_leaderelection
+      value: "true"
+    - name: vip_leasename
+      value: plndr-cp-lock
+    - name: vip_leaseduration
+      value: "5"
+    - name: vip_renewdeadline
+      value: "3"
+    - name: vip_retryperiod
+      value: "1"
+    - name: address
+      value: 192.168.91.4
+    securityContext:
+      capabilities:
+        add:
+        - NET_ADMIN
+        - NET_RAW
+    volumeMounts:
+    - mountPath: /etc/kubernetes/admin.conf
+      name: kubeconfig
+  hostAliases:
+  - hostnames:
+    - kubernetes
+    ip: 127.0.0.1
+  hostNetwork: true
+  volumes:
+  - name: kubeconfig
+    hostPath:
+      path: /etc/rancher/k3s/k3s.yaml
+      type: File
+KUBE_VIP_EOF
+
+echo "kube-vip installation completed for k3s"
@@ -0,0 +1,75 @@
+#!/bin/bash
+set -e
+set -x
+echo "Installing kube-vip v0.8.9 for kubeadm on 192.168.91.11 (VIP 192.168.91.4)"
+
+# The interface that holds this host's address carries the VIP
+IFACE=$(ip -o -4 addr show to 192.168.91.11/32 | awk '{print $2; exit}')
+if [ -z "$IFACE" ]; then
+    echo "No interface with address 192.168.91.11 found"
+    exit 1
+fi
+
+# The kubelet starts kube-vip as a static pod, which elects one control-plane node to hold
+# the VIP and answer ARP for it. The kubeconfig is mounted with type File so the pod waits
+# for the cluster to write it instead of the kubelet creating a directory in its place.
+sudo mkdir -p /etc/kubernetes/manifests
+sudo tee /etc/kubernetes/manifests/kube-vip.yaml > /dev/null << KUBE_VIP_EOF
+apiVersion: v1
+kind: Pod
+metadata:
+  name: kube-vip
+  namespace: kube-system
+spec:
+  containers:
+  - name: kube-vip
+    image: ghcr.io/kube-vip/kube-vip:v0.8.9
+    imagePullPolicy: IfNotPresent
+    args:
+    - manager
+    env:
+    - name: vip_arp
+      value: "true"
+    - name: port
+      value: "6443"
+    - name: vip_interface
+      value: $IFACE
+    - name: vip_cidr
+      value: "32"
+    - name: cp_enable
+      value: "true"
+    - name: cp_namespace
+      value: kube-system
+    - name: vip_leaderelection
+      value: "true"
+    - name: vip_leasename
+      value: plndr-cp-lock
+    - name: vip_leaseduration
+      value: "5"
+    - name: vip_renewdeadline
+      value: "3"
+    - name: vip_retryperiod
+      value: "1"
+    - name: address
+      value: 192.168.91.4
+    securityContext:
+      capabilities:
+        add:
+        - NET_ADMIN
+        - NET_RAW
+    volumeMounts:
+    - mountPath: /etc/kubernetes/admin.conf
+      name: kubeconfig
+  hostAliases:
+  - hostnames:
+    - kubernetes
+    ip: 127.0.0.1
+  hostNetwork: true
+  volumes:
+  - name: kubeconfig
+    hostPath:
+      path: /etc/kubernetes/admin.conf
+      type: File
+KUBE_VIP_EOF
+
+echo "kube-vip installation completed for kubeadm"
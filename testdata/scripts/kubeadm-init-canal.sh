@@ -0,0 +1,93 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+
+set -x
+
+# Wait for apt locks
+wait_for_apt() {
+    while sudo fuser /var/lib/apt/lists/lock >/dev/null 2>&1 || \
+          sudo fuser /var/lib/dpkg/lock-frontend >/dev/null 2>&1 || \
+          sudo fuser /var/lib/dpkg/lock >/dev/null 2>&1; do
+        echo "Waiting for apt locks..."
+        sleep 5
+    done
+}
+
+
+# ============================================
+# Create kubeadm config file
+# ============================================
+sudo tee /tmp/kubeadm-config.yaml <<KUBEADM_EOF
+---
+apiVersion: kubeadm.k8s.io/v1beta4
+kind: InitConfiguration
+localAPIEndpoint:
+  advertiseAddress: 192.168.91.11
+  bindPort: 6443
+nodeRegistration:
+  criSocket: unix:///var/run/containerd/containerd.sock
+  taints: []
+---
+apiVersion: kubeadm.k8s.io/v1beta4
+kind: ClusterConfiguration
+kubernetesVersion: v1.34.3
+controlPlaneEndpoint: "192.168.91.5:6443"
+networking:
+  podSubnet: 10.244.0.0/16
+  serviceSubnet: 10.96.0.0/12
+---
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+serverTLSBootstrap: true
+KUBEADM_EOF
+
+# ============================================
+# Initialize cluster
+# ============================================
+sudo kubeadm init \
+  --config=/tmp/kubeadm-config.yaml \
+  --upload-certs
+
+# Verify CA issuer
+echo "Verifying CA issuer for apiserver certificate:"
+openssl x509 -in /etc/kubernetes/pki/apiserver.crt -noout -issuer
+
+# Set up kubeconfig
+mkdir -p $HOME/.kube
+sudo cp -i /etc/kubernetes/admin.conf $HOME/.kube/config
+sudo chown $(id -u):$(id -g) $HOME/.kube/config
+
+# Remove control plane taint to allow pod scheduling
+kubectl taint nodes --all node-role.kubernetes.io/control-plane:NoSchedule- || true
+
+# Install Canal from the Calico v3.31.2 manifest, with flannel on the pod network
+curl -fsSL https://raw.githubusercontent.com/projectcalico/calico/v3.31.2/manifests/canal.yaml \
+    | sed 's#"Network": "10.244.0.0/16"#"Network": "10.244.0.0/16"#' \
+    | kubectl apply -f -
+
+# Approve pending kubelet serving certificates
+echo "Approving kubelet serving certificates..."
+sleep 10  # Give kubelets time to generate CSRs
+kubectl get csr | grep Pending | awk '{print $1}' | xargs kubectl certificate approve || true
+
+# Upload certificates and get the certificate key, untraced as both carry join credentials
+{ set +x; } 2>/dev/null
+CERT_KEY=$(sudo kubeadm init phase upload-certs --upload-certs 2>/dev/null | tail -1)
+
+# Generate join command with certificate key
+JOIN_CMD=$(sudo kubeadm token create --print-join-command)
+echo "$JOIN_CMD --certificate-key $CERT_KEY --control-plane" | sudo install -m 600 /dev/stdin /etc/kubernetes/kubeadm-join-command
+set -x
+
+echo "Control plane initialized successfully"
+
+echo "Setup kube-bench"
+curl -L https://github.com/aquasecurity/kube-bench/releases/download/v0.14.1/kube-bench_0.14.1_linux_amd64.tar.gz -o kube-bench.tar.gz
+tar -xvf kube-bench.tar.gz
+sudo mv kube-bench /usr/local/bin/
+sudo mkdir -p /etc/kube-bench
+sudo cp -r cfg/ /etc/kube-bench/
+sudo kube-bench version
@@ -0,0 +1,85 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+
+# ============================================
+# Copy custom CA files before kubeadm join
+# ============================================
+printf '%s\n' "$KUBEADM_CA_CERT" | sudo install -D -m 644 /dev/stdin /etc/kubernetes/pki/ca.crt
+printf '%s\n' "$KUBEADM_CA_KEY" | sudo install -D -m 600 /dev/stdin /etc/kubernetes/pki/ca.key
+echo "Custom CA files copied to /etc/kubernetes/pki/"
+
+set -x
+
+echo "Setup kube-bench"
+curl -L https://github.com/aquasecurity/kube-bench/releases/download/v0.14.1/kube-bench_0.14.1_linux_amd64.tar.gz -o kube-bench.tar.gz
+tar -xvf kube-bench.tar.gz
+sudo mv kube-bench /usr/local/bin/
+sudo mkdir -p /etc/kube-bench
+sudo cp -r cfg/ /etc/kube-bench/
+sudo kube-bench version
+
+# ============================================
+# Parse join command and create config file
+# ============================================
+
+# Untraced, the token and certificate key must not reach the logs
+{ set +x; } 2>/dev/null
+JOIN_CMD="$KUBEADM_JOIN_COMMAND"
+
+# Extract components from join command
+API_ENDPOINT=$(echo "$JOIN_CMD" | grep -oP 'join \K[^ ]+')
+TOKEN=$(echo "$JOIN_CMD" | grep -oP -- '--token \K[^ ]+')
+CA_HASH=$(echo "$JOIN_CMD" | grep -oP -- '--discovery-token-ca-cert-hash \K[^ ]+')
+CERT_KEY=$(echo "$JOIN_CMD" | grep -oP -- '--certificate-key \K[^ ]+')
+
+echo "Parsed join parameters:"
+echo "  API Endpoint: $API_ENDPOINT"
+echo "  CA Hash: $CA_HASH"
+
+# Create kubeadm join config file with KubeletConfiguration, readable by root only
+JOIN_CONFIG=$(sudo mktemp)
+sudo tee "$JOIN_CONFIG" >/dev/null <<KUBEADM_JOIN_EOF
+---
+apiVersion: kubeadm.k8s.io/v1beta4
+kind: JoinConfiguration
+discovery:
+  bootstrapToken:
+    token: ${TOKEN}
+    apiServerEndpoint: "${API_ENDPOINT}"
+    caCertHashes:
+      - "${CA_HASH}"
+controlPlane:
+  certificateKey: ${CERT_KEY}
+nodeRegistration:
+  criSocket: unix:///var/run/containerd/containerd.sock
+  taints: []
+---
+apiVersion: kubelet.config.k8s.io/v1beta1
+kind: KubeletConfiguration
+serverTLSBootstrap: true
+KUBEADM_JOIN_EOF
+set -x
+
+# Join using config file instead of command line
+echo "Joining cluster with config file..."
+sudo kubeadm join --config="$JOIN_CONFIG"
+sudo rm -f "$JOIN_CONFIG"
+
+# Verify CA issuer
+echo "Verifying CA issuer for apiserver certificate:"
+openssl x509 -in /etc/kubernetes/pki/apiserver.crt -noout -issuer
+
+echo "Control plane node joined successfully"
+
+# Set up kubeconfig
+mkdir -p $HOME/.kube
+sudo cp -i /etc/kubernetes/admin.conf $HOME/.kube/config
+sudo chown $(id -u):$(id -g) $HOME/.kube/config
+
+# Wait for kubelet CSR and approve
+echo "Waiting for kubelet serving CSR..."
+sleep 10
+kubectl get csr | grep Pending | awk '{print $1}' | xargs kubectl certificate approve || true
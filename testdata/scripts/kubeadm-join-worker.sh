@@ -0,0 +1,67 @@
+#!/bin/bash
+set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+
+# Prerequisites
+swapoff -a
+sed -i '/ swap / s/^\(.*\)$/#\1/g' /etc/fstab
+
+cat <<EOF | tee /etc/modules-load.d/k8s.conf
+overlay
+br_netfilter
+EOF
+
+modprobe overlay
+modprobe br_netfilter
+
+cat <<EOF | tee /etc/sysctl.d/k8s.conf
+net.bridge.bridge-nf-call-iptables  = 1
+net.bridge.bridge-nf-call-ip6tables = 1
+net.ipv4.ip_forward                 = 1
+EOF
+
+sysctl --system
+
+# Install containerd
+apt-get update
+apt-get install -y containerd
+mkdir -p /etc/containerd
+containerd config default | tee /etc/containerd/config.toml
+sed -i 's/SystemdCgroup = false/SystemdCgroup = true/' /etc/containerd/config.toml
+systemctl restart containerd
+systemctl enable containerd
+
+# Install kubeadm, kubelet, kubectl
+apt-get install -y apt-transport-https ca-certificates curl gpg
+mkdir -p -m 755 /etc/apt/keyrings
+curl -fsSL https://pkgs.k8s.io/core:/stable:/v1.34/deb/Release.key | gpg --dearmor -o /etc/apt/keyrings/kubernetes-apt-keyring.gpg
+echo 'deb [signed-by=/etc/apt/keyrings/kubernetes-apt-keyring.gpg] https://pkgs.k8s.io/core:/stable:/v1.34/deb/ /' | tee /etc/apt/sources.list.d/kubernetes.list
+apt-get update
+apt-get install -y kubelet='1.34.3-*' kubeadm='1.34.3-*' kubectl='1.34.3-*'
+apt-mark hold kubelet kubeadm kubectl
+systemctl enable kubelet
+
+# Join as worker. The first control plane prints its own join command, so only the
+# discovery part is taken from it and the token stays out of the process list.
+API_ENDPOINT=$(echo "$KUBEADM_JOIN_COMMAND" | grep -oP 'join \K[^ ]+')
+TOKEN=$(echo "$KUBEADM_JOIN_COMMAND" | grep -oP -- '--token \K[^ ]+')
+CA_HASH=$(echo "$KUBEADM_JOIN_COMMAND" | grep -oP -- '--discovery-token-ca-cert-hash \K[^ ]+')
+
+JOIN_CONFIG=$(mktemp)
+cat > "$JOIN_CONFIG" <<KUBEADM_JOIN_EOF
+---
+apiVersion: kubeadm.k8s.io/v1beta4
+kind: JoinConfiguration
+discovery:
+  bootstrapToken:
+    token: ${TOKEN}
+    apiServerEndpoint: "${API_ENDPOINT}"
+    caCertHashes:
+      - "${CA_HASH}"
+nodeRegistration:
+  criSocket: unix:///var/run/containerd/containerd.sock
+KUBEADM_JOIN_EOF
+kubeadm join --config="$JOIN_CONFIG"
+rm -f "$JOIN_CONFIG"
@@ -0,0 +1,81 @@
+#!/bin/bash
+set -e
+set -x
+export KUBECONFIG=$HOME/.kube/config
+echo "Installing MetalLB v0.15.2 on rke2"
+
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f https://raw.githubusercontent.com/metallb/metallb/v0.15.2/config/manifests/metallb-native.yaml
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n metallb-system rollout status deployment/controller --timeout=300s
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n metallb-system rollout status daemonset/speaker --timeout=300s
+
+MANIFEST=$(mktemp)
+cat > "$MANIFEST" << 'METALLB_EOF'
+apiVersion: metallb.io/v1beta1
+kind: IPAddressPool
+metadata:
+  name: rke2-pool
+  namespace: metallb-system
+spec:
+  addresses:
+  - 192.168.92.0/28
+  - 192.168.92.20-192.168.92.25
+---
+apiVersion: metallb.io/v1beta2
+kind: BGPPeer
+metadata:
+  name: rke2-peer-0
+  namespace: metallb-system
+  labels:
+    proxmox-infra/service: rke2
+spec:
+  myASN: 64512
+  peerASN: 64513
+  peerAddress: 192.168.91.1
+---
+apiVersion: metallb.io/v1beta2
+kind: BGPPeer
+metadata:
+  name: rke2-peer-1
+  namespace: metallb-system
+  labels:
+    proxmox-infra/service: rke2
+spec:
+  myASN: 64512
+  peerASN: 64513
+  peerAddress: 192.168.91.2
+  peerPort: 1179
+---
+apiVersion: metallb.io/v1beta1
+kind: BGPAdvertisement
+metadata:
+  name: rke2-bgp
+  namespace: metallb-system
+spec:
+  ipAddressPools:
+  - rke2-pool
+METALLB_EOF
+
+# The MetalLB webhook only admits the pool once it serves, shortly after the rollout
+for attempt in $(seq 1 30); do
+    if sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml apply -f "$MANIFEST"; then
+        break
+    fi
+    if [ "$attempt" = 30 ]; then
+        echo "MetalLB did not accept the address pool of rke2"
+        exit 1
+    fi
+    sleep 10
+done
+rm "$MANIFEST"
+
+# Only one way of announcing stays: drop the objects of the other, and the peers that are no longer listed
+sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n metallb-system delete l2advertisement rke2-l2 --ignore-not-found
+PEERS=" rke2-peer-0 rke2-peer-1 "
+for peer in $(sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n metallb-system get bgppeers -l proxmox-infra/service=rke2 -o name); do
+    case "$PEERS" in
+        *" ${peer#*/} "*) ;;
+        *) sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml -n metallb-system delete "$peer" ;;
+    esac
+done
+
+echo "MetalLB serves LoadBalancer services on rke2"
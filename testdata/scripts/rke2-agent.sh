@@ -0,0 +1,36 @@
+
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+		printf '%s' "$RKE2_TOKEN" | sudo install -D -m 600 /dev/stdin /etc/rancher/rke2/cluster-token
+
+		# Set DNS resolver
+		sudo tee /etc/resolv.conf << 'EOF'
+nameserver 1.1.1.1
+nameserver 8.8.8.8
+EOF
+
+		# Wait for server to be ready
+		until curl -k -s https://192.168.91.5:9345/ping; do
+			echo "Waiting for RKE2 server to be ready..."
+			sleep 10
+		done
+
+		# Create RKE2 config directory
+		sudo mkdir -p /etc/rancher/rke2
+
+		# Create RKE2 agent configuration
+		sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
+server: https://192.168.91.5:9345
+token-file: /etc/rancher/rke2/cluster-token
+EOF
+
+		# Download and install RKE2
+		curl -sfL https://get.rke2.io | sudo INSTALL_RKE2_TYPE="agent" INSTALL_RKE2_VERSION=v1.34.3+rke2r1 sh -
+
+		# Enable and start RKE2 agent
+		sudo systemctl enable rke2-agent.service
+		sudo systemctl start rke2-agent.service
+
+		echo "RKE2 agent joined cluster successfully"
+	
\ No newline at end of file
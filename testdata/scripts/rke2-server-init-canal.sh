@@ -0,0 +1,76 @@
+#!/bin/bash
+			set -e
+			set -x
+			# Set DNS resolver
+			sudo tee /etc/systemd/resolved.conf << 'EOF'
+[Resolve]
+DNS=1.1.1.1 8.8.8.8
+FallbackDNS=1.1.1.1
+DNSStubListener=no
+EOF
+			sudo systemctl restart systemd-resolved
+
+			# Create RKE2 config directory
+			sudo mkdir -p /etc/rancher/rke2
+
+			# Cluster token, generated once on the first server; the other nodes get it from node-token.
+			# A cluster that already runs keeps its token, RKE2 refuses to start with another one
+			if sudo test -s /var/lib/rancher/rke2/server/token; then
+				sudo install -m 600 /var/lib/rancher/rke2/server/token /etc/rancher/rke2/cluster-token
+			elif ! sudo test -s /etc/rancher/rke2/cluster-token; then
+				openssl rand -hex 32 | sudo install -D -m 600 /dev/stdin /etc/rancher/rke2/cluster-token
+			fi
+
+			# Create RKE2 server configuration
+			sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
+token-file: /etc/rancher/rke2/cluster-token
+cluster-init: true
+tls-san:
+  - 192.168.91.5
+  - $(hostname -I | awk '{print $1}')
+cni: canal
+disable:
+  - rke2-ingress-nginx
+kube-apiserver-arg:
+  - '--audit-log-path=/var/lib/rancher/rke2/server/logs/audit.log'
+  - '--audit-log-maxage=30'
+  - '--audit-log-maxbackup=10'
+  - '--audit-log-maxsize=100'
+EOF
+
+
+
+
+			# Download and install RKE2
+			curl -sfL https://get.rke2.io | sudo INSTALL_RKE2_VERSION=v1.34.3+rke2r1 sh -
+
+			# Enable and start RKE2 server
+			sudo systemctl enable --now rke2-server.service &
+
+			# Wait for RKE2 to be ready
+			sleep 120
+
+			# Install Helm
+			curl https://raw.githubusercontent.com/helm/helm/main/scripts/get-helm-3 | sudo bash -s -- --version v3.19.0 || true
+			
+			# Set up kubeconfig for non-root user
+			mkdir -p $HOME/.kube
+			sudo cp /etc/rancher/rke2/rke2.yaml $HOME/.kube/config
+			sudo chown $(id -u):$(id -g) $HOME/.kube/config
+			chmod 600 $HOME/.kube/config
+			export KUBECONFIG=$HOME/.kube/config
+			
+			sudo cp /var/lib/rancher/rke2/bin/kubectl /usr/local/bin
+
+# rke2 ships Canal and starts it with the server
+			
+			# Setting up Longhorn pre-requisites
+			curl -sSfL -o longhornctl https://github.com/longhorn/cli/releases/download/v1.10.1/longhornctl-linux-amd64
+			chmod +x longhornctl
+			sudo mv longhornctl /usr/local/bin/longhornctl
+			kubectl --kubeconfig $HOME/.kube/config create namespace longhorn-system
+			longhornctl --kubeconfig $HOME/.kube/config --image longhornio/longhorn-cli:v1.10.1 install preflight
+
+			# Wait for all nodes to be ready
+			sudo /var/lib/rancher/rke2/bin/kubectl --kubeconfig /etc/rancher/rke2/rke2.yaml wait --for=condition=Ready nodes --all --timeout=300s
+		
\ No newline at end of file
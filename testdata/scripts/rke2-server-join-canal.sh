@@ -0,0 +1,57 @@
+#!/bin/bash
+			set -e
+# Secrets arrive on stdin as shell assignments (see scriptSecrets) and are read before
+# tracing starts, so they stay out of the command line, the process list and the logs
+. /dev/stdin
+			printf '%s' "$RKE2_TOKEN" | sudo install -D -m 600 /dev/stdin /etc/rancher/rke2/cluster-token
+			set -x
+			# Set DNS resolver
+			sudo tee /etc/systemd/resolved.conf << 'EOF'
+[Resolve]
+DNS=1.1.1.1 8.8.8.8
+FallbackDNS=1.1.1.1
+DNSStubListener=no
+EOF
+			sudo systemctl restart systemd-resolved
+
+			# Wait for first server to be ready
+			until curl -k -s https://192.168.91.5:9345/ping; do
+				echo "Waiting for first RKE2 server to be ready..."
+				sleep 10
+			done
+
+			# Create RKE2 config directory
+			sudo mkdir -p /etc/rancher/rke2
+
+			# Create RKE2 server configuration for joining
+			sudo tee /etc/rancher/rke2/config.yaml << 'EOF'
+server: https://192.168.91.5:9345
+token-file: /etc/rancher/rke2/cluster-token
+tls-san:
+  - 192.168.91.5
+  - $(hostname -I | awk '{print $1}')
+cni: canal
+disable:
+  - rke2-ingress-nginx
+kube-apiserver-arg:
+  - '--audit-log-path=/var/lib/rancher/rke2/server/logs/audit.log'
+  - '--audit-log-maxage=30'
+  - '--audit-log-maxbackup=10'
+  - '--audit-log-maxsize=100'
+EOF
+
+			# Download and install RKE2
+			curl -sfL https://get.rke2.io | sudo INSTALL_RKE2_VERSION=v1.34.3+rke2r1 sh -
+
+			# Enable and start RKE2 server
+			sudo systemctl enable --now rke2-server.service
+
+			# Set up kubeconfig for non-root user
+			mkdir -p $HOME/.kube
+			sudo cp /etc/rancher/rke2/rke2.yaml $HOME/.kube/config
+			sudo chown $(id -u):$(id -g) $HOME/.kube/config
+			chmod 600 $HOME/.kube/config
+			export KUBECONFIG=$HOME/.kube/config
+
+			echo "RKE2 server joined cluster successfully"
+		
\ No newline at end of file
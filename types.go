@@ -9,64 +9,218 @@ import (
 type ServiceContext struct {
 	ServiceName   string
 	VMs           []*vm.VirtualMachine
+	Ready         []pulumi.Resource // Readiness gate per VM, in the same order as VMs
 	IPs           []string
+	Hosts         []Host // SSH target per VM, in the same order as IPs
 	GlobalDeps    map[string]interface{}
 	Config        map[string]interface{}
 	VMPassword    string
 	ServiceConfig *ServiceConfig
+	After         []pulumi.Resource // What the services this instance depends on finished with
+}
+
+// Host is a VM that service commands run on, with the SSH user and resolvers of its group
+type Host struct {
+	IP         string
+	User       string
+	AuthMethod string
+	Password   string
+	DNS        []string
 }
 
 type IPXEConfig struct {
-	BootServerURL string   `yaml:"bootServerUrl"`
-	OSType        string   `yaml:"osType"`
-	Version       string   `yaml:"version"`
-	BaseURL       string   `yaml:"baseUrl,omitempty"`
-	ConfigUrl     string   `yaml:"configUrl,omitempty"`
-	KernelParams  []string `yaml:"kernelParams,omitempty"`
-	AutoInstall   bool     `yaml:"autoInstall,omitempty"`
-	ISOFiles      []string `yaml:"isoFiles,omitempty"`
+	BootServerURL string   `json:"bootServerUrl,omitempty"`
+	OSType        string   `json:"osType,omitempty"`
+	Version       string   `json:"version,omitempty"`
+	BaseURL       string   `json:"baseUrl,omitempty"`
+	ConfigUrl     string   `json:"configUrl,omitempty"`
+	KernelParams  []string `json:"kernelParams,omitempty"`
+	AutoInstall   bool     `json:"autoInstall,omitempty"`
+	ISOFiles      []string `json:"isoFiles,omitempty"`
 
-	KernelURL string `yaml:"kernelUrl,omitempty"`
-	InitrdURL string `yaml:"initrdUrl,omitempty"`
-	ISOURL    string `yaml:"isoUrl,omitempty"`
+	KernelURL string `json:"kernelUrl,omitempty"`
+	InitrdURL string `json:"initrdUrl,omitempty"`
+	ISOURL    string `json:"isoUrl,omitempty"`
 }
 
 type VM struct {
-	Name        string      `yaml:"name"`
-	Count       int64       `yaml:"count"`
-	TemplateID  int64       `yaml:"templateId"`
-	Memory      int64       `yaml:"memory"`
-	CPU         int64       `yaml:"cpu"`
-	DiskSize    int64       `yaml:"diskSize"`
-	IPs         []string    `yaml:"ips,omitempty"`
-	IPConfig    string      `yaml:"ipconfig,omitempty"`
-	Gateway     string      `yaml:"gateway,omitempty"`
-	Username    string      `yaml:"username,omitempty"`
-	AuthMethod  string      `yaml:"authMethod,omitempty"`
-	Password    string      `yaml:"password,omitempty"`
-	ProxmoxNode string      `yaml:"proxmoxNode,omitempty"`
-	BootMethod  string      `yaml:"bootMethod,omitempty"`
-	IPXEConfig  *IPXEConfig `yaml:"ipxeConfig,omitempty"`
-	//VMName      string      `yaml:"vmName"`
+	Name        string      `json:"name"`
+	Count       int64       `json:"count"`
+	TemplateID  int64       `json:"templateId,omitempty"`
+	Memory      int64       `json:"memory"`
+	CPU         int64       `json:"cpu"`
+	DiskSize    int64       `json:"diskSize"`
+	IPs         []string    `json:"ips,omitempty"`
+	IPConfig    string      `json:"ipConfig,omitempty" enum:"static,dhcp"`
+	Gateway     string      `json:"gateway,omitempty"`
+	Username    string      `json:"username,omitempty"`
+	AuthMethod  string      `json:"authMethod,omitempty" enum:"ssh-key,password"`
+	Password    string      `json:"password,omitempty"`
+	ProxmoxNode string      `json:"proxmoxNode,omitempty"`
+	BootMethod  string      `json:"bootMethod,omitempty" enum:"cloud-init,ipxe"`
+	IPXEConfig  *IPXEConfig `json:"ipxeConfig,omitempty"`
+	// Node holding the template to clone from. Declared templates override this with their own node.
+	TemplateNode string `json:"templateNode,omitempty"`
+	// Existing VMIDs adopted into the stack, one per index. 0 means clone as usual.
+	Import []int64 `json:"import,omitempty"`
+	// Firmware: seabios (default) or ovmf. OVMF adds an EFI disk and uses the q35 machine type.
+	Firmware     string `json:"firmware,omitempty" enum:"seabios,ovmf"`
+	SecureBoot   bool   `json:"secureBoot,omitempty"`   // Enroll distribution and Microsoft keys in the EFI disk (ovmf only)
+	TPM          bool   `json:"tpm,omitempty"`          // Add a TPM 2.0 state disk (ovmf only)
+	EFIDatastore string `json:"efiDatastore,omitempty"` // Datastore for the EFI and TPM disks
+
+	PrefixLength     int                 `json:"prefixLength,omitempty"`     // Prefix length of ips (default: 23)
+	Bridges          []string            `json:"bridges,omitempty"`          // One virtio NIC per bridge (default: [vmbr0])
+	NetworkConfig    string              `json:"networkConfig,omitempty"`    // cloud-init network-config v2 template, replaces the single static IP setup
+	ExtraIPs         map[string][]string `json:"extraIps,omitempty"`         // Additional per-index IP lists available to networkConfig as .Extra.<name>
+	SnippetDatastore string              `json:"snippetDatastore,omitempty"` // Datastore with snippets content for the rendered network config
+
+	Datastore string   `json:"datastore,omitempty"` // Datastore for the cloud-init drive (default: defaults.datastore)
+	DNS       []string `json:"dns,omitempty"`       // Resolvers set via cloud-init and in service scripts (default: defaults.dns)
+	Domain    string   `json:"domain,omitempty"`    // Search domain set via cloud-init (default: defaults.domain)
+
+	// Set by loadConfig when the template is declared under templates and validated there
+	declaredTemplate bool
+	// Set by loadConfig when firmware comes from the config rather than the seabios default
+	explicitFirmware bool
+	//VMName      string      `json:"vmName"`
+}
+
+// VMTemplate describes a cloud image that is imported and registered as a Proxmox template
+type VMTemplate struct {
+	Name          string   `json:"name"`
+	VMID          int64    `json:"vmId"`
+	ProxmoxNode   string   `json:"proxmoxNode,omitempty"`
+	NodeAddress   string   `json:"nodeAddress,omitempty"` // SSH address of the node (default: host of PROXMOX_VE_ENDPOINT)
+	ImageURL      string   `json:"imageUrl,omitempty"`
+	ImagePath     string   `json:"imagePath,omitempty"` // Image already present on the node, used instead of imageUrl
+	Checksum      string   `json:"checksum,omitempty"`  // sha256 of the image
+	Datastore     string   `json:"datastore,omitempty"`
+	StoragePath   string   `json:"storagePath,omitempty"` // Mount path of the datastore, checked for orphaned cloud-init disks
+	Memory        int64    `json:"memory,omitempty"`
+	CPU           int64    `json:"cpu,omitempty"`
+	Bridge        string   `json:"bridge,omitempty"`
+	Packages      []string `json:"packages,omitempty"` // Extra packages installed with virt-customize (qemu-guest-agent is always added)
+	Commands      []string `json:"commands,omitempty"` // Extra virt-customize --run-command entries
+	SkipCustomize bool     `json:"skipCustomize,omitempty"`
+	Firmware      string   `json:"firmware,omitempty" enum:"seabios,ovmf"` // seabios (default) or ovmf, must match the VMs cloned from it
 }
 
 type ServiceConfig struct {
-	Enabled          bool                   `yaml:"enabled"`
-	Targets          []string               `yaml:"targets,omitempty"`          // VM groups this service runs on
-	ControlPlane     []string               `yaml:"control-plane,omitempty"`    // For k8s control plane nodes
-	Workers          []string               `yaml:"workers,omitempty"`          // For k8s worker nodes
-	LoadBalancer     []string               `yaml:"loadbalancer,omitempty"`     // For load balancer nodes
-	BackendDiscovery string                 `yaml:"backendDiscovery,omitempty"` // Which VM group provides backends
-	Config           map[string]interface{} `yaml:"config,omitempty"`           // Service-specific config
+	Type                 string                 `json:"type,omitempty"` // Registered service type (default: the instance name)
+	Enabled              bool                   `json:"enabled"`
+	DependsOn            []string               `json:"dependsOn,omitempty"`                                  // Service instances that must be installed first
+	Targets              []string               `json:"targets,omitempty"`                                    // VM groups this service runs on
+	ControlPlane         []string               `json:"controlPlane,omitempty"`                               // For k8s control plane nodes
+	Workers              []string               `json:"workers,omitempty"`                                    // For k8s worker nodes
+	LoadBalancer         []string               `json:"loadBalancer,omitempty"`                               // For load balancer nodes
+	BackendDiscovery     string                 `json:"backendDiscovery,omitempty"`                           // Which VM group provides backends
+	Versions             *ClusterVersions       `json:"versions,omitempty"`                                   // Pinned versions of a k3s, rke2 or kubeadm cluster
+	LoadBalancerProvider string                 `json:"loadBalancerProvider,omitempty" enum:"cilium,metallb"` // What serves LoadBalancer services of a cluster (default: cilium with cni cilium)
+	Config               map[string]interface{} `json:"config,omitempty"`                                     // Service-specific config
+}
+
+// CiliumOptions is the cilium map in the config of a cluster running Cilium
+type CiliumOptions struct {
+	Values  interface{}       `json:"values,omitempty"`  // Helm values over defaultCiliumValues: a map, or the path of a YAML file
+	Pools   []CiliumPoolBlock `json:"pools,omitempty"`   // LoadBalancer IP blocks (default: cilium-pool-start/stop or the range of the type)
+	L2      *CiliumL2Policy   `json:"l2,omitempty"`      // Which nodes announce which services over ARP
+	Gateway *CiliumGateway    `json:"gateway,omitempty"` // Gateway API gateway of the cluster
+}
+
+// CiliumPoolBlock is one block of the LoadBalancer IP pool: a cidr, or a start and stop address
+type CiliumPoolBlock struct {
+	CIDR  string `json:"cidr,omitempty"`
+	Start string `json:"start,omitempty"`
+	Stop  string `json:"stop,omitempty"`
+}
+
+// CiliumL2Policy selects what the L2 announcement policy covers. Empty selectors match everything.
+type CiliumL2Policy struct {
+	Interfaces      []string          `json:"interfaces,omitempty"`      // Regular expressions of the interfaces that announce
+	NodeSelector    map[string]string `json:"nodeSelector,omitempty"`    // Labels of the nodes that announce
+	ServiceSelector map[string]string `json:"serviceSelector,omitempty"` // Labels of the services announced
+}
+
+// CiliumGateway is the Gateway API gateway deployCiliumGateway creates, with the certificates
+// its listeners terminate TLS with
+type CiliumGateway struct {
+	Name         string               `json:"name,omitempty"`      // Default: <instance>-gateway
+	Namespace    string               `json:"namespace,omitempty"` // Default: cilium-gateway
+	Listeners    []GatewayListener    `json:"listeners"`
+	Certificates []GatewayCertificate `json:"certificates,omitempty"`
+}
+
+// GatewayListener is one listener of the gateway
+type GatewayListener struct {
+	Name        string `json:"name"`
+	Hostname    string `json:"hostname,omitempty"` // Default: every hostname
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol" enum:"HTTP,HTTPS,TLS"`
+	Certificate string `json:"certificate,omitempty"` // Name of a certificate, required for HTTPS. TLS listeners without one pass TLS through.
+}
+
+// GatewayCertificate is a TLS secret listeners refer to by name, and where it comes from
+type GatewayCertificate struct {
+	Name       string `json:"name"`                                             // Name of the secret
+	Namespace  string `json:"namespace,omitempty"`                              // Default: certificates
+	Source     string `json:"source" enum:"files,secret,cert-manager"`          // files: certFile/keyFile or the tlsCert/tlsKey credentials, secret: an existing secret, cert-manager: a Certificate
+	CertFile   string `json:"certFile,omitempty"`                               // files: PEM certificate
+	KeyFile    string `json:"keyFile,omitempty"`                                // files: PEM private key
+	Issuer     string `json:"issuer,omitempty"`                                 // cert-manager: issuer of the Certificate
+	IssuerKind string `json:"issuerKind,omitempty" enum:"ClusterIssuer,Issuer"` // cert-manager: default ClusterIssuer
+}
+
+// ClusterVersions pins what a cluster installs, so two deploys of the same config build the
+// same cluster. Empty fields use defaultClusterVersions.
+type ClusterVersions struct {
+	K3s        string `json:"k3s,omitempty"`        // INSTALL_K3S_VERSION, e.g. v1.34.3+k3s1
+	RKE2       string `json:"rke2,omitempty"`       // INSTALL_RKE2_VERSION, e.g. v1.34.3+rke2r1
+	Kubernetes string `json:"kubernetes,omitempty"` // kubeadm kubernetesVersion and worker packages, e.g. v1.34.3
+	Helm       string `json:"helm,omitempty"`       // Helm CLI installed on K3s and RKE2 servers
+	Cilium     string `json:"cilium,omitempty"`     // Cilium Helm chart, e.g. 1.18.5
+	CiliumCLI  string `json:"ciliumCli,omitempty"`  // cilium CLI release
+	Hubble     string `json:"hubble,omitempty"`     // hubble CLI release
+	GatewayAPI string `json:"gatewayApi,omitempty"` // Gateway API CRD release
+	Calico     string `json:"calico,omitempty"`     // Calico release of the calico and canal manifests
+	Flannel    string `json:"flannel,omitempty"`    // flannel release installed on kubeadm
+	KubeVIP    string `json:"kubeVip,omitempty"`    // kube-vip image tag, see load-balancer-mode
+	MetalLB    string `json:"metallb,omitempty"`    // MetalLB native manifest release, see loadBalancerProvider
+}
+
+// MetalLBOptions is the metallb map in the config of a cluster with loadBalancerProvider metallb
+type MetalLBOptions struct {
+	Addresses []string    `json:"addresses,omitempty"` // CIDRs and start-stop ranges (default: the range of the cluster type)
+	L2        *MetalLBL2  `json:"l2,omitempty"`        // Which nodes announce the addresses over ARP
+	BGP       *MetalLBBGP `json:"bgp,omitempty"`       // Announce the addresses to BGP peers instead of over L2
 }
 
-type Services struct {
-	K3s       *ServiceConfig `yaml:"k3s,omitempty"`
-	Kubeadm   *ServiceConfig `yaml:"kubeadm,omitempty"`
-	RKE2      *ServiceConfig `yaml:"rke2,omitempty"`
-	HAProxy   *ServiceConfig `yaml:"haproxy,omitempty"`
-	Talos     *ServiceConfig `yaml:"talos,omitempty"`
-	Harvester *ServiceConfig `yaml:"harvester,omitempty"`
+// MetalLBL2 selects the nodes and interfaces of the L2Advertisement. Empty fields match everything.
+type MetalLBL2 struct {
+	Interfaces   []string          `json:"interfaces,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"` // Labels of the nodes that announce
+}
+
+// MetalLBBGP are the BGP sessions the MetalLB speakers open
+type MetalLBBGP struct {
+	MyASN int           `json:"myASN"`
+	Peers []MetalLBPeer `json:"peers"`
+}
+
+// MetalLBPeer is one BGP router the speakers peer with
+type MetalLBPeer struct {
+	Address string `json:"address"`
+	ASN     int    `json:"asn"`
+	Port    int    `json:"port,omitempty"` // Default: 179
+}
+
+// Services are the configured service instances by name
+type Services map[string]*ServiceConfig
+
+// ServiceType is a kind of service that instances under services can use
+type ServiceType struct {
+	Handler ServiceHandler // nil while the type is only planned
+	Cluster bool           // Owns the VM groups it runs on, no other cluster may use them
 }
 
 type VMGroup struct {
@@ -75,9 +229,60 @@ type VMGroup struct {
 }
 
 type VMCreationConfig struct {
-	BatchSize  int `yaml:"batchSize"`  // How many VMs to create in parallel (default: 3)
-	MaxRetries int `yaml:"maxRetries"` // How many times to retry failed clones (default: 5)
-	BatchDelay int `yaml:"batchDelay"` // Seconds to wait between batches (default: 10)
+	BatchSize  int `json:"batchSize,omitempty"`  // How many VMs to create in parallel (default: 3)
+	MaxRetries int `json:"maxRetries,omitempty"` // How many times to retry failed clones (default: 5)
+	BatchDelay int `json:"batchDelay,omitempty"` // Seconds to wait between batches (default: 10)
+}
+
+// SiteDefaults are the site-wide values every VM group and template inherits unless it sets its own
+type SiteDefaults struct {
+	SSHUser      string   `json:"sshUser,omitempty"`      // OS user created via cloud-init and used for SSH by services
+	Node         string   `json:"node,omitempty"`         // Proxmox node VMs are created on
+	TemplateNode string   `json:"templateNode,omitempty"` // Proxmox node holding the templates (default: node)
+	Datastore    string   `json:"datastore,omitempty"`    // Datastore for cloud-init drives, EFI disks and built templates (default: vm-data)
+	Bridge       string   `json:"bridge,omitempty"`       // Bridge of the first NIC (default: vmbr0)
+	DNS          []string `json:"dns,omitempty"`          // Resolvers (default: the gateway)
+	Domain       string   `json:"domain,omitempty"`       // Search domain (default: local)
+	Gateway      string   `json:"gateway,omitempty"`      // Default gateway (default: the top-level gateway key)
+}
+
+// SecretRef points at a credential in exactly one secret source, for example
+// `{vault: kv/proxmox#key}`, `{env: SSH_PUBLIC_KEY}` or `{file: ./tls.crt}`
+type SecretRef struct {
+	Env    string `json:"env,omitempty"`    // Environment variable name
+	File   string `json:"file,omitempty"`   // File path, environment variables in it are expanded
+	Config string `json:"config,omitempty"` // Pulumi config key, usually set with --secret. Other namespaces as <namespace>:<key>
+	Vault  string `json:"vault,omitempty"`  // Vault KV secret as <mount>/<path>#<field>
+}
+
+// CredentialsConfig declares where each credential is read from. A credential left out is read
+// from its default source, which is the environment variable or file used before this block existed.
+type CredentialsConfig struct {
+	SSHPublicKey         *SecretRef `json:"sshPublicKey,omitempty" default:"env:SSH_PUBLIC_KEY" required:"true"`
+	SSHPrivateKey        *SecretRef `json:"sshPrivateKey,omitempty" default:"env:PROXMOX_VE_SSH_PRIVATE_KEY" required:"true"`
+	ProxmoxAPIToken      *SecretRef `json:"proxmoxApiToken,omitempty" default:"env:PROXMOX_VE_API_TOKEN" required:"true"`
+	SUSERegistrationCode *SecretRef `json:"suseRegistrationCode,omitempty" default:"env:SUSE_REGISTRATION_CODE"`
+	TLSCert              *SecretRef `json:"tlsCert,omitempty" default:"file:$TLS_CERT_PATH"` // Cilium gateway certificate (PEM)
+	TLSKey               *SecretRef `json:"tlsKey,omitempty" default:"file:$TLS_KEY_PATH"`   // Cilium gateway private key (PEM)
+	KubeadmCACert        *SecretRef `json:"kubeadmCaCert,omitempty" default:"env:K8S_CA_CERT"`
+	KubeadmCAKey         *SecretRef `json:"kubeadmCaKey,omitempty" default:"env:K8S_CA_KEY"`
+	KeepalivedAuth       *SecretRef `json:"keepalivedAuth,omitempty" default:"env:KEEPALIVED_AUTH_PASS"` // VRRP password of load balancer pairs
+	HAProxyStats         *SecretRef `json:"haproxyStats,omitempty" default:"env:HAPROXY_STATS_PASSWORD"` // Password of the HAProxy stats page
+}
+
+// StackConfig is the proxmoxInfra config namespace. Its JSON tags are the config keys and
+// the source of the schema printed by `go run . schema`.
+type StackConfig struct {
+	Password    string            `json:"password"`
+	Gateway     string            `json:"gateway,omitempty"` // Same as defaults.gateway, kept for existing stacks
+	Defaults    SiteDefaults      `json:"defaults,omitempty"`
+	VMCreation  VMCreationConfig  `json:"vmCreation,omitempty"`
+	Templates   []VMTemplate      `json:"templates,omitempty"` // Templates built from cloud images
+	VMs         []VM              `json:"vms"`
+	Services    Services          `json:"services"`
+	Render      bool              `json:"render,omitempty"`      // Write the scripts of remote commands to ./rendered
+	Credentials CredentialsConfig `json:"credentials,omitempty"` // Where SSH keys, API tokens and certificates come from
+	Layers      []string          `json:"layers,omitempty"`      // Base and overlay files merged in order below the stack config
 }
 
 type VMRequest struct {
@@ -89,25 +294,51 @@ type VMRequest struct {
 	Password string
 }
 
-type HAProxyServiceConfig struct {
-	APIPort        int            `json:"apiPort"`
-	SupervisorPort int            `json:"supervisorPort,omitempty"`
-	DashboardPort  int            `json:"dashboardPort,omitempty"`
-	ExtraPorts     map[string]int `json:"extraPorts,omitempty"`
+// HAProxyPort is one entry of the `ports` list in a service's config: a frontend on the load
+// balancer forwarding to a port on every backend server
+type HAProxyPort struct {
+	Name        string `json:"name"`
+	Frontend    int    `json:"frontend"`
+	Backend     int    `json:"backend"`
+	Mode        string `json:"mode,omitempty" enum:"tcp,http"`                             // tcp (default) or http
+	Check       string `json:"check,omitempty" enum:"tcp,http,https,none"`                 // Health check of the servers (default: tcp)
+	CheckPath   string `json:"checkPath,omitempty"`                                        // Path requested by http(s) checks (default: /)
+	CheckStatus []int  `json:"checkStatus,omitempty"`                                      // Statuses http(s) checks accept (default: 200)
+	Balance     string `json:"balance,omitempty" enum:"roundrobin,leastconn,source,first"` // Overrides the balance of the haproxy config
 }
-type HAProxyBackend struct {
-	Name         string
-	IPs          []string
-	FrontendPort int
-	BackendPort  int
+
+// HAProxyOptions is the `haproxy` map in the config of a cluster or haproxy service
+type HAProxyOptions struct {
+	Balance    string             `json:"balance,omitempty" enum:"roundrobin,leastconn,source,first"` // Default: roundrobin
+	Timeouts   HAProxyTimeouts    `json:"timeouts,omitempty"`
+	Stats      HAProxyStats       `json:"stats,omitempty"`
+	Prometheus *HAProxyPrometheus `json:"prometheus,omitempty"` // Exporter frontend, off unless set
 }
-type HAProxyStructure struct {
-	Config struct {
-		Ports map[string]HAProxyServiceConfig `json:"ports"`
-	} `json:"config"`
+
+// HAProxyTimeouts are HAProxy time values such as 500ms, 5s or 1m
+type HAProxyTimeouts struct {
+	Connect string `json:"connect,omitempty"` // Default: 5s
+	Client  string `json:"client,omitempty"`  // Default: 50s
+	Server  string `json:"server,omitempty"`  // Default: 50s
+	Check   string `json:"check,omitempty"`   // Default: 5s
 }
 
-type ServicesConfig struct {
-	HAProxy HAProxyStructure `json:"haproxy"`
+// HAProxyStats is the stats page. It only listens on localhost unless the haproxyStats
+// credential is set.
+type HAProxyStats struct {
+	Port int    `json:"port,omitempty"` // Default: 8404
+	User string `json:"user,omitempty"` // Default: admin
+}
+
+// HAProxyPrometheus is the frontend of HAProxy's built-in Prometheus exporter
+type HAProxyPrometheus struct {
+	Port int `json:"port,omitempty"` // Default: 8405
+}
+
+// HAProxyBackend is one frontend and backend pair of a load balancer with its servers
+type HAProxyBackend struct {
+	Name string // <service>-<port name>, the prefix of the frontend, backend and server names
+	Port HAProxyPort
+	IPs  []string
 }
 type ServiceHandler func(ctx *pulumi.Context, serviceCtx ServiceContext) error
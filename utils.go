@@ -1,23 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve"
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
+	"github.com/pulumi/pulumi-command/sdk/go/command/remote"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
 func checkRequiredEnvVars() error {
 	required := []string{
-		"SSH_PUBLIC_KEY",
 		"PROXMOX_VE_SSH_USERNAME",
 		"PROXMOX_VE_ENDPOINT",
-		"PROXMOX_VE_API_TOKEN",
-		"PROXMOX_VE_SSH_PRIVATE_KEY",
 	}
 
 	var missingEnvVars []string
@@ -35,9 +37,10 @@ func checkRequiredEnvVars() error {
 func setupProxmoxProvider(ctx *pulumi.Context) (*proxmoxve.Provider, error) {
 	provider, err := proxmoxve.NewProvider(ctx, "proxmox-provider", &proxmoxve.ProviderArgs{
 		Ssh: &proxmoxve.ProviderSshArgs{
-			PrivateKey: pulumi.String(os.Getenv("PROXMOX_VE_SSH_PRIVATE_KEY")),
+			PrivateKey: secretCredential("sshPrivateKey"),
 			Username:   pulumi.String(os.Getenv("PROXMOX_VE_SSH_USERNAME")),
 		},
+		ApiToken: secretCredential("proxmoxApiToken"),
 		Insecure: pulumi.Bool(true), // for self signed certificate
 	})
 	if err != nil {
@@ -46,86 +49,216 @@ func setupProxmoxProvider(ctx *pulumi.Context) (*proxmoxve.Provider, error) {
 	return provider, nil
 }
 
-func loadConfig(ctx *pulumi.Context) (string, string, []VM, *Services, *VMCreationConfig, map[string]HAProxyServiceConfig, error) {
-	cfg := config.New(ctx, "")
-	vmPassword := cfg.Require("password")
-	gateway := cfg.Require("gateway")
-
-	var vms []VM
-	cfg.RequireObject("vms", &vms)
+// configuredKeys lists the keys set in a config namespace. The SDK only looks keys up by
+// name, so the list comes from the config the engine hands to the program.
+func configuredKeys(namespace string) []string {
+	var all map[string]string
+	if err := json.Unmarshal([]byte(os.Getenv(pulumi.EnvConfig)), &all); err != nil {
+		return nil
+	}
+	var keys []string
+	for name := range all {
+		if key, found := strings.CutPrefix(name, namespace+":"); found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	var services Services
-	cfg.RequireObject("services", &services)
+func loadConfig(ctx *pulumi.Context) (*StackConfig, error) {
+	cfg := config.New(ctx, "")
+	var errs ConfigErrors
+
+	// Check the raw values against the schema first: unknown keys and type mistakes are
+	// reported with their path instead of being dropped or panicking during decode
+	schema := stackConfigSchema()
+	properties := schema["properties"].(map[string]interface{})
+	raw := make(map[string]interface{})
+	for key, property := range properties {
+		text, err := cfg.Try(key)
+		if err != nil {
+			continue
+		}
+		if property.(map[string]interface{})["type"] == "string" {
+			raw[key] = text
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(text), &value); err != nil {
+			errs.add(key, "cannot be parsed: %v", err)
+			continue
+		}
+		raw[key] = value
+	}
+	for _, key := range configuredKeys(ctx.Project()) {
+		if properties[key] == nil && !isAnchorKey(key) {
+			errs.add(key, "unknown key in the %s config%s", ctx.Project(), suggestField(key, properties))
+		}
+	}
+	raw = layeredConfig(raw, properties, &errs)
+	checkSchema(raw, schema, "", &errs)
 
-	// Load VM creation config with defaults
-	var vmCreationConfig VMCreationConfig
-	cfg.TryObject("vmCreation", &vmCreationConfig)
+	var stack StackConfig
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&stack); err != nil && len(errs) == 0 {
+		// The schema check above should have caught this; report it rather than guess
+		errs.add("", "%v", err)
+	}
 
 	// Set defaults if not provided
-	if vmCreationConfig.BatchSize == 0 {
-		vmCreationConfig.BatchSize = 3
+	if stack.VMCreation.BatchSize == 0 {
+		stack.VMCreation.BatchSize = 3
+	}
+	if stack.VMCreation.MaxRetries == 0 {
+		stack.VMCreation.MaxRetries = 5
+	}
+	if stack.VMCreation.BatchDelay == 0 {
+		stack.VMCreation.BatchDelay = 10
+	}
+
+	// Site defaults fill in whatever a group or template leaves unset
+	site := &stack.Defaults
+	if site.Gateway == "" {
+		site.Gateway = stack.Gateway
+	}
+	if site.TemplateNode == "" {
+		site.TemplateNode = site.Node
+	}
+	// Cloud-init drives were always created on vm-data, another default would replace them
+	if site.Datastore == "" {
+		site.Datastore = "vm-data"
 	}
-	if vmCreationConfig.MaxRetries == 0 {
-		vmCreationConfig.MaxRetries = 5
+	if site.Bridge == "" {
+		site.Bridge = "vmbr0"
 	}
-	if vmCreationConfig.BatchDelay == 0 {
-		vmCreationConfig.BatchDelay = 10
+	if site.Domain == "" {
+		site.Domain = "local"
 	}
+	for idx, server := range site.DNS {
+		if net.ParseIP(server) == nil {
+			errs.add(fmt.Sprintf("defaults.dns[%d]", idx), "%q is not an IP address", server)
+		}
+	}
+
+	templates := stack.Templates
+	templateNodes := make(map[int64]string)
+	templateFirmware := make(map[int64]string)
+	for i := range templates {
+		path := fmt.Sprintf("templates[%d]", i)
+		validateTemplate(templates[i], path, &errs)
+		if _, exists := templateNodes[templates[i].VMID]; exists {
+			errs.add(path+".vmId", "%d is declared twice", templates[i].VMID)
+		}
 
+		// Set defaults
+		if templates[i].ProxmoxNode == "" {
+			templates[i].ProxmoxNode = site.TemplateNode
+			if templates[i].ProxmoxNode == "" {
+				errs.add(path+".proxmoxNode", "not set and defaults.templateNode and defaults.node are empty")
+			}
+		}
+		if templates[i].Datastore == "" {
+			templates[i].Datastore = site.Datastore
+		}
+		if templates[i].Bridge == "" {
+			templates[i].Bridge = site.Bridge
+		}
+		if templates[i].Memory == 0 {
+			templates[i].Memory = 2048
+		}
+		if templates[i].CPU == 0 {
+			templates[i].CPU = 2
+		}
+		if templates[i].Firmware == "" {
+			templates[i].Firmware = "seabios"
+		}
+		templateNodes[templates[i].VMID] = templates[i].ProxmoxNode
+		templateFirmware[templates[i].VMID] = templates[i].Firmware
+	}
+
+	vms := stack.VMs
 	for i := range vms {
+		path := fmt.Sprintf("vms[%d]", i)
+
 		// iPXE boot VMs (like Harvester) don't need a template - they boot from ISO
 		if vms[i].BootMethod != "ipxe" && vms[i].TemplateID == 0 {
-			return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s' has no templateId set. Template ID is required for bootMethod '%s'", vms[i].Name, vms[i].BootMethod)
+			errs.add(path+".templateId", "required for bootMethod '%s'", vms[i].BootMethod)
 		}
 		if vms[i].Name == "" {
-			return "", "", nil, nil, nil, nil, fmt.Errorf("VM at index %d has no name set", i)
+			errs.add(path+".name", "must not be empty")
+		}
+		if vms[i].Count < 0 {
+			errs.add(path+".count", "must not be negative, got %d", vms[i].Count)
+		}
+
+		if int64(len(vms[i].Import)) > vms[i].Count {
+			errs.add(path+".import", "imports %d VMs but count is %d", len(vms[i].Import), vms[i].Count)
+		}
+		for idx, vmID := range vms[i].Import {
+			if vmID != 0 && vmID < 100 {
+				errs.add(fmt.Sprintf("%s.import[%d]", path, idx), "not a valid VMID: %d", vmID)
+			}
+		}
+
+		validateFirmware(vms[i], path, &errs)
+		if vms[i].NetworkConfig != "" && vms[i].BootMethod == "ipxe" {
+			errs.add(path+".networkConfig", "only supported for cloud-init VMs")
 		}
 
 		// iPXE VMs don't need IPs (they use DHCP)
-		if vms[i].BootMethod != "ipxe" && len(vms[i].IPs) == 0 {
-			return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s' has no IPs configured (required for non-iPXE VMs)", vms[i].Name)
+		if vms[i].BootMethod != "ipxe" && int64(len(vms[i].IPs)) < vms[i].Count {
+			errs.add(path+".ips", "need %d, got %d", vms[i].Count, len(vms[i].IPs))
+		}
+		for idx, ip := range vms[i].IPs {
+			if net.ParseIP(ip) == nil {
+				errs.add(fmt.Sprintf("%s.ips[%d]", path, idx), "%q is not an IP address", ip)
+			}
 		}
 
 		// Validate iPXE/Harvester specific configuration
 		if vms[i].BootMethod == "ipxe" {
 			if vms[i].IPXEConfig == nil {
-				return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s' uses iPXE boot but has no ipxeConfig", vms[i].Name)
-			}
-
-			isoCount := len(vms[i].IPXEConfig.ISOFiles)
-			nodeCount := vms[i].Count
+				errs.add(path+".ipxeConfig", "required for bootMethod 'ipxe'")
+			} else {
+				isoCount := len(vms[i].IPXEConfig.ISOFiles)
+				nodeCount := vms[i].Count
 
-			if isoCount == 0 {
-				return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s' uses iPXE but has no ISO files configured", vms[i].Name)
-			}
+				if isoCount == 0 {
+					errs.add(path+".ipxeConfig.isoFiles", "no ISO files configured")
+				}
 
-			// Critical validation: single ISO can only create single node
-			if isoCount == 1 && nodeCount > 1 {
-				return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s': Cannot create %d nodes with only 1 ISO. For Harvester clustering, provide 2 ISOs (create + join)",
-					vms[i].Name, nodeCount)
-			}
+				// Critical validation: single ISO can only create single node
+				if isoCount == 1 && nodeCount > 1 {
+					errs.add(path+".ipxeConfig.isoFiles", "cannot create %d nodes with only 1 ISO. For Harvester clustering, provide 2 ISOs (create + join)", nodeCount)
+				}
 
-			// Warn about even node counts for Harvester
-			if nodeCount == 2 {
-				ctx.Log.Error(fmt.Sprintf("CRITICAL: VM '%s' has 2 nodes - this breaks etcd quorum! Use 1 or 3+ nodes", vms[i].Name), nil)
-				return "", "", nil, nil, nil, nil, fmt.Errorf("VM '%s': 2-node Harvester cluster breaks etcd quorum. Use 1 node (no HA) or 3+ nodes (with HA)", vms[i].Name)
-			}
+				// Even node counts break etcd quorum for Harvester
+				if nodeCount == 2 {
+					errs.add(path+".count", "2-node Harvester cluster breaks etcd quorum. Use 1 node (no HA) or 3+ nodes (with HA)")
+				}
 
-			// Check for create/join pattern in ISO names
-			if isoCount > 1 && nodeCount > 1 {
-				hasCreate, hasJoin := false, false
-				for _, iso := range vms[i].IPXEConfig.ISOFiles {
-					isoLower := strings.ToLower(iso)
-					if strings.Contains(isoLower, "create") || strings.Contains(isoLower, "master") || strings.Contains(isoLower, "init") {
-						hasCreate = true
+				// Check for create/join pattern in ISO names
+				if isoCount > 1 && nodeCount > 1 {
+					hasCreate, hasJoin := false, false
+					for _, iso := range vms[i].IPXEConfig.ISOFiles {
+						isoLower := strings.ToLower(iso)
+						if strings.Contains(isoLower, "create") || strings.Contains(isoLower, "master") || strings.Contains(isoLower, "init") {
+							hasCreate = true
+						}
+						if strings.Contains(isoLower, "join") || strings.Contains(isoLower, "worker") || strings.Contains(isoLower, "add") {
+							hasJoin = true
+						}
 					}
-					if strings.Contains(isoLower, "join") || strings.Contains(isoLower, "worker") || strings.Contains(isoLower, "add") {
-						hasJoin = true
-					}
-				}
 
-				if !hasCreate || !hasJoin {
-					ctx.Log.Warn(fmt.Sprintf("VM '%s': ISO names should contain 'create'/'master' and 'join'/'worker' for automatic role detection. Will use positional logic (first=create, rest=join)", vms[i].Name), nil)
+					if !hasCreate || !hasJoin {
+						ctx.Log.Warn(fmt.Sprintf("VM '%s': ISO names should contain 'create'/'master' and 'join'/'worker' for automatic role detection. Will use positional logic (first=create, rest=join)", vms[i].Name), nil)
+					}
 				}
 			}
 		}
@@ -138,53 +271,360 @@ func loadConfig(ctx *pulumi.Context) (string, string, []VM, *Services, *VMCreati
 			vms[i].AuthMethod = "ssh-key"
 		}
 		if vms[i].Username == "" {
-			vms[i].Username = "rajeshk"
+			vms[i].Username = site.SSHUser
+			if vms[i].Username == "" && vms[i].BootMethod != "ipxe" {
+				errs.add(path+".username", "not set and defaults.sshUser is empty; earlier versions used rajeshk, set defaults.sshUser: rajeshk to keep it")
+			}
 		}
 		if vms[i].ProxmoxNode == "" {
-			vms[i].ProxmoxNode = "proxmox-3"
+			vms[i].ProxmoxNode = site.Node
+			if vms[i].ProxmoxNode == "" {
+				errs.add(path+".proxmoxNode", "not set and defaults.node is empty")
+			}
 		}
 		if vms[i].Gateway == "" {
-			vms[i].Gateway = gateway
+			vms[i].Gateway = site.Gateway
+			if vms[i].Gateway == "" && vms[i].BootMethod != "ipxe" {
+				errs.add(path+".gateway", "not set and defaults.gateway is empty")
+			}
+		}
+		if len(vms[i].DNS) == 0 {
+			vms[i].DNS = site.DNS
+			if len(vms[i].DNS) == 0 && vms[i].Gateway != "" {
+				vms[i].DNS = []string{vms[i].Gateway}
+			}
+		}
+		for idx, server := range vms[i].DNS {
+			if net.ParseIP(server) == nil {
+				errs.add(fmt.Sprintf("%s.dns[%d]", path, idx), "%q is not an IP address", server)
+			}
+		}
+		if vms[i].Domain == "" {
+			vms[i].Domain = site.Domain
+		}
+		if vms[i].Datastore == "" {
+			vms[i].Datastore = site.Datastore
 		}
 		if vms[i].IPConfig == "" {
 			vms[i].IPConfig = "static"
 		}
+		vms[i].explicitFirmware = vms[i].Firmware != ""
+		if vms[i].Firmware == "" {
+			vms[i].Firmware = "seabios"
+		}
+		if vms[i].PrefixLength == 0 {
+			vms[i].PrefixLength = 23
+		}
+		if len(vms[i].Bridges) == 0 {
+			vms[i].Bridges = []string{site.Bridge}
+		}
+		if vms[i].SnippetDatastore == "" {
+			vms[i].SnippetDatastore = "local"
+		}
+		if vms[i].EFIDatastore == "" {
+			vms[i].EFIDatastore = vms[i].Datastore
+			if vms[i].BootMethod == "ipxe" {
+				vms[i].EFIDatastore = "local-lvm"
+			}
+		}
+		if node, declared := templateNodes[vms[i].TemplateID]; declared && vms[i].BootMethod != "ipxe" {
+			vms[i].TemplateNode = node
+			vms[i].declaredTemplate = true
+			if templateFirmware[vms[i].TemplateID] != vms[i].Firmware {
+				errs.add(path+".firmware", "'%s' does not match template %d, which is built with '%s'",
+					vms[i].Firmware, vms[i].TemplateID, templateFirmware[vms[i].TemplateID])
+			}
+		}
+		if vms[i].TemplateNode == "" {
+			vms[i].TemplateNode = site.TemplateNode
+			if vms[i].TemplateNode == "" {
+				vms[i].TemplateNode = vms[i].ProxmoxNode
+			}
+		}
 	}
 
-	ctx.Export("vmPassword", pulumi.String(vmPassword))
+	// Render every network config now so a broken template fails before anything is deployed
+	for i := range vms {
+		if vms[i].NetworkConfig == "" {
+			continue
+		}
+		if err := validateGroupNetworkConfig(vms[i]); err != nil {
+			errs.add(fmt.Sprintf("vms[%d].networkConfig", i), "%v", err)
+		}
+	}
+
+	// Instances without a type use the type of the same name, so `k3s:` stays a k3s cluster
+	for name, service := range stack.Services {
+		if service != nil && service.Type == "" {
+			service.Type = name
+		}
+	}
+	validateServiceReferences(&stack, &errs)
+	validateClusterCNIs(stack.Services, &errs)
+	validateLoadBalancerPools(stack.Services, &errs)
+	validateCiliumConfig(stack.Services, &errs)
+	validateMetalLBConfig(stack.Services, &errs)
+	validateHAProxyConfig(stack.Services, &errs)
+	validateClusterVIPs(&stack, &errs)
+	validateClusterVersions(stack.Services, &errs)
+	validateCredentials(stack.Credentials, &errs)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	ctx.Export("vmPassword", pulumi.ToSecret(pulumi.String(stack.Password)))
 	ctx.Log.Info(fmt.Sprintf("Infrastructure: Found %d VM groups to create", len(vms)), nil)
 
-	enabledServices := getEnabledServices(&services)
+	enabledServices := getEnabledServices(stack.Services)
 	if len(enabledServices) > 0 {
 		ctx.Log.Info(fmt.Sprintf("Services: Found enabled services: %v", enabledServices), nil)
 	}
-	return vmPassword, gateway, vms, &services, &vmCreationConfig, nil, nil
+	if len(templates) > 0 {
+		ctx.Log.Info(fmt.Sprintf("Templates: Found %d templates to build", len(templates)), nil)
+	}
+	return &stack, nil
 }
 
-func getEnabledServices(services *Services) []string {
-	if services == nil {
-		return []string{}
+func validateTemplate(tmpl VMTemplate, path string, errs *ConfigErrors) {
+	if tmpl.Name == "" {
+		errs.add(path+".name", "must not be empty")
+	}
+	if tmpl.VMID < 100 {
+		errs.add(path+".vmId", "must be 100 or higher, got %d", tmpl.VMID)
+	}
+	if tmpl.ImageURL == "" && tmpl.ImagePath == "" {
+		errs.add(path, "set either imageUrl or imagePath")
+	}
+	if tmpl.ImageURL != "" && tmpl.ImagePath != "" {
+		errs.add(path, "imageUrl and imagePath are mutually exclusive")
 	}
+	if tmpl.SkipCustomize && (len(tmpl.Packages) > 0 || len(tmpl.Commands) > 0) {
+		errs.add(path+".skipCustomize", "packages and commands need customization, remove skipCustomize")
+	}
+}
 
-	serviceRegistry := map[string]*ServiceConfig{
-		"k3s":       services.K3s,
-		"kubeadm":   services.Kubeadm,
-		"haproxy":   services.HAProxy,
-		"harvester": services.Harvester,
-		"rke2":      services.RKE2,
-		"talos":     services.Talos,
+func validateFirmware(vmDef VM, path string, errs *ConfigErrors) {
+	if vmDef.Firmware != "ovmf" && (vmDef.SecureBoot || vmDef.TPM) {
+		errs.add(path+".firmware", "secureBoot and tpm require firmware: ovmf")
 	}
+}
 
-	var enabledServices []string
-	for name, config := range serviceRegistry {
-		if config != nil && config.Enabled {
-			enabledServices = append(enabledServices, name)
+// getEnabledServices returns the enabled service instances in the order they are installed
+func getEnabledServices(services Services) []string {
+	enabledServices, err := serviceOrder(services)
+	if err != nil {
+		// Cycles are reported by validateServiceReferences, fall back to plain names here
+		for name, config := range services {
+			if config != nil && config.Enabled {
+				enabledServices = append(enabledServices, name)
+			}
 		}
+		sort.Strings(enabledServices)
 	}
 	return enabledServices
 }
 
-func createVMs(ctx *pulumi.Context, provider *proxmoxve.Provider, vms []VM, vmPassword string, vmCreationConfig *VMCreationConfig) (map[string][]*vm.VirtualMachine, error) {
+// serviceRole is one VM group reference of a service, e.g. services.rke2.controlPlane[0]
+type serviceRole struct {
+	path  string
+	role  string
+	group string
+}
+
+func serviceRoles(name string, config *ServiceConfig) []serviceRole {
+	var roles []serviceRole
+	lists := []struct {
+		role   string
+		groups []string
+	}{
+		{"targets", config.Targets},
+		{"controlPlane", config.ControlPlane},
+		{"workers", config.Workers},
+		{"loadBalancer", config.LoadBalancer},
+	}
+	for _, list := range lists {
+		for i, group := range list.groups {
+			roles = append(roles, serviceRole{
+				path:  fmt.Sprintf("services.%s.%s[%d]", name, list.role, i),
+				role:  list.role,
+				group: group,
+			})
+		}
+	}
+	if config.BackendDiscovery != "" {
+		roles = append(roles, serviceRole{
+			path:  fmt.Sprintf("services.%s.backendDiscovery", name),
+			role:  "backendDiscovery",
+			group: config.BackendDiscovery,
+		})
+	}
+	return roles
+}
+
+// validateServiceReferences checks that services and VM groups fit together, so a typo in a
+// group name fails before anything is created instead of deep in PHASE 2
+func validateServiceReferences(stack *StackConfig, errs *ConfigErrors) {
+	groups := make(map[string]VM)
+	for i, vmDef := range stack.VMs {
+		if _, exists := groups[vmDef.Name]; exists {
+			errs.add(fmt.Sprintf("vms[%d].name", i), "VM group '%s' is defined more than once", vmDef.Name)
+		}
+		groups[vmDef.Name] = vmDef
+	}
+
+	services := stack.Services
+
+	// Group name -> path of the cluster role that claimed it first
+	claimedBy := make(map[string]string)
+	for _, name := range sortedServiceNames(services) {
+		config := services[name]
+
+		serviceType, known := serviceTypes[config.Type]
+		if !known {
+			errs.add(fmt.Sprintf("services.%s.type", name), "unknown service type '%s', registered types are %s", config.Type, strings.Join(serviceTypeNames(), ", "))
+		} else if config.Enabled && serviceType.Handler == nil {
+			errs.add(fmt.Sprintf("services.%s.enabled", name), "service type '%s' is not implemented yet", config.Type)
+		}
+		for i, dependency := range config.DependsOn {
+			path := fmt.Sprintf("services.%s.dependsOn[%d]", name, i)
+			other, exists := services[dependency]
+			switch {
+			case !exists || other == nil:
+				errs.add(path, "unknown service '%s'", dependency)
+			case dependency == name:
+				errs.add(path, "service '%s' cannot depend on itself", name)
+			case config.Enabled && !other.Enabled:
+				errs.add(path, "service '%s' is disabled but '%s' depends on it", dependency, name)
+			}
+		}
+
+		serverCount := int64(0)
+		for _, ref := range serviceRoles(name, config) {
+			vmDef, exists := groups[ref.group]
+			if !exists {
+				errs.add(ref.path, "unknown VM group '%s'", ref.group)
+				continue
+			}
+			// Disabled services may keep pointing at groups that are switched off
+			if !config.Enabled {
+				continue
+			}
+			if vmDef.Count == 0 {
+				errs.add(ref.path, "VM group '%s' is disabled (count: 0) but service '%s' is enabled", ref.group, name)
+			}
+			if ref.role == "targets" || ref.role == "controlPlane" {
+				serverCount += vmDef.Count
+			}
+			if !serviceType.Cluster || ref.role == "backendDiscovery" {
+				continue
+			}
+			if other, claimed := claimedBy[ref.group]; claimed {
+				errs.add(ref.path, "VM group '%s' is already used by %s", ref.group, other)
+				continue
+			}
+			claimedBy[ref.group] = ref.path
+		}
+
+		// etcd needs a majority of control-plane nodes, an even count only adds a failure point
+		if config.Enabled && serviceType.Cluster && serverCount > 0 && serverCount%2 == 0 {
+			errs.add(fmt.Sprintf("services.%s.controlPlane", name), "%d control-plane nodes break etcd quorum, use an odd count", serverCount)
+		}
+	}
+
+	if _, err := serviceOrder(services); err != nil {
+		errs.add("services", "%v", err)
+	}
+}
+
+// validateLoadBalancerPools checks the LoadBalancer IP blocks of every enabled cluster instance,
+// from Cilium or MetalLB. Two clusters of the same type share a default range, so the second one
+// has to set its own.
+func validateLoadBalancerPools(services Services, errs *ConfigErrors) {
+	type pool struct {
+		name        string
+		start, stop net.IP
+	}
+	var pools []pool
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		if !isClusterType(config.Type) {
+			continue
+		}
+		provider := loadBalancerProvider(config)
+		if provider != "cilium" {
+			for _, key := range []string{"cilium-pool-start", "cilium-pool-stop"} {
+				if _, set := config.Config[key]; set {
+					errs.add(fmt.Sprintf("services.%s.config.%s", name, key), "only used with cni cilium and loadBalancerProvider cilium")
+				}
+			}
+		}
+
+		var blocks []CiliumPoolBlock
+		var paths []string
+		switch provider {
+		case "cilium":
+			valid := true
+			for _, key := range []string{"cilium-pool-start", "cilium-pool-stop"} {
+				if value, set := config.Config[key]; set {
+					if text, ok := value.(string); !ok || net.ParseIP(text).To4() == nil {
+						errs.add(fmt.Sprintf("services.%s.config.%s", name, key), "must be an IPv4 address, got %v", value)
+						valid = false
+					}
+				}
+			}
+			if !valid {
+				continue
+			}
+			options, err := ciliumOptions(config)
+			if err != nil {
+				continue // Reported by validateCiliumConfig
+			}
+			if len(options.Pools) > 0 {
+				for _, key := range []string{"cilium-pool-start", "cilium-pool-stop"} {
+					if _, set := config.Config[key]; set {
+						errs.add(fmt.Sprintf("services.%s.config.%s", name, key), "cannot be combined with cilium.pools")
+					}
+				}
+			}
+			blocks, _ = ciliumPoolBlocks(config)
+			for i := range blocks {
+				if len(options.Pools) > 0 {
+					paths = append(paths, fmt.Sprintf("services.%s.config.cilium.pools[%d]", name, i))
+				} else {
+					paths = append(paths, fmt.Sprintf("services.%s.config.cilium-pool-start", name))
+				}
+			}
+		case "metallb":
+			addresses, err := metalLBAddresses(config)
+			if err != nil {
+				continue // Reported by validateMetalLBConfig
+			}
+			for i, address := range addresses {
+				blocks = append(blocks, metalLBAddressBlock(address))
+				paths = append(paths, fmt.Sprintf("services.%s.config.metallb.addresses[%d]", name, i))
+			}
+		}
+
+		for i, block := range blocks {
+			start, stop, err := ciliumPoolRange(block)
+			if err != nil {
+				errs.add(paths[i], "%v", err)
+				continue
+			}
+			current := pool{name: name, start: start, stop: stop}
+			for _, other := range pools {
+				if bytes.Compare(current.start, other.stop) <= 0 && bytes.Compare(other.start, current.stop) <= 0 {
+					errs.add(fmt.Sprintf("services.%s.config", name), "LoadBalancer pool %s-%s overlaps the pool of service '%s' (%s-%s), set cilium.pools or metallb.addresses",
+						start, stop, other.name, other.start, other.stop)
+				}
+			}
+			pools = append(pools, current)
+		}
+	}
+}
+
+func createVMs(ctx *pulumi.Context, provider *proxmoxve.Provider, vms []VM, vmPassword string, vmCreationConfig *VMCreationConfig, templateDeps map[int64]pulumi.Resource) (map[string][]*vm.VirtualMachine, error) {
 	vmGroups := make(map[string][]*vm.VirtualMachine)
 
 	// Track last VM created per template PER NODE (to avoid NFS lock contention on same node)
@@ -211,9 +651,6 @@ func createVMs(ctx *pulumi.Context, provider *proxmoxve.Provider, vms []VM, vmPa
 
 			nodeName := vmDef.ProxmoxNode
 			if vmDef.BootMethod == "ipxe" {
-				// Distribute Harvester nodes across different Proxmox hosts
-				proxmoxNodes := []string{"proxmox-3"} // hardcoding to proxmox-3 for archtectural changes in the home lab
-				nodeName = proxmoxNodes[int(i)%len(proxmoxNodes)]
 				ctx.Log.Info(fmt.Sprintf("  Harvester node %d will be on %s", i+1, nodeName), nil)
 			}
 			// Get dependency on last VM from same template
@@ -238,6 +675,15 @@ func createVMs(ctx *pulumi.Context, provider *proxmoxve.Provider, vms []VM, vmPa
 				}
 			}
 
+			if vmID := importedVMID(vmDef, i); vmID > 0 {
+				ctx.Log.Info(fmt.Sprintf("  [%d/%d] %s (adopts existing VM %d)", i+1, count, vmName, vmID), nil)
+			}
+
+			// Templates built by this stack must exist before anything is cloned from them
+			if templateCmd, declared := templateDeps[vmDef.TemplateID]; declared && vmDef.BootMethod != "ipxe" && importedVMID(vmDef, i) == 0 {
+				dependsOn = append(dependsOn, templateCmd)
+			}
+
 			vmInstance, err := createVMWithRetry(
 				ctx,
 				provider,
@@ -312,17 +758,20 @@ func validateHarvesterConfig(ctx *pulumi.Context, vms []VM) error {
 	return nil
 }
 
-func buildGlobalDependency(vmGroups map[string][]*vm.VirtualMachine, vms []VM) map[string]interface{} {
+func buildGlobalDependency(vmGroups map[string][]*vm.VirtualMachine, vms []VM, vmPassword string, readiness map[string][]pulumi.Resource) map[string]interface{} {
 	globalDeps := make(map[string]interface{})
 
 	for groupName, vmList := range vmGroups {
 		globalDeps[groupName+"-vms"] = vmList
+		// Service commands depend on these rather than on the VMs themselves
+		globalDeps[groupName+"-ready"] = readiness[groupName]
 
 		for _, vmDef := range vms {
 			if vmDef.Name == groupName {
 				// Only store IPs if they exist
 				if len(vmDef.IPs) > 0 {
 					globalDeps[groupName+"-ips"] = vmDef.IPs
+					globalDeps[groupName+"-hosts"] = groupHosts(vmDef, vmPassword)
 				} else {
 					// Store empty slice or a marker for DHCP
 					globalDeps[groupName+"-ips"] = []string{}
@@ -334,3 +783,28 @@ func buildGlobalDependency(vmGroups map[string][]*vm.VirtualMachine, vms []VM) m
 	}
 	return globalDeps
 }
+
+// groupHosts returns the SSH target of every VM in a group, in the same order as its IPs
+func groupHosts(vmDef VM, vmPassword string) []Host {
+	hosts := make([]Host, 0, len(vmDef.IPs))
+	for _, ip := range vmDef.IPs {
+		hosts = append(hosts, Host{IP: ip, User: vmDef.Username, AuthMethod: vmDef.AuthMethod, Password: vmPassword, DNS: vmDef.DNS})
+	}
+	return hosts
+}
+
+// sshConnection connects to a host as the user of its VM group, with the SSH key and, for
+// groups that use authMethod: password, the VM password
+func sshConnection(host Host) *remote.ConnectionArgs {
+	connection := &remote.ConnectionArgs{
+		Host:           pulumi.String(host.IP),
+		User:           pulumi.String(host.User),
+		PrivateKey:     secretCredential("sshPrivateKey"),
+		PerDialTimeout: pulumi.IntPtr(30),
+		DialErrorLimit: pulumi.IntPtr(20),
+	}
+	if host.AuthMethod == "password" {
+		connection.Password = pulumi.String(host.Password)
+	}
+	return connection
+}
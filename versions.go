@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// defaultClusterVersions are what clusters install when their versions block leaves a field out
+var defaultClusterVersions = ClusterVersions{
+	K3s:        "v1.34.3+k3s1",
+	RKE2:       "v1.34.3+rke2r1",
+	Kubernetes: "v1.34.3",
+	Helm:       "v3.19.0",
+	Cilium:     "1.18.5",
+	CiliumCLI:  "v0.18.9",
+	Hubble:     "v1.18.3",
+	GatewayAPI: "v1.4.1",
+	Calico:     "v3.31.2",
+	Flannel:    "v0.27.4",
+	KubeVIP:    "v0.8.9",
+	MetalLB:    "v0.15.2",
+}
+
+// versionFields describes each field of ClusterVersions: whether a cluster installs it and the
+// form of its values
+var versionFields = []struct {
+	key     string
+	used    func(*ServiceConfig) bool
+	pattern *regexp.Regexp
+	field   func(*ClusterVersions) *string
+}{
+	{"k3s", clusterTypeIs("k3s"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+\+k3s[0-9]+$`), func(v *ClusterVersions) *string { return &v.K3s }},
+	{"rke2", clusterTypeIs("rke2"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+\+rke2r[0-9]+$`), func(v *ClusterVersions) *string { return &v.RKE2 }},
+	{"kubernetes", clusterTypeIs("kubeadm"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.Kubernetes }},
+	{"helm", clusterTypeIs("k3s", "rke2"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.Helm }},
+	{"cilium", cniInstalls("cilium"), regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.]+)?$`), func(v *ClusterVersions) *string { return &v.Cilium }},
+	{"ciliumCli", cniInstalls("cilium"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.CiliumCLI }},
+	{"hubble", cniInstalls("cilium"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.Hubble }},
+	{"gatewayApi", cniInstalls("cilium"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.GatewayAPI }},
+	{"calico", cniInstalls("calico", "canal"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.Calico }},
+	{"flannel", cniInstalls("flannel"), regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.Flannel }},
+	{"kubeVip", func(config *ServiceConfig) bool { return loadBalancerMode(config) == "kube-vip" },
+		regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.KubeVIP }},
+	{"metallb", func(config *ServiceConfig) bool { return loadBalancerProvider(config) == "metallb" },
+		regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`), func(v *ClusterVersions) *string { return &v.MetalLB }},
+}
+
+// clusterTypeIs reports whether a cluster is one of types
+func clusterTypeIs(types ...string) func(*ServiceConfig) bool {
+	return func(config *ServiceConfig) bool {
+		for _, t := range types {
+			if t == config.Type {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// cniInstalls reports whether a cluster installs one of the CNIs itself, rather than running
+// the one its distribution ships
+func cniInstalls(cnis ...string) func(*ServiceConfig) bool {
+	return func(config *ServiceConfig) bool {
+		cni := clusterCNI(config)
+		for _, shipped := range cniPlugins[cni] {
+			if shipped == config.Type {
+				return false
+			}
+		}
+		for _, c := range cnis {
+			if c == cni {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// clusterVersions returns the versions block of a cluster with the defaults filled in
+func clusterVersions(config *ServiceConfig) ClusterVersions {
+	versions := defaultClusterVersions
+	if config.Versions == nil {
+		return versions
+	}
+	configured := *config.Versions
+	for _, f := range versionFields {
+		if value := *f.field(&configured); value != "" {
+			*f.field(&versions) = value
+		}
+	}
+	return versions
+}
+
+// KubernetesMinor returns the minor release of the Kubernetes version, v1.34 for v1.34.3,
+// which names the pkgs.k8s.io channel its packages come from
+func (v ClusterVersions) KubernetesMinor() string {
+	parts := strings.SplitN(v.Kubernetes, ".", 3)
+	if len(parts) < 2 {
+		return v.Kubernetes
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// KubernetesPackage returns the Kubernetes version as the deb packages spell it, 1.34.3
+func (v ClusterVersions) KubernetesPackage() string {
+	return strings.TrimPrefix(v.Kubernetes, "v")
+}
+
+// validateClusterVersions checks the versions block of every enabled service: only clusters
+// take one, each field has to be something the cluster installs and look like a release of it
+func validateClusterVersions(services Services, errs *ConfigErrors) {
+	for _, name := range sortedEnabledServices(services) {
+		config := services[name]
+		if config.Versions == nil {
+			continue
+		}
+		path := fmt.Sprintf("services.%s.versions", name)
+		if !isClusterType(config.Type) {
+			errs.add(path, "only used by k3s, rke2 and kubeadm clusters")
+			continue
+		}
+		for _, f := range versionFields {
+			value := *f.field(config.Versions)
+			if value == "" {
+				continue
+			}
+			if !f.used(config) {
+				errs.add(path+"."+f.key, "not installed by this %s cluster", config.Type)
+			} else if !f.pattern.MatchString(value) {
+				errs.add(path+"."+f.key, "%q does not look like a release, e.g. %s", value, *f.field(&defaultClusterVersions))
+			}
+		}
+	}
+}
+
+// exportClusterVersions records the versions a cluster installs as the <instance>-versions
+// stack output
+func exportClusterVersions(ctx *pulumi.Context, serviceCtx ServiceContext) ClusterVersions {
+	config := serviceCtx.ServiceConfig
+	versions := clusterVersions(config)
+	resolved := pulumi.StringMap{}
+	for _, f := range versionFields {
+		if f.used(config) {
+			resolved[f.key] = pulumi.String(*f.field(&versions))
+		}
+	}
+	ctx.Export(serviceCtx.ServiceName+"-versions", resolved)
+	return versions
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -77,7 +76,7 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 
 	var userAccount *vm.VirtualMachineInitializationUserAccountArgs
 	if vmDef.AuthMethod == "ssh-key" {
-		sshKey := strings.TrimSpace(os.Getenv("SSH_PUBLIC_KEY"))
+		sshKey := strings.TrimSpace(credential("sshPublicKey"))
 		userAccount = &vm.VirtualMachineInitializationUserAccountArgs{
 			Username: pulumi.String(vmDef.Username),
 			Keys: pulumi.StringArray{
@@ -88,7 +87,7 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 		// For SLE VMs: Use password authentication
 		userAccount = &vm.VirtualMachineInitializationUserAccountArgs{
 			Username: pulumi.String(vmDef.Username),
-			Password: pulumi.String(password),
+			Password: pulumi.ToSecret(pulumi.String(password)).(pulumi.StringOutput),
 		}
 	}
 
@@ -102,7 +101,7 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 		ipConfig = &vm.VirtualMachineInitializationIpConfigArray{
 			&vm.VirtualMachineInitializationIpConfigArgs{
 				Ipv4: vm.VirtualMachineInitializationIpConfigIpv4Args{
-					Address: pulumi.String(vmDef.IPs[vmIndex] + "/23"),
+					Address: pulumi.String(fmt.Sprintf("%s/%d", vmDef.IPs[vmIndex], vmDef.PrefixLength)),
 					Gateway: pulumi.String(gateway),
 				},
 			},
@@ -110,6 +109,17 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 	} else {
 		ipConfig = nil
 	}
+
+	// A network config snippet replaces the single address per NIC set through ipConfig
+	var networkDataFileID pulumi.StringPtrInput
+	if vmDef.NetworkConfig != "" {
+		fileID, err := uploadNetworkConfig(ctx, provider, vmIndex, vmDef, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		networkDataFileID = fileID
+		ipConfig = nil
+	}
 	vmName := fmt.Sprintf("%s-%d", vmDef.Name, vmIndex)
 
 	// Build resource options with dependencies
@@ -125,18 +135,35 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 		opts = append(opts, pulumi.DependsOn(dependsOn))
 	}
 
+	importOpts, vmID, err := importVM(ctx, provider, vmIndex, vmDef, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, importOpts...)
+
+	bios, err := templateFirmwareCheck(ctx, provider, vmIndex, vmDef)
+	if err != nil {
+		return nil, err
+	}
+	machine, efiDisk, tpmState := firmwareArgs(vmDef)
+
 	vmInstance, err := vm.NewVirtualMachine(ctx, vmDef.Name+fmt.Sprintf("-%d", vmIndex), &vm.VirtualMachineArgs{
 		Name:     pulumi.String(vmName),
 		NodeName: pulumi.String(nodeName),
+		VmId:     vmID,
+		Bios:     bios,
+		Machine:  machine,
+		EfiDisk:  efiDisk,
+		TpmState: tpmState,
 		Memory: &vm.VirtualMachineMemoryArgs{
 			Dedicated: pulumi.Int(vmDef.Memory),
 		},
 		Cpu: &vm.VirtualMachineCpuArgs{
 			Cores: pulumi.Int(vmDef.CPU),
-			Type:  pulumi.String("x86-64-v2-AES"),
+			Type:  pulumi.String(cpuType(vmDef)),
 		},
 		Clone: &vm.VirtualMachineCloneArgs{
-			NodeName: pulumi.String("proxmox-1"), // hardcoding this for now as I have all the templates on proxmox-1. TODO somehow automate this as well.
+			NodeName: pulumi.String(vmDef.TemplateNode),
 			VmId:     pulumi.Int(vmDef.TemplateID),
 			Full:     pulumi.Bool(true),
 			Retries:  pulumi.Int(3), // Retry clone operation up to 3 times
@@ -151,23 +178,16 @@ func createCloudInitVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 				FileFormat: pulumi.String("raw"),
 			},
 		},
-		NetworkDevices: &vm.VirtualMachineNetworkDeviceArray{
-			&vm.VirtualMachineNetworkDeviceArgs{
-				Bridge:   pulumi.String("vmbr0"),
-				Model:    pulumi.String("virtio"),
-				Firewall: pulumi.Bool(true),
-			},
-		},
+		NetworkDevices: networkDevices(vmDef),
 		Initialization: &vm.VirtualMachineInitializationArgs{
-			DatastoreId: pulumi.String("vm-data"),
+			DatastoreId: pulumi.String(vmDef.Datastore),
 			UserAccount: userAccount,
 			Dns: &vm.VirtualMachineInitializationDnsArgs{
-				Domain: pulumi.String("local"),
-				Servers: pulumi.StringArray{
-					pulumi.String("192.168.90.1"),
-				},
+				Domain:  pulumi.String(vmDef.Domain),
+				Servers: pulumi.ToStringArray(vmDef.DNS),
 			},
-			IpConfigs: ipConfig,
+			IpConfigs:         ipConfig,
+			NetworkDataFileId: networkDataFileID,
 		},
 		Started: pulumi.Bool(true),
 		OnBoot:  pulumi.Bool(true),
@@ -264,9 +284,22 @@ func createHarvesterVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 		opts = append(opts, pulumi.DependsOn(dependsOn))
 	}
 
+	importOpts, vmID, err := importVM(ctx, provider, vmIndex, vmDef, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, importOpts...)
+
+	machine, efiDisk, tpmState := firmwareArgs(vmDef)
+
 	vmInstance, err := vm.NewVirtualMachine(ctx, vmDef.Name+fmt.Sprintf("-%d", vmIndex), &vm.VirtualMachineArgs{
 		Name:     pulumi.String(vmName),
 		NodeName: pulumi.String(nodeName),
+		VmId:     vmID,
+		Bios:     pulumi.String(vmDef.Firmware),
+		Machine:  machine,
+		EfiDisk:  efiDisk,
+		TpmState: tpmState,
 		Agent: &vm.VirtualMachineAgentArgs{
 			Enabled: pulumi.Bool(false), // Disable to prevent ide3 cdrom from being added
 		},
@@ -275,13 +308,9 @@ func createHarvesterVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 		},
 		Cpu: &vm.VirtualMachineCpuArgs{
 			Cores: pulumi.Int(vmDef.CPU),
-			Type:  pulumi.String("host"), // needed host type to ensure kvm is available on harvester for vms
-		},
-		BootOrders: pulumi.StringArray{
-			pulumi.String("scsi0"), // Disk first
-			pulumi.String("ide2"),  // Then CD-ROM with iPXE
-			pulumi.String("net0"),  // Then network
+			Type:  pulumi.String(cpuType(vmDef)),
 		},
+		BootOrders: pulumi.ToStringArray(ipxeBootOrder),
 		Disks: &vm.VirtualMachineDiskArray{
 			&vm.VirtualMachineDiskArgs{
 				Interface:   pulumi.String("scsi0"),
@@ -296,15 +325,9 @@ func createHarvesterVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 			FileId:    pulumi.String(fmt.Sprintf("nas-vm-storage:iso/%s", isoFileName)),
 			Interface: pulumi.String("ide2"),
 		},
-		NetworkDevices: &vm.VirtualMachineNetworkDeviceArray{
-			&vm.VirtualMachineNetworkDeviceArgs{
-				Bridge:   pulumi.String("vmbr0"),
-				Model:    pulumi.String("virtio"),
-				Firewall: pulumi.Bool(true),
-			},
-		},
-		Started: pulumi.Bool(true),
-		OnBoot:  pulumi.Bool(true),
+		NetworkDevices: networkDevices(vmDef),
+		Started:        pulumi.Bool(true),
+		OnBoot:         pulumi.Bool(true),
 		//	Protection: pulumi.Bool(true), Commenting this line for testing. will remove later TODO.
 	}, append(opts, pulumi.Protect(true))...)
 	if err != nil {
@@ -312,3 +335,274 @@ func createHarvesterVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmInde
 	}
 	return vmInstance, nil
 }
+
+// importedVMID returns the VMID to adopt for this index, or 0 when the VM should be created
+func importedVMID(vmDef VM, vmIndex int64) int64 {
+	if vmIndex < int64(len(vmDef.Import)) {
+		return vmDef.Import[vmIndex]
+	}
+	return 0
+}
+
+// importVM returns the resource options that adopt an existing VM instead of creating one.
+// Before the import happens the VM's current settings are read and compared with the group
+// definition, so any mismatch shows up in preview rather than as a failed import or an update.
+func importVM(ctx *pulumi.Context, provider *proxmoxve.Provider, vmIndex int64, vmDef VM, nodeName string) ([]pulumi.ResourceOption, pulumi.IntPtrInput, error) {
+	vmID := importedVMID(vmDef, vmIndex)
+	if vmID == 0 {
+		return nil, nil, nil
+	}
+
+	vmName := fmt.Sprintf("%s-%d", vmDef.Name, vmIndex)
+	importID := pulumi.ID(fmt.Sprintf("%s/%d", nodeName, vmID))
+	ctx.Log.Info(fmt.Sprintf("Adopting existing VM %d on %s as %s", vmID, nodeName, vmName), nil)
+
+	current, err := vm.GetVirtualMachine(ctx, vmName+"-import-check", importID, nil, pulumi.Provider(provider))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read existing VM %d on %s for %s: %w", vmID, nodeName, vmName, err)
+	}
+
+	pulumi.All(current.Name, current.Memory, current.Cpu, current.Disks, current.Bios, current.Machine,
+		current.OnBoot, current.Started, current.NetworkDevices, current.EfiDisk, current.TpmState,
+		current.Agent, current.BootOrders).ApplyT(func(args []interface{}) error {
+		mismatches := importMismatches(vmDef, vmName, importedState{
+			Name:           args[0].(string),
+			Memory:         args[1].(*vm.VirtualMachineMemory),
+			Cpu:            args[2].(*vm.VirtualMachineCpu),
+			Disks:          args[3].([]vm.VirtualMachineDisk),
+			Bios:           args[4].(*string),
+			Machine:        args[5].(*string),
+			OnBoot:         args[6].(*bool),
+			Started:        args[7].(*bool),
+			NetworkDevices: args[8].([]vm.VirtualMachineNetworkDevice),
+			EfiDisk:        args[9].(*vm.VirtualMachineEfiDisk),
+			TpmState:       args[10].(*vm.VirtualMachineTpmState),
+			Agent:          args[11].(*vm.VirtualMachineAgent),
+			BootOrders:     args[12].([]string),
+		})
+		for _, mismatch := range mismatches {
+			ctx.Log.Warn(fmt.Sprintf("Imported VM %s (VMID %d) differs from group '%s': %s", vmName, vmID, vmDef.Name, mismatch), nil)
+		}
+		if len(mismatches) == 0 {
+			ctx.Log.Info(fmt.Sprintf("Imported VM %s (VMID %d) matches group '%s'", vmName, vmID, vmDef.Name), nil)
+		}
+		return nil
+	})
+
+	opts := []pulumi.ResourceOption{
+		pulumi.Import(importID),
+		// Hand-built VMs have no clone source and may not use cloud-init
+		pulumi.IgnoreChanges([]string{"initialization", "cdrom"}),
+	}
+	return opts, pulumi.IntPtr(int(vmID)), nil
+}
+
+// cpuType is the CPU type of a group's VMs. iPXE (Harvester) VMs get the host CPU so KVM is
+// available to the VMs they run.
+func cpuType(vmDef VM) string {
+	if vmDef.BootMethod == "ipxe" {
+		return "host"
+	}
+	return "x86-64-v2-AES"
+}
+
+// ipxeBootOrder boots iPXE VMs from the disk first, then the iPXE CD-ROM, then the network
+var ipxeBootOrder = []string{"scsi0", "ide2", "net0"}
+
+// importedState is what importVM reads of an existing VM: every setting the VM resources manage
+type importedState struct {
+	Name           string
+	Memory         *vm.VirtualMachineMemory
+	Cpu            *vm.VirtualMachineCpu
+	Disks          []vm.VirtualMachineDisk
+	Bios           *string
+	Machine        *string
+	OnBoot         *bool
+	Started        *bool
+	NetworkDevices []vm.VirtualMachineNetworkDevice
+	EfiDisk        *vm.VirtualMachineEfiDisk
+	TpmState       *vm.VirtualMachineTpmState
+	Agent          *vm.VirtualMachineAgent
+	BootOrders     []string
+}
+
+// importMismatches compares an existing VM with what its group would create, property by
+// property, so a wrong value is a named warning instead of a failed import
+func importMismatches(vmDef VM, vmName string, current importedState) []string {
+	var mismatches []string
+	differs := func(property string, want, got interface{}) {
+		mismatches = append(mismatches, fmt.Sprintf("%s: want %v, got %v", property, want, got))
+	}
+
+	if current.Name != vmName {
+		differs("name", vmName, current.Name)
+	}
+	if memory := current.Memory; memory != nil && memory.Dedicated != nil && int64(*memory.Dedicated) != vmDef.Memory {
+		differs("memory", vmDef.Memory, *memory.Dedicated)
+	}
+	if cpu := current.Cpu; cpu != nil {
+		if cpu.Cores != nil && int64(*cpu.Cores) != vmDef.CPU {
+			differs("cpu", vmDef.CPU, *cpu.Cores)
+		}
+		if got := stringValue(cpu.Type, "kvm64"); got != cpuType(vmDef) {
+			differs("cpu type", cpuType(vmDef), got)
+		}
+	}
+	if got := stringValue(current.Bios, "seabios"); got != vmDef.Firmware {
+		differs("firmware", vmDef.Firmware, got)
+	}
+	// SeaBIOS VMs leave the machine type to Proxmox, OVMF VMs use q35
+	machine := stringValue(current.Machine, "")
+	if vmDef.Firmware == "ovmf" && machine != "q35" {
+		differs("machine", "q35", machine)
+	} else if vmDef.Firmware != "ovmf" && strings.HasPrefix(machine, "q35") {
+		differs("machine", "the Proxmox default", machine)
+	}
+	if current.OnBoot == nil || !*current.OnBoot {
+		differs("onBoot", true, false)
+	}
+	if current.Started == nil || !*current.Started {
+		differs("started", true, false)
+	}
+
+	if len(current.NetworkDevices) != len(vmDef.Bridges) {
+		differs("network devices", len(vmDef.Bridges), len(current.NetworkDevices))
+	}
+	for i, device := range current.NetworkDevices {
+		if i >= len(vmDef.Bridges) {
+			break
+		}
+		if got := stringValue(device.Bridge, ""); got != vmDef.Bridges[i] {
+			differs(fmt.Sprintf("net%d bridge", i), vmDef.Bridges[i], got)
+		}
+		if got := stringValue(device.Model, "virtio"); got != "virtio" {
+			differs(fmt.Sprintf("net%d model", i), "virtio", got)
+		}
+		if device.Firewall == nil || !*device.Firewall {
+			differs(fmt.Sprintf("net%d firewall", i), true, false)
+		}
+	}
+
+	wantEFI := vmDef.Firmware == "ovmf"
+	switch {
+	case wantEFI && current.EfiDisk == nil:
+		differs("efi disk", "a 4m EFI disk", "none")
+	case !wantEFI && current.EfiDisk != nil:
+		differs("efi disk", "none", "an EFI disk")
+	case wantEFI:
+		if got := stringValue(current.EfiDisk.Type, "2m"); got != "4m" {
+			differs("efi disk type", "4m", got)
+		}
+		if got := current.EfiDisk.PreEnrolledKeys != nil && *current.EfiDisk.PreEnrolledKeys; got != vmDef.SecureBoot {
+			differs("efi disk pre-enrolled keys", vmDef.SecureBoot, got)
+		}
+	}
+	wantTPM := wantEFI && vmDef.TPM
+	switch {
+	case wantTPM && current.TpmState == nil:
+		differs("tpm state", "a v2.0 TPM state disk", "none")
+	case !wantTPM && current.TpmState != nil:
+		differs("tpm state", "none", "a TPM state disk")
+	case wantTPM:
+		if got := stringValue(current.TpmState.Version, "v2.0"); got != "v2.0" {
+			differs("tpm version", "v2.0", got)
+		}
+	}
+
+	if vmDef.BootMethod == "ipxe" {
+		if current.Agent != nil && current.Agent.Enabled != nil && *current.Agent.Enabled {
+			differs("agent", "disabled", "enabled")
+		}
+		if strings.Join(current.BootOrders, ",") != strings.Join(ipxeBootOrder, ",") {
+			differs("boot order", strings.Join(ipxeBootOrder, ","), strings.Join(current.BootOrders, ","))
+		}
+	}
+
+	foundDisk := false
+	for _, disk := range current.Disks {
+		if disk.Interface != "scsi0" {
+			continue
+		}
+		foundDisk = true
+		if disk.Size != nil && int64(*disk.Size) != vmDef.DiskSize {
+			differs("diskSize", vmDef.DiskSize, *disk.Size)
+		}
+	}
+	if !foundDisk {
+		mismatches = append(mismatches, "disks: no scsi0 disk found")
+	}
+	return mismatches
+}
+
+// stringValue returns a string read from Proxmox, or fallback when Proxmox left it unset
+func stringValue(value *string, fallback string) string {
+	if value == nil || *value == "" {
+		return fallback
+	}
+	return *value
+}
+
+// firmwareArgs returns the machine type, EFI disk and TPM state for the VM's firmware.
+// All three are nil for SeaBIOS so existing VMs see no diff.
+func firmwareArgs(vmDef VM) (pulumi.StringPtrInput, vm.VirtualMachineEfiDiskPtrInput, vm.VirtualMachineTpmStatePtrInput) {
+	if vmDef.Firmware != "ovmf" {
+		return nil, nil, nil
+	}
+
+	efiDisk := &vm.VirtualMachineEfiDiskArgs{
+		DatastoreId:     pulumi.String(vmDef.EFIDatastore),
+		FileFormat:      pulumi.String("raw"),
+		Type:            pulumi.String("4m"), // required for Secure Boot
+		PreEnrolledKeys: pulumi.Bool(vmDef.SecureBoot),
+	}
+
+	var tpmState vm.VirtualMachineTpmStatePtrInput
+	if vmDef.TPM {
+		tpmState = &vm.VirtualMachineTpmStateArgs{
+			DatastoreId: pulumi.String(vmDef.EFIDatastore),
+			Version:     pulumi.String("v2.0"),
+		}
+	}
+	return pulumi.String("q35"), efiDisk, tpmState
+}
+
+// templateFirmwareCheck returns the bios input for a cloned VM. When the group sets a firmware
+// and the template is not built by this stack, the template is read from Proxmox first and the
+// input fails when its firmware differs: a SeaBIOS disk cloned into an OVMF VM (or the other
+// way round) does not boot.
+func templateFirmwareCheck(ctx *pulumi.Context, provider *proxmoxve.Provider, vmIndex int64, vmDef VM) (pulumi.StringPtrInput, error) {
+	if !vmDef.explicitFirmware || vmDef.declaredTemplate || importedVMID(vmDef, vmIndex) > 0 {
+		return pulumi.String(vmDef.Firmware), nil
+	}
+
+	vmName := fmt.Sprintf("%s-%d", vmDef.Name, vmIndex)
+	templateID := pulumi.ID(fmt.Sprintf("%s/%d", vmDef.TemplateNode, vmDef.TemplateID))
+	tmpl, err := vm.GetVirtualMachine(ctx, vmName+"-template-check", templateID, nil, pulumi.Provider(provider))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %d on %s for %s: %w", vmDef.TemplateID, vmDef.TemplateNode, vmName, err)
+	}
+
+	return tmpl.Bios.ApplyT(func(templateBios *string) (string, error) {
+		current := "seabios"
+		if templateBios != nil && *templateBios != "" {
+			current = *templateBios
+		}
+		if current != vmDef.Firmware {
+			return "", fmt.Errorf("VM %s uses firmware '%s' but template %d uses '%s'", vmName, vmDef.Firmware, vmDef.TemplateID, current)
+		}
+		return vmDef.Firmware, nil
+	}).(pulumi.StringOutput), nil
+}
+
+// networkDevices returns one virtio NIC per configured bridge
+func networkDevices(vmDef VM) vm.VirtualMachineNetworkDeviceArray {
+	var devices vm.VirtualMachineNetworkDeviceArray
+	for _, bridge := range vmDef.Bridges {
+		devices = append(devices, &vm.VirtualMachineNetworkDeviceArgs{
+			Bridge:   pulumi.String(bridge),
+			Model:    pulumi.String("virtio"),
+			Firewall: pulumi.Bool(true),
+		})
+	}
+	return devices
+}